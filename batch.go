@@ -0,0 +1,136 @@
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// BatchStorer operates on many items with as few round trips as possible.
+//
+// PutMany applies the same optimistic locking as Put to every item but does
+// not fail as a whole: if some items can not be stored it returns a
+// *BatchError with one entry per item (nil on success). Only the first
+// occurrence of a repeated id is stored, the rest fail with ErrVersionGone.
+//
+// GetMany returns the items in the same order as ids, nil for missing ones.
+type BatchStorer[T Identifier] interface {
+	PutMany(ctx context.Context, items []*T) error
+	GetMany(ctx context.Context, ids []string) ([]*T, error)
+	DeleteMany(ctx context.Context, ids []string) error
+}
+
+// BatchError reports which items of a batch failed. Errors is aligned with
+// the items of the batch, nil means that item was stored.
+type BatchError struct {
+	Errors []error
+}
+
+// NewBatchError returns a *BatchError if any of errs is not nil
+func NewBatchError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errors: errs}
+		}
+	}
+	return nil
+}
+
+func (e *BatchError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errors {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		failed++
+	}
+	return fmt.Sprintf("%d of %d items failed: %s", failed, len(e.Errors), first)
+}
+
+// Unwrap allows errors.Is(err, ErrVersionGone) on a batch
+func (e *BatchError) Unwrap() []error {
+	result := []error{}
+	for _, err := range e.Errors {
+		if err != nil {
+			result = append(result, err)
+		}
+	}
+	return result
+}
+
+// PutMany uses the native batch support of s if any, otherwise puts the items
+// one by one
+func PutMany[T Identifier](ctx context.Context, s Storer[T], items []*T) error {
+	if batch, ok := s.(BatchStorer[T]); ok {
+		return batch.PutMany(ctx, items)
+	}
+	return putEach(ctx, s, items)
+}
+
+// GetMany uses the native batch support of s if any, otherwise gets the items
+// one by one
+func GetMany[T Identifier](ctx context.Context, s Storer[T], ids []string) ([]*T, error) {
+	if batch, ok := s.(BatchStorer[T]); ok {
+		return batch.GetMany(ctx, ids)
+	}
+	return getEach(ctx, s, ids)
+}
+
+// DeleteMany uses the native batch support of s if any, otherwise deletes the
+// items one by one
+func DeleteMany[T Identifier](ctx context.Context, s Storer[T], ids []string) error {
+	if batch, ok := s.(BatchStorer[T]); ok {
+		return batch.DeleteMany(ctx, ids)
+	}
+	return deleteEach(ctx, s, ids)
+}
+
+// DuplicatedIds marks every repeated id after its first occurrence with
+// ErrVersionGone so batch implementations do not need to deal with them.
+func DuplicatedIds[T Identifier](items []*T) []error {
+	errs := make([]error, len(items))
+	seen := map[string]bool{}
+	for i, item := range items {
+		id := (*item).GetId()
+		if seen[id] {
+			errs[i] = ErrVersionGone
+		}
+		seen[id] = true
+	}
+	return errs
+}
+
+func putEach[T Identifier](ctx context.Context, s Storer[T], items []*T) error {
+	errs := DuplicatedIds(items)
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+		errs[i] = s.Put(ctx, item)
+	}
+	return NewBatchError(errs)
+}
+
+func getEach[T Identifier](ctx context.Context, s Storer[T], ids []string) ([]*T, error) {
+	result := make([]*T, len(ids))
+	for i, id := range ids {
+		item, err := s.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = item
+	}
+	return result, nil
+}
+
+func deleteEach[T Identifier](ctx context.Context, s Storer[T], ids []string) error {
+	for _, id := range ids {
+		if err := s.Delete(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// errNotCloneable is returned by the copiers of types that can not be copied
+// by reflection, see Clone
+var errNotCloneable = errors.New("not cloneable")
+
+// Cloner can be implemented by items to copy themselves faster than Clone
+// does. The copy must not share memory with the original.
+type Cloner[T any] interface {
+	Clone() *T
+}
+
+// Clone returns a deep copy of item, using its Cloner implementation if any.
+// Otherwise fields are copied by reflection, which is faster than JSON but
+// does not behave like it: json.Marshaler implementations and `json:"-"` tags
+// are ignored, every field is copied as it is. Unexported fields can not be
+// set by reflection, so types with unexported pointers, slices, maps or
+// interfaces (e.g. *big.Int or netip.Addr) are copied with JSONCodec, like
+// they are stored. time.Time is copied as a value. Items must not contain
+// cycles. It panics if the JSON copy fails.
+func Clone[T any](item *T) *T {
+	result, err := clone(item)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// clone is Clone returning the errors of the JSON copy instead of panicking
+func clone[T any](item *T) (*T, error) {
+	if item == nil {
+		return nil, nil
+	}
+	if cloner, ok := any(item).(Cloner[T]); ok {
+		return cloner.Clone(), nil
+	}
+
+	src := reflect.ValueOf(item).Elem()
+	c, err := copierOf(src.Type())
+	if err == nil {
+		dst := reflect.New(src.Type()).Elem()
+		if err = c(dst, src); err == nil {
+			return dst.Addr().Interface().(*T), nil
+		}
+	}
+	if !errors.Is(err, errNotCloneable) {
+		return nil, err
+	}
+
+	var result *T
+	if err := (JSONCodec{}).Copy(item, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// copier copies src into dst, which is settable. It only fails for values in
+// interfaces, the types of the other values are checked when it is built.
+type copier func(dst, src reflect.Value) error
+
+// immutableTypes are copied by assignment although they have unexported
+// references, they are never modified through them
+var immutableTypes = map[reflect.Type]bool{
+	reflect.TypeFor[time.Time](): true,
+}
+
+// copierEntry is a copier of a type or the reason there is none
+type copierEntry struct {
+	copy copier
+	err  error
+}
+
+var (
+	copiers      sync.Map // reflect.Type -> copierEntry, only complete copiers
+	copiersMutex sync.Mutex
+)
+
+// copierOf returns the copier of t, built once per type
+func copierOf(t reflect.Type) (copier, error) {
+	if e, ok := copiers.Load(t); ok {
+		return e.(copierEntry).copy, e.(copierEntry).err
+	}
+
+	copiersMutex.Lock()
+	defer copiersMutex.Unlock()
+
+	b := &copierBuilder{
+		building: map[reflect.Type]*copier{},
+		built:    map[reflect.Type]copier{},
+	}
+	c := b.build(t)
+	if b.err != nil {
+		copiers.Store(t, copierEntry{err: b.err})
+		return nil, b.err
+	}
+
+	// Publish when all are complete, recursive types refer to each other
+	for t, c := range b.built {
+		copiers.Store(t, copierEntry{copy: c})
+	}
+	return c, nil
+}
+
+// copierBuilder builds the copiers of a type and the types it contains.
+// Recursive types get an indirection to the copier being built.
+type copierBuilder struct {
+	building map[reflect.Type]*copier
+	built    map[reflect.Type]copier
+	err      error // the first type found that can not be copied
+}
+
+func (b *copierBuilder) build(t reflect.Type) copier {
+	if e, ok := copiers.Load(t); ok {
+		if e.(copierEntry).err != nil && b.err == nil {
+			b.err = e.(copierEntry).err
+		}
+		return e.(copierEntry).copy
+	}
+	if c, ok := b.built[t]; ok {
+		return c
+	}
+	if c, ok := b.building[t]; ok {
+		return func(dst, src reflect.Value) error { return (*c)(dst, src) }
+	}
+
+	c := new(copier)
+	b.building[t] = c
+	*c = b.newCopier(t)
+	delete(b.building, t)
+	b.built[t] = *c
+	return *c
+}
+
+func copyValue(dst, src reflect.Value) error {
+	dst.Set(src)
+	return nil
+}
+
+func (b *copierBuilder) newCopier(t reflect.Type) copier {
+	if !hasReferences(t, map[reflect.Type]bool{}) {
+		return copyValue
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		elem := b.build(t.Elem())
+		return func(dst, src reflect.Value) error {
+			if src.IsNil() {
+				dst.SetZero()
+				return nil
+			}
+			p := reflect.New(t.Elem())
+			if err := elem(p.Elem(), src.Elem()); err != nil {
+				return err
+			}
+			dst.Set(p)
+			return nil
+		}
+
+	case reflect.Interface:
+		return func(dst, src reflect.Value) error {
+			if src.IsNil() {
+				dst.SetZero()
+				return nil
+			}
+			value := src.Elem()
+			c, err := copierOf(value.Type())
+			if err != nil {
+				return err
+			}
+			copied := reflect.New(value.Type()).Elem()
+			if err := c(copied, value); err != nil {
+				return err
+			}
+			dst.Set(copied)
+			return nil
+		}
+
+	case reflect.Slice:
+		elem := b.build(t.Elem())
+		return func(dst, src reflect.Value) error {
+			if src.IsNil() {
+				dst.SetZero()
+				return nil
+			}
+			s := reflect.MakeSlice(t, src.Len(), src.Cap())
+			for i := 0; i < src.Len(); i++ {
+				if err := elem(s.Index(i), src.Index(i)); err != nil {
+					return err
+				}
+			}
+			dst.Set(s)
+			return nil
+		}
+
+	case reflect.Array:
+		elem := b.build(t.Elem())
+		return func(dst, src reflect.Value) error {
+			for i := 0; i < src.Len(); i++ {
+				if err := elem(dst.Index(i), src.Index(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+	case reflect.Map:
+		elem := b.build(t.Elem())
+		return func(dst, src reflect.Value) error {
+			if src.IsNil() {
+				dst.SetZero()
+				return nil
+			}
+			m := reflect.MakeMapWithSize(t, src.Len())
+			iterator := src.MapRange()
+			for iterator.Next() {
+				value := reflect.New(t.Elem()).Elem()
+				if err := elem(value, iterator.Value()); err != nil {
+					return err
+				}
+				m.SetMapIndex(iterator.Key(), value)
+			}
+			dst.Set(m)
+			return nil
+		}
+
+	case reflect.Struct:
+		type field struct {
+			index int
+			copy  copier
+		}
+		fields := []field{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !hasReferences(f.Type, map[reflect.Type]bool{}) {
+				continue // copied by the assignment
+			}
+			if !f.IsExported() {
+				if b.err == nil {
+					b.err = fmt.Errorf("%w: field '%s' of %s is unexported and can share memory", errNotCloneable, f.Name, t)
+				}
+				continue
+			}
+			fields = append(fields, field{index: i, copy: b.build(f.Type)})
+		}
+		return func(dst, src reflect.Value) error {
+			dst.Set(src)
+			for _, f := range fields {
+				if err := f.copy(dst.Field(f.index), src.Field(f.index)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	// chan, func and unsafe pointers are shared
+	return copyValue
+}
+
+// hasReferences reports if values of t can share memory, otherwise an
+// assignment is a deep copy
+func hasReferences(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if immutableTypes[t] {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+		return true
+	case reflect.Array:
+		return hasReferences(t.Elem(), visiting)
+	case reflect.Struct:
+		if visiting[t] {
+			return false
+		}
+		visiting[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			if hasReferences(t.Field(i).Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
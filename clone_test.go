@@ -0,0 +1,163 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"math/big"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+)
+
+type cloneTree struct {
+	Name     string
+	Children []*cloneTree
+	Labels   map[string][]string
+	Any      any
+	Matrix   [2][]int
+	When     time.Time
+	secret   string
+}
+
+func TestClone(t *testing.T) {
+
+	original := &cloneTree{
+		Name: "root",
+		Children: []*cloneTree{
+			{Name: "child", Labels: map[string][]string{"a": {"1"}}},
+		},
+		Labels: map[string][]string{"b": {"2", "3"}},
+		Any:    map[string]any{"nested": []any{"x"}},
+		Matrix: [2][]int{{1}, {2}},
+		When:   time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		secret: "kept",
+	}
+
+	copied := store.Clone(original)
+	biff.AssertEqual(copied, original)
+	biff.AssertEqual(copied.secret, "kept")
+	biff.AssertTrue(copied.When.Equal(original.When))
+
+	copied.Children[0].Name = "changed"
+	copied.Children[0].Labels["a"][0] = "changed"
+	copied.Labels["b"][0] = "changed"
+	copied.Any.(map[string]any)["nested"].([]any)[0] = "changed"
+	copied.Matrix[1][0] = 0
+
+	biff.AssertEqual(original.Children[0].Name, "child")
+	biff.AssertEqual(original.Children[0].Labels["a"][0], "1")
+	biff.AssertEqual(original.Labels["b"][0], "2")
+	biff.AssertEqual(original.Any.(map[string]any)["nested"].([]any)[0], "x")
+	biff.AssertEqual(original.Matrix[1][0], 2)
+}
+
+func TestClone_Nil(t *testing.T) {
+	biff.AssertNil(store.Clone[cloneTree](nil))
+
+	copied := store.Clone(&cloneTree{})
+	biff.AssertNil(copied.Children)
+	biff.AssertNil(copied.Labels)
+	biff.AssertNil(copied.Any)
+}
+
+type clonerItem struct {
+	*store.Id
+	cloned bool
+}
+
+func (c *clonerItem) Clone() *clonerItem {
+	return &clonerItem{Id: &store.Id{Id: c.Id.Id, Version: c.Version}, cloned: true}
+}
+
+func TestClone_Cloner(t *testing.T) {
+	copied := store.Clone(&clonerItem{Id: store.NewId("my-id")})
+	biff.AssertTrue(copied.cloned)
+	biff.AssertEqual(copied.GetId(), "my-id")
+}
+
+type bigItem struct {
+	*store.Id
+	Amount *big.Int
+	Any    any
+}
+
+type unexportedCloner struct {
+	*store.Id
+	tags map[string]bool
+}
+
+func (c *unexportedCloner) Clone() *unexportedCloner {
+	return &unexportedCloner{Id: &store.Id{Id: c.Id.Id, Version: c.Version}, tags: maps.Clone(c.tags)}
+}
+
+func TestClone_Unexported(t *testing.T) {
+
+	ctx := context.Background()
+
+	t.Run("Clone copies with JSON", func(t *testing.T) {
+		original := &bigItem{Id: store.NewId("my-id"), Amount: big.NewInt(42)}
+		copied := store.Clone(original)
+		biff.AssertEqual(copied.Amount.String(), "42")
+
+		copied.Amount.SetInt64(7)
+		biff.AssertEqual(original.Amount.String(), "42")
+	})
+
+	t.Run("Stores copy with JSON", func(t *testing.T) {
+		p := store.NewStoreMemory[bigItem]()
+		original := &bigItem{Id: store.NewId("my-id"), Amount: big.NewInt(42), Any: netip.MustParseAddr("10.0.0.1")}
+		biff.AssertNil(p.Put(ctx, original))
+
+		original.Amount.SetInt64(7)
+		stored, err := p.Get(ctx, "my-id")
+		biff.AssertNil(err)
+		biff.AssertEqual(stored.Amount.String(), "42")
+		biff.AssertEqual(stored.Any, "10.0.0.1")
+
+		items, err := p.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(items), 1)
+		biff.AssertEqual(items[0].Amount.String(), "42")
+	})
+
+	t.Run("Cloner", func(t *testing.T) {
+		p := store.NewStoreMemory[unexportedCloner]()
+		original := &unexportedCloner{Id: store.NewId("my-id"), tags: map[string]bool{"a": true}}
+		biff.AssertNil(p.Put(ctx, original))
+
+		original.tags["b"] = true
+		stored, err := p.Get(ctx, "my-id")
+		biff.AssertNil(err)
+		biff.AssertEqual(stored.tags, map[string]bool{"a": true})
+	})
+}
+
+func BenchmarkClone(b *testing.B) {
+
+	item := &testutils.TestItem{
+		Id:          store.NewId("my-id"),
+		Title:       "title",
+		Description: "description",
+		Subitems:    []*testutils.SubItem{{Field1: "a", Field2: "b"}, {Field1: "c", Field2: "d"}},
+		Counter:     7,
+	}
+
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			data, _ := json.Marshal(item)
+			var copied *testutils.TestItem
+			_ = json.Unmarshal(data, &copied)
+		}
+	})
+
+	b.Run("clone", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			store.Clone(item)
+		}
+	})
+}
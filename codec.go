@@ -0,0 +1,119 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec serializes items. All the codecs of this package use the json tags of
+// the types, so the same types work with any of them. Implementations must be
+// safe for concurrent use.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	// Copy deep copies in into out, a pointer like the one given to Unmarshal
+	Copy(in, out any) error
+}
+
+// extensioner is implemented by codecs that name the files of StoreDisk
+type extensioner interface {
+	Extension() string
+}
+
+// JSONCodec is the default codec, Indent is used if not empty
+type JSONCodec struct {
+	Indent string
+}
+
+func (c JSONCodec) Marshal(v any) ([]byte, error) {
+	if c.Indent != "" {
+		return json.MarshalIndent(v, "", c.Indent)
+	}
+	return json.Marshal(v)
+}
+
+func (c JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (c JSONCodec) Copy(in, out any) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+func (c JSONCodec) Extension() string {
+	return ".json"
+}
+
+// CBORCodec encodes items with CBOR (RFC 8949), smaller and faster to decode
+// than JSON
+type CBORCodec struct{}
+
+func (c CBORCodec) Marshal(v any) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (c CBORCodec) Unmarshal(data []byte, v any) error {
+	return cbor.Unmarshal(data, v)
+}
+
+func (c CBORCodec) Copy(in, out any) error {
+	b, err := cbor.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return cbor.Unmarshal(b, out)
+}
+
+func (c CBORCodec) Extension() string {
+	return ".cbor"
+}
+
+// MsgpackCodec encodes items with MessagePack
+type MsgpackCodec struct{}
+
+func (c MsgpackCodec) Marshal(v any) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	encoder := msgpack.NewEncoder(buffer)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (c MsgpackCodec) Unmarshal(data []byte, v any) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+func (c MsgpackCodec) Copy(in, out any) error {
+	b, err := c.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(b, out)
+}
+
+func (c MsgpackCodec) Extension() string {
+	return ".msgpack"
+}
+
+// copyItem returns a deep copy of item done by codec, or by Clone if nil
+func copyItem[T any](codec Codec, item *T) (*T, error) {
+	if codec == nil {
+		return clone(item)
+	}
+	var result *T
+	if err := codec.Copy(item, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
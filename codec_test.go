@@ -0,0 +1,116 @@
+package store_test
+
+import (
+	"context"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+)
+
+var codecs = []struct {
+	name  string
+	codec store.Codec
+}{
+	{"json", store.JSONCodec{}},
+	{"cbor", store.CBORCodec{}},
+	{"msgpack", store.MsgpackCodec{}},
+}
+
+func TestCodec(t *testing.T) {
+
+	item := &testutils.TestItem{
+		Id:          &store.Id{Id: "my-id", Version: 3},
+		Title:       "title",
+		Description: "description",
+		Subitems:    []*testutils.SubItem{{Field1: "a", Field2: "b"}},
+		Counter:     7,
+	}
+
+	for _, c := range codecs {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := c.codec.Marshal(item)
+			biff.AssertNil(err)
+
+			var decoded *testutils.TestItem
+			biff.AssertNil(c.codec.Unmarshal(data, &decoded))
+			biff.AssertEqual(decoded, item)
+
+			var copied *testutils.TestItem
+			biff.AssertNil(c.codec.Copy(item, &copied))
+			biff.AssertEqual(copied, item)
+
+			copied.Subitems[0].Field1 = "changed"
+			biff.AssertEqual(item.Subitems[0].Field1, "a")
+		})
+	}
+}
+
+func TestCodec_StoreMemory(t *testing.T) {
+	for _, c := range codecs {
+		t.Run(c.name, func(t *testing.T) {
+			newStore := func() *store.StoreMemory[testutils.TestItem] {
+				p := store.NewStoreMemory[testutils.TestItem]()
+				p.SetCodec(c.codec)
+				return p
+			}
+
+			testutils.SuitePersistencer(newStore(), t)
+			testutils.SuiteTransactor(newStore(), t)
+			testutils.SuiteWatcher(newStore(), t)
+		})
+	}
+}
+
+func TestCodec_StoreDisk(t *testing.T) {
+	for _, c := range codecs {
+		t.Run(c.name, func(t *testing.T) {
+			newStore := func(dir string) *store.StoreDisk[testutils.TestItem] {
+				disk, err := store.NewStoreDisk[testutils.TestItem](dir)
+				biff.AssertNil(err)
+				biff.AssertNil(disk.SetCodec(c.codec))
+				return disk
+			}
+
+			testutils.SuitePersistencer(newStore(t.TempDir()), t)
+			testutils.SuiteTransactor(newStore(t.TempDir()), t)
+
+			// files are named after the codec
+			dir := t.TempDir()
+			biff.AssertNil(newStore(dir).Put(context.Background(), &testutils.TestItem{Id: store.NewId("my-id")}))
+			extension := c.codec.(interface{ Extension() string }).Extension()
+			_, err := os.Stat(path.Join(dir, "my-id"+extension))
+			biff.AssertNil(err)
+		})
+	}
+}
+
+type floatItem struct {
+	*store.Id
+	Value float64 `json:"value"`
+}
+
+func TestCodec_CopyError(t *testing.T) {
+
+	ctx := context.Background()
+	p := store.NewStoreMemory[floatItem]()
+	p.SetCodec(store.JSONCodec{})
+
+	item := &floatItem{Id: store.NewId("nan"), Value: math.NaN()} // JSON has no NaN
+	biff.AssertNotNil(p.Put(ctx, item))
+	biff.AssertEqual(item.GetVersion(), int64(0))
+	biff.AssertNotNil(p.Create(ctx, item))
+
+	err := p.WithTx(ctx, func(tx store.Storer[floatItem]) error {
+		return tx.Put(ctx, item)
+	})
+	biff.AssertNotNil(err)
+
+	items, err := p.List(ctx)
+	biff.AssertNil(err)
+	biff.AssertEqual(len(items), 0)
+}
@@ -0,0 +1,447 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"iter"
+	"sync"
+)
+
+var ErrUnknownKey = errors.New("unknown key")
+
+// Keyring keeps the AES keys of an EncryptedStore by id. New records are
+// encrypted with the current key, the rest are kept to read older records.
+// It is safe for concurrent use.
+type Keyring struct {
+	mutex   sync.RWMutex
+	current string
+	keys    map[string]*keyringKey
+}
+
+type keyringKey struct {
+	aead     cipher.AEAD
+	nonceKey []byte // derives the nonces of deterministic encryption
+}
+
+// NewKeyring creates a keyring with keys (of 16, 24 or 32 bytes for AES-128,
+// AES-192 or AES-256) where current is the one used to encrypt
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{
+		keys: map[string]*keyringKey{},
+	}
+	for id, key := range keys {
+		if err := k.Add(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if err := k.SetCurrent(current); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Add adds or replaces a key, it does not change the current one
+func (k *Keyring) Add(id string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("key '%s': %s", id, err.Error())
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("key '%s': %s", id, err.Error())
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("deterministic nonce"))
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys[id] = &keyringKey{aead: aead, nonceKey: mac.Sum(nil)}
+	return nil
+}
+
+// SetCurrent changes the key used to encrypt, it must have been added
+func (k *Keyring) SetCurrent(id string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("%w: '%s'", ErrUnknownKey, id)
+	}
+	k.current = id
+	return nil
+}
+
+// Current returns the id of the key used to encrypt
+func (k *Keyring) Current() string {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.current
+}
+
+func (k *Keyring) key(id string) (*keyringKey, error) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+func (k *Keyring) currentKey() (string, *keyringKey) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+// EncryptedRecord is what EncryptedStore keeps in the underlying store. Id
+// and version are in clear so the underlying store can check versions.
+type EncryptedRecord struct {
+	*Id  `bson:",inline"`
+	Key  string `json:"key" bson:"key"`   // id of the key in the keyring
+	Data []byte `json:"data" bson:"data"` // nonce followed by the sealed item
+}
+
+// EncryptedStore encrypts the items with AES-GCM before they reach the
+// underlying store, which can be any store of EncryptedRecord (e.g. StoreDisk
+// or postgres). The id is authenticated with the item, so records can not be
+// moved between ids. Only the id and the version can be queried.
+type EncryptedStore[T Identifier] struct {
+	store     Storer[EncryptedRecord]
+	keyring   *Keyring
+	codec     Codec
+	committed *[]func() // inside WithTx, sets the versions once committed
+}
+
+func NewEncryptedStore[T Identifier](store Storer[EncryptedRecord], keyring *Keyring) *EncryptedStore[T] {
+	return &EncryptedStore[T]{
+		store:   store,
+		keyring: keyring,
+		codec:   JSONCodec{},
+	}
+}
+
+// SetCodec changes how items are serialized before they are encrypted. It
+// must be called before the store is used.
+func (s *EncryptedStore[T]) SetCodec(codec Codec) {
+	s.codec = codec
+}
+
+// encrypt seals the item with the current key, the record keeps the version
+// of the item
+func (s *EncryptedStore[T]) encrypt(item *T) (*EncryptedRecord, error) {
+	id := (*item).GetId()
+
+	data, err := s.codec.Marshal(item)
+	if err != nil {
+		return nil, fmt.Errorf("encoding item '%s': %s", id, err.Error())
+	}
+
+	keyId, key := s.keyring.currentKey()
+	sealed, err := seal(key.aead, data, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedRecord{
+		Id:   &Id{Id: id, Version: (*item).GetVersion()},
+		Key:  keyId,
+		Data: sealed,
+	}, nil
+}
+
+// decrypt opens the record, the item gets the version of the record
+func (s *EncryptedStore[T]) decrypt(record *EncryptedRecord) (*T, error) {
+	if record == nil {
+		return nil, nil
+	}
+
+	data, err := s.open(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var item *T
+	if err := s.codec.Unmarshal(data, &item); err != nil {
+		return nil, fmt.Errorf("decoding item '%s': %s", record.GetId(), err.Error())
+	}
+	(*item).SetVersion(record.GetVersion())
+	return item, nil
+}
+
+func (s *EncryptedStore[T]) open(record *EncryptedRecord) ([]byte, error) {
+	key, err := s.keyring.key(record.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := open(key.aead, record.Data, record.GetId())
+	if err != nil {
+		return nil, fmt.Errorf("decrypting item '%s': %s", record.GetId(), err.Error())
+	}
+	return data, nil
+}
+
+// seal encrypts data with a random nonce, authenticating aad (e.g. the id)
+func seal(aead cipher.AEAD, data []byte, aad string) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %s", err.Error())
+	}
+	return aead.Seal(nonce, nonce, data, []byte(aad)), nil
+}
+
+// open decrypts what seal returns
+func open(aead cipher.AEAD, sealed []byte, aad string) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("data too short")
+	}
+	return aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(aad))
+}
+
+func (s *EncryptedStore[T]) decryptAll(records []*EncryptedRecord) ([]*T, error) {
+	result := make([]*T, len(records))
+	for i, record := range records {
+		item, err := s.decrypt(record)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = item
+	}
+	return result, nil
+}
+
+func (s *EncryptedStore[T]) List(ctx context.Context) ([]*T, error) {
+	records, err := s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptAll(records)
+}
+
+func (s *EncryptedStore[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		var records iter.Seq2[*EncryptedRecord, error]
+		if iterable, ok := s.store.(Iterable[EncryptedRecord]); ok {
+			records = iterable.Iterate(ctx)
+		} else {
+			records = IterateItems(s.store.List(ctx))
+		}
+
+		for record, err := range records {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			item, err := s.decrypt(record)
+			if !yield(item, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *EncryptedStore[T]) ListPage(ctx context.Context, req PageRequest) (*Page[T], error) {
+	pager, ok := s.store.(Pager[EncryptedRecord])
+	if !ok {
+		items, err := s.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return PageItems(items, req)
+	}
+
+	page, err := pager.ListPage(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	items, err := s.decryptAll(page.Items)
+	if err != nil {
+		return nil, err
+	}
+	return &Page[T]{Items: items, NextCursor: page.NextCursor}, nil
+}
+
+func (s *EncryptedStore[T]) Put(ctx context.Context, item *T) error {
+	record, err := s.encrypt(item)
+	if err != nil {
+		return err
+	}
+	if err := s.store.Put(ctx, record); err != nil {
+		return err
+	}
+	s.stored(item, record)
+	return nil
+}
+
+// stored sets on item the version of its record once it is stored, inside
+// WithTx when the transaction is committed
+func (s *EncryptedStore[T]) stored(item *T, record *EncryptedRecord) {
+	if s.committed != nil {
+		*s.committed = append(*s.committed, func() { (*item).SetVersion(record.GetVersion()) })
+		return
+	}
+	(*item).SetVersion(record.GetVersion())
+}
+
+func (s *EncryptedStore[T]) Get(ctx context.Context, id string) (*T, error) {
+	record, err := s.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(record)
+}
+
+func (s *EncryptedStore[T]) Delete(ctx context.Context, id string) error {
+	return s.store.Delete(ctx, id)
+}
+
+func (s *EncryptedStore[T]) PutMany(ctx context.Context, items []*T) error {
+	records := make([]*EncryptedRecord, len(items))
+	for i, item := range items {
+		record, err := s.encrypt(item)
+		if err != nil {
+			return err
+		}
+		records[i] = record
+	}
+
+	err := PutMany(ctx, s.store, records)
+	batchErr, isBatch := err.(*BatchError)
+	if err != nil && !isBatch {
+		return err
+	}
+
+	for i, item := range items {
+		if isBatch && batchErr.Errors[i] != nil {
+			continue
+		}
+		s.stored(item, records[i])
+	}
+
+	return err
+}
+
+func (s *EncryptedStore[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+	records, err := GetMany(ctx, s.store, ids)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptAll(records)
+}
+
+func (s *EncryptedStore[T]) DeleteMany(ctx context.Context, ids []string) error {
+	return DeleteMany(ctx, s.store, ids)
+}
+
+// DeleteVersion relies on the underlying store if it can delete by version,
+// otherwise it checks the version and deletes
+func (s *EncryptedStore[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+	if deleter, ok := s.store.(VersionDeleter[EncryptedRecord]); ok {
+		return deleter.DeleteVersion(ctx, id, version)
+	}
+
+	current, err := s.store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return ErrNotFound
+	}
+	if current.GetVersion() != version {
+		return ErrVersionGone
+	}
+	return s.store.Delete(ctx, id)
+}
+
+// WithTx runs the transaction of the underlying store, encrypting through it
+func (s *EncryptedStore[T]) WithTx(ctx context.Context, fn func(tx Storer[T]) error) error {
+	transactor, ok := s.store.(Transactor[EncryptedRecord])
+	if !ok {
+		return ErrTxNotSupported
+	}
+
+	committed := []func(){}
+	err := transactor.WithTx(ctx, func(tx Storer[EncryptedRecord]) error {
+		return fn(&EncryptedStore[T]{
+			store:     tx,
+			keyring:   s.keyring,
+			codec:     s.codec,
+			committed: &committed,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, setVersion := range committed {
+		setVersion()
+	}
+	return nil
+}
+
+// Rotate makes keyId, already in the keyring, the current key and re-encrypts
+// with it the records of other keys. Records are written with the version
+// they were read with, so a record changed meanwhile fails the version check
+// and is skipped: it was written with the current key. Records are updated
+// with Update if the underlying store is a StrictStorer, otherwise with Put,
+// which would insert again a record deleted meanwhile. It returns how many
+// records were re-encrypted. Old keys must be kept in the keyring until the
+// rotation is done in all the processes sharing the store.
+func (s *EncryptedStore[T]) Rotate(ctx context.Context, keyId string) (int, error) {
+	if err := s.keyring.SetCurrent(keyId); err != nil {
+		return 0, err
+	}
+	_, key := s.keyring.currentKey()
+
+	write := s.store.Put
+	if strict, ok := s.store.(StrictStorer[EncryptedRecord]); ok {
+		write = strict.Update
+	}
+
+	records, err := s.store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return rotated, err
+		}
+		if record.Key == keyId {
+			continue
+		}
+
+		data, err := s.open(record)
+		if err != nil {
+			return rotated, err
+		}
+		sealed, err := seal(key.aead, data, record.GetId())
+		if err != nil {
+			return rotated, err
+		}
+		record.Key = keyId
+		record.Data = sealed
+
+		err = write(ctx, record)
+		if errors.Is(err, ErrVersionGone) || errors.Is(err, ErrNotFound) {
+			continue // changed or deleted meanwhile
+		}
+		if err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+
+	return rotated, nil
+}
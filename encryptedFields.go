@@ -0,0 +1,630 @@
+package store
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"iter"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FieldEncryptedStore encrypts the string fields of T tagged with
+// `store:"encrypted"` before they reach the underlying store, so the rest of
+// the item can still be queried. Fields in nested structs, pointers, slices and
+// map values are found too. Interface fields are rejected, what they hold can
+// not be known in advance. Empty strings are not encrypted.
+//
+// Encrypted values are "<key id>:<base64>" strings sealed with AES-GCM and
+// bound to the id and the field. Fields tagged `store:"encrypted,deterministic"`
+// are bound to the field only and get the same value for the same text and
+// key, which allows eq, ne and in filters in Find at the cost of revealing
+// which items share a value. Filters only match values encrypted with the
+// current key, see Rotate.
+type FieldEncryptedStore[T Identifier] struct {
+	store   Storer[T]
+	keyring *Keyring
+	structs map[reflect.Type][]encryptedField // structs with encrypted fields, maybe nested
+	paths   map[string]bool                   // path of every encrypted field -> deterministic
+
+	committed *[]func() // inside WithTx, sets the versions once committed
+}
+
+type encryptedField struct {
+	index         int
+	name          string // json name, empty for embedded structs
+	encrypted     bool   // otherwise it contains encrypted fields
+	deterministic bool
+}
+
+func NewFieldEncryptedStore[T Identifier](store Storer[T], keyring *Keyring) (*FieldEncryptedStore[T], error) {
+	s := &FieldEncryptedStore[T]{
+		store:   store,
+		keyring: keyring,
+		structs: map[reflect.Type][]encryptedField{},
+		paths:   map[string]bool{},
+	}
+	if _, err := s.plan(reflect.TypeFor[T](), "", map[reflect.Type]bool{}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// plan finds the encrypted fields of t and reports if there is any
+func (s *FieldEncryptedStore[T]) plan(t reflect.Type, path string, visiting map[reflect.Type]bool) (bool, error) {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return s.plan(t.Elem(), path, visiting)
+	case reflect.Map:
+		if keys, err := s.plan(t.Key(), path, visiting); err != nil || keys {
+			return false, fmt.Errorf("field '%s': map keys can not have encrypted fields", path)
+		}
+		return s.plan(t.Elem(), path, visiting)
+	case reflect.Interface, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		// the value could hold encrypted fields that would be stored in plain
+		return false, fmt.Errorf("field '%s': %s fields can not be checked for encrypted fields", path, t.Kind())
+	case reflect.Struct:
+	default:
+		return false, nil
+	}
+
+	if _, ok := s.structs[t]; ok {
+		return true, nil
+	}
+	if visiting[t] {
+		return true, nil // recursive, walk finds out if it has encrypted fields
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	fields := []encryptedField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, ok := jsonName(f)
+		if !ok {
+			continue
+		}
+		fieldPath := joinPath(path, name)
+
+		tag := strings.Split(f.Tag.Get("store"), ",")
+		if tag[0] == "encrypted" {
+			if f.Type.Kind() != reflect.String {
+				return false, fmt.Errorf("field '%s': only string fields can be encrypted", fieldPath)
+			}
+			deterministic := len(tag) > 1 && tag[1] == "deterministic"
+			fields = append(fields, encryptedField{index: i, name: name, encrypted: true, deterministic: deterministic})
+			s.paths[fieldPath] = deterministic
+			continue
+		}
+
+		nested, err := s.plan(f.Type, fieldPath, visiting)
+		if err != nil {
+			return false, err
+		}
+		if nested {
+			fields = append(fields, encryptedField{index: i, name: name})
+		}
+	}
+
+	if len(fields) > 0 {
+		s.structs[t] = fields
+	}
+	return len(fields) > 0, nil
+}
+
+// jsonName returns the name of the field in the JSON representation, empty
+// for embedded structs that are inlined
+func jsonName(f reflect.StructField) (string, bool) {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "-" {
+		return "", false
+	}
+	if name == "" && f.Anonymous {
+		return "", true
+	}
+	if name == "" {
+		name = f.Name
+	}
+	return name, true
+}
+
+func joinPath(path, name string) string {
+	if path == "" || name == "" {
+		return path + name
+	}
+	return path + "." + name
+}
+
+// walk calls fn with every encrypted field in v
+func (s *FieldEncryptedStore[T]) walk(v reflect.Value, path string, fn func(field reflect.Value, path string, deterministic bool) error) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		return s.walk(v.Elem(), path, fn)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := s.walk(v.Index(i), path, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		// map values are not addressable, change a copy and put it back
+		entries := v.MapRange()
+		for entries.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(entries.Value())
+			if err := s.walk(value, path, fn); err != nil {
+				return err
+			}
+			v.SetMapIndex(entries.Key(), value)
+		}
+		return nil
+	case reflect.Struct:
+		for _, f := range s.structs[v.Type()] {
+			fieldPath := joinPath(path, f.name)
+			var err error
+			if f.encrypted {
+				err = fn(v.Field(f.index), fieldPath, f.deterministic)
+			} else {
+				err = s.walk(v.Field(f.index), fieldPath, fn)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fieldAad binds an encrypted value to the field, and to the item unless it
+// is deterministic
+func fieldAad(id, path string, deterministic bool) string {
+	if deterministic {
+		return path
+	}
+	return id + "/" + path
+}
+
+func sealField(keyId string, key *keyringKey, id, path, text string, deterministic bool) (string, error) {
+	aad := fieldAad(id, path, deterministic)
+
+	var sealed []byte
+	if deterministic {
+		mac := hmac.New(sha256.New, key.nonceKey)
+		mac.Write([]byte(aad))
+		mac.Write([]byte{0})
+		mac.Write([]byte(text))
+		nonce := mac.Sum(nil)[:key.aead.NonceSize()]
+		sealed = key.aead.Seal(nonce, nonce, []byte(text), []byte(aad))
+	} else {
+		var err error
+		sealed, err = seal(key.aead, []byte(text), aad)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return keyId + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *FieldEncryptedStore[T]) openField(id, path, value string, deterministic bool) (string, error) {
+	// base64 has no ':', the key id could
+	separator := strings.LastIndex(value, ":")
+	if separator < 0 {
+		return "", fmt.Errorf("decrypting '%s' of item '%s': not encrypted", path, id)
+	}
+	keyId, encoded := value[:separator], value[separator+1:]
+	key, err := s.keyring.key(keyId)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("decrypting '%s' of item '%s': %s", path, id, err.Error())
+	}
+	text, err := open(key.aead, sealed, fieldAad(id, path, deterministic))
+	if err != nil {
+		return "", fmt.Errorf("decrypting '%s' of item '%s': %s", path, id, err.Error())
+	}
+	return string(text), nil
+}
+
+// encrypt returns a copy of item with the fields encrypted with the current
+// key
+func (s *FieldEncryptedStore[T]) encrypt(item *T) (*T, error) {
+	result, err := clone(item)
+	if err != nil {
+		return nil, err
+	}
+	id := (*item).GetId()
+	keyId, key := s.keyring.currentKey()
+
+	err = s.walk(reflect.ValueOf(result).Elem(), "", func(field reflect.Value, path string, deterministic bool) error {
+		if field.String() == "" {
+			return nil
+		}
+		sealed, err := sealField(keyId, key, id, path, field.String(), deterministic)
+		if err != nil {
+			return err
+		}
+		field.SetString(sealed)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// decrypt decrypts the fields of item in place
+func (s *FieldEncryptedStore[T]) decrypt(item *T) (*T, error) {
+	if item == nil {
+		return nil, nil
+	}
+	id := (*item).GetId()
+
+	err := s.walk(reflect.ValueOf(item).Elem(), "", func(field reflect.Value, path string, deterministic bool) error {
+		if field.String() == "" {
+			return nil
+		}
+		text, err := s.openField(id, path, field.String(), deterministic)
+		if err != nil {
+			return err
+		}
+		field.SetString(text)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (s *FieldEncryptedStore[T]) decryptAll(items []*T) ([]*T, error) {
+	for _, item := range items {
+		if _, err := s.decrypt(item); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// encryptedPath returns the path of the encrypted field of a filter or sort
+// field, which can have slice indexes
+func (s *FieldEncryptedStore[T]) encryptedPath(field string) (path string, deterministic, encrypted bool) {
+	parts := []string{}
+	for _, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	path = strings.Join(parts, ".")
+	deterministic, encrypted = s.paths[path]
+	return
+}
+
+// encryptFilter encrypts the values compared with deterministic fields, other
+// comparisons with encrypted fields can not be done by the underlying store
+func (s *FieldEncryptedStore[T]) encryptFilter(filter Filter) (Filter, error) {
+	switch filter.Op {
+	case "":
+		return filter, nil
+	case OpAnd, OpOr:
+		filters := make([]Filter, len(filter.Filters))
+		for i, sub := range filter.Filters {
+			encrypted, err := s.encryptFilter(sub)
+			if err != nil {
+				return Filter{}, err
+			}
+			filters[i] = encrypted
+		}
+		filter.Filters = filters
+		return filter, nil
+	}
+
+	path, deterministic, encrypted := s.encryptedPath(filter.Field)
+	if !encrypted || filter.Op == OpExists {
+		return filter, nil
+	}
+	if !deterministic || (filter.Op != OpEq && filter.Op != OpNe && filter.Op != OpIn) {
+		return Filter{}, fmt.Errorf("%w: '%s' is encrypted, only eq, ne, in and exists are allowed on deterministic fields", ErrInvalidFilter, filter.Field)
+	}
+
+	keyId, key := s.keyring.currentKey()
+	seal := func(value any) (any, error) {
+		text, ok := value.(string)
+		if !ok || text == "" {
+			return value, nil // never matches an encrypted value, or not encrypted
+		}
+		return sealField(keyId, key, "", path, text, true)
+	}
+
+	var err error
+	if filter.Op == OpIn {
+		values := make([]any, len(filter.Values))
+		for i, value := range filter.Values {
+			if values[i], err = seal(value); err != nil {
+				return Filter{}, err
+			}
+		}
+		filter.Values = values
+		return filter, nil
+	}
+	filter.Value, err = seal(filter.Value)
+	return filter, err
+}
+
+func (s *FieldEncryptedStore[T]) List(ctx context.Context) ([]*T, error) {
+	items, err := s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptAll(items)
+}
+
+func (s *FieldEncryptedStore[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		var items iter.Seq2[*T, error]
+		if iterable, ok := s.store.(Iterable[T]); ok {
+			items = iterable.Iterate(ctx)
+		} else {
+			items = IterateItems(s.store.List(ctx))
+		}
+
+		for item, err := range items {
+			if err == nil {
+				item, err = s.decrypt(item)
+			}
+			if !yield(item, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *FieldEncryptedStore[T]) ListPage(ctx context.Context, req PageRequest) (*Page[T], error) {
+	pager, ok := s.store.(Pager[T])
+	if !ok {
+		items, err := s.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return PageItems(items, req)
+	}
+
+	page, err := pager.ListPage(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.decryptAll(page.Items); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Find translates the filter for the underlying store (see
+// FieldEncryptedStore), or filters the decrypted items if it can not be
+// queried. Encrypted fields can not be sorted.
+func (s *FieldEncryptedStore[T]) Find(ctx context.Context, filter Filter, sort ...SortField) ([]*T, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ValidateSort(sort); err != nil {
+		return nil, err
+	}
+
+	querier, ok := s.store.(Querier[T])
+	if !ok {
+		items, err := s.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		items, err = FilterItems(items, filter)
+		if err != nil {
+			return nil, err
+		}
+		return items, SortItems(items, sort)
+	}
+
+	for _, field := range sort {
+		if _, _, encrypted := s.encryptedPath(field.Field); encrypted {
+			return nil, fmt.Errorf("%w: '%s' is encrypted and can not be sorted", ErrInvalidFilter, field.Field)
+		}
+	}
+	encrypted, err := s.encryptFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := querier.Find(ctx, encrypted, sort...)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptAll(items)
+}
+
+func (s *FieldEncryptedStore[T]) Put(ctx context.Context, item *T) error {
+	encrypted, err := s.encrypt(item)
+	if err != nil {
+		return err
+	}
+	if err := s.store.Put(ctx, encrypted); err != nil {
+		return err
+	}
+	s.stored(item, encrypted)
+	return nil
+}
+
+// stored sets on item the version of its encrypted copy once it is stored,
+// inside WithTx when the transaction is committed
+func (s *FieldEncryptedStore[T]) stored(item, encrypted *T) {
+	if s.committed != nil {
+		*s.committed = append(*s.committed, func() { (*item).SetVersion((*encrypted).GetVersion()) })
+		return
+	}
+	(*item).SetVersion((*encrypted).GetVersion())
+}
+
+func (s *FieldEncryptedStore[T]) Get(ctx context.Context, id string) (*T, error) {
+	item, err := s.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(item)
+}
+
+func (s *FieldEncryptedStore[T]) Delete(ctx context.Context, id string) error {
+	return s.store.Delete(ctx, id)
+}
+
+func (s *FieldEncryptedStore[T]) PutMany(ctx context.Context, items []*T) error {
+	encrypted := make([]*T, len(items))
+	for i, item := range items {
+		e, err := s.encrypt(item)
+		if err != nil {
+			return err
+		}
+		encrypted[i] = e
+	}
+
+	err := PutMany(ctx, s.store, encrypted)
+	batchErr, isBatch := err.(*BatchError)
+	if err != nil && !isBatch {
+		return err
+	}
+
+	for i, item := range items {
+		if isBatch && batchErr.Errors[i] != nil {
+			continue
+		}
+		s.stored(item, encrypted[i])
+	}
+
+	return err
+}
+
+func (s *FieldEncryptedStore[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+	items, err := GetMany(ctx, s.store, ids)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptAll(items)
+}
+
+func (s *FieldEncryptedStore[T]) DeleteMany(ctx context.Context, ids []string) error {
+	return DeleteMany(ctx, s.store, ids)
+}
+
+// DeleteVersion relies on the underlying store if it can delete by version,
+// otherwise it checks the version and deletes
+func (s *FieldEncryptedStore[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+	if deleter, ok := s.store.(VersionDeleter[T]); ok {
+		return deleter.DeleteVersion(ctx, id, version)
+	}
+
+	current, err := s.store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return ErrNotFound
+	}
+	if (*current).GetVersion() != version {
+		return ErrVersionGone
+	}
+	return s.store.Delete(ctx, id)
+}
+
+// WithTx runs the transaction of the underlying store, encrypting through it
+func (s *FieldEncryptedStore[T]) WithTx(ctx context.Context, fn func(tx Storer[T]) error) error {
+	transactor, ok := s.store.(Transactor[T])
+	if !ok {
+		return ErrTxNotSupported
+	}
+
+	committed := []func(){}
+	err := transactor.WithTx(ctx, func(tx Storer[T]) error {
+		txStore := *s
+		txStore.store = tx
+		txStore.committed = &committed
+		return fn(&txStore)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, setVersion := range committed {
+		setVersion()
+	}
+	return nil
+}
+
+// Rotate makes keyId, already in the keyring, the current key and encrypts
+// again with it every item, like EncryptedStore.Rotate does. It returns how
+// many items were written.
+func (s *FieldEncryptedStore[T]) Rotate(ctx context.Context, keyId string) (int, error) {
+	if err := s.keyring.SetCurrent(keyId); err != nil {
+		return 0, err
+	}
+
+	write := s.store.Put
+	if strict, ok := s.store.(StrictStorer[T]); ok {
+		write = strict.Update
+	}
+
+	items, err := s.store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return rotated, err
+		}
+
+		current := true
+		err := s.walk(reflect.ValueOf(item).Elem(), "", func(field reflect.Value, path string, deterministic bool) error {
+			if value := field.String(); value != "" && !strings.HasPrefix(value, keyId+":") {
+				current = false
+			}
+			return nil
+		})
+		if err != nil {
+			return rotated, err
+		}
+		if current {
+			continue
+		}
+
+		if _, err := s.decrypt(item); err != nil {
+			return rotated, err
+		}
+		encrypted, err := s.encrypt(item)
+		if err != nil {
+			return rotated, err
+		}
+
+		err = write(ctx, encrypted)
+		if errors.Is(err, ErrVersionGone) || errors.Is(err, ErrNotFound) {
+			continue // changed or deleted meanwhile
+		}
+		if err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+
+	return rotated, nil
+}
@@ -0,0 +1,178 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+)
+
+func newFieldEncryptedStore[T store.Identifier](t *testing.T, raw store.Storer[T]) *store.FieldEncryptedStore[T] {
+	p, err := store.NewFieldEncryptedStore[T](raw, newKeyring(t))
+	biff.AssertNil(err)
+	return p
+}
+
+func TestFieldEncryptedStore(t *testing.T) {
+	raw := store.NewStoreMemory[testutils.SecretItem]()
+	testutils.SuiteFieldEncryption(newFieldEncryptedStore(t, raw), raw, t)
+}
+
+func TestFieldEncryptedStore_Disk(t *testing.T) {
+
+	dir := t.TempDir()
+	raw, err := store.NewStoreDisk[testutils.SecretItem](dir)
+	biff.AssertNil(err)
+
+	testutils.SuiteFieldEncryption(newFieldEncryptedStore(t, raw), raw, t)
+
+	data, err := os.ReadFile(path.Join(dir, "s-1.json"))
+	biff.AssertNil(err)
+	biff.AssertTrue(strings.Contains(string(data), `"email": "k1:`))
+	biff.AssertTrue(!strings.Contains(string(data), "shared@example.com"))
+}
+
+// Items without encrypted fields are passed through
+
+func newFieldEncryptedTestItems(t *testing.T) store.Storer[testutils.TestItem] {
+	return newFieldEncryptedStore(t, store.NewStoreMemory[testutils.TestItem]())
+}
+
+func TestFieldEncryptedStore_Persistencer(t *testing.T) {
+	testutils.SuitePersistencer(newFieldEncryptedTestItems(t), t)
+}
+
+func TestFieldEncryptedStore_Pagination(t *testing.T) {
+	testutils.SuitePagination(newFieldEncryptedTestItems(t), t)
+}
+
+func TestFieldEncryptedStore_Querier(t *testing.T) {
+	testutils.SuiteQuerier(newFieldEncryptedTestItems(t), t)
+}
+
+func TestFieldEncryptedStore_Batch(t *testing.T) {
+	testutils.SuiteBatch(newFieldEncryptedTestItems(t), t)
+}
+
+func TestFieldEncryptedStore_Transactor(t *testing.T) {
+	testutils.SuiteTransactor(newFieldEncryptedTestItems(t), t)
+}
+
+func TestFieldEncryptedStore_VersionDeleter(t *testing.T) {
+	testutils.SuiteVersionDeleter(newFieldEncryptedTestItems(t), t)
+}
+
+func TestFieldEncryptedStore_Aliasing(t *testing.T) {
+	testutils.SuiteAliasing(newFieldEncryptedTestItems(t), t)
+}
+
+type secretNode struct {
+	*store.Id
+	Secret   string        `json:"secret" store:"encrypted"`
+	Children []*secretNode `json:"children"`
+}
+
+func TestFieldEncryptedStore_Recursive(t *testing.T) {
+
+	ctx := context.Background()
+	raw := store.NewStoreMemory[secretNode]()
+	p := newFieldEncryptedStore(t, raw)
+
+	biff.AssertNil(p.Put(ctx, &secretNode{
+		Id:       store.NewId("root"),
+		Secret:   "root secret",
+		Children: []*secretNode{{Secret: "child secret"}},
+	}))
+
+	stored, err := raw.Get(ctx, "root")
+	biff.AssertNil(err)
+	biff.AssertTrue(strings.HasPrefix(stored.Children[0].Secret, "k1:"))
+
+	item, err := p.Get(ctx, "root")
+	biff.AssertNil(err)
+	biff.AssertEqual(item.Children[0].Secret, "child secret")
+}
+
+func TestFieldEncryptedStore_Rotate(t *testing.T) {
+
+	ctx := context.Background()
+	raw := store.NewStoreMemory[testutils.SecretItem]()
+	p := newFieldEncryptedStore(t, raw)
+
+	for _, id := range []string{"a", "b"} {
+		biff.AssertNil(p.Put(ctx, &testutils.SecretItem{Id: store.NewId(id), Email: id + "@example.com"}))
+	}
+
+	rotated, err := p.Rotate(ctx, "k2")
+	biff.AssertNil(err)
+	biff.AssertEqual(rotated, 2)
+
+	stored, err := raw.Get(ctx, "a")
+	biff.AssertNil(err)
+	biff.AssertTrue(strings.HasPrefix(stored.Email, "k2:"))
+
+	items, err := p.Find(ctx, store.Eq("email", "a@example.com"))
+	biff.AssertNil(err)
+	biff.AssertEqual(len(items), 1)
+	biff.AssertEqual(items[0].GetVersion(), int64(2))
+
+	rotated, err = p.Rotate(ctx, "k2")
+	biff.AssertNil(err)
+	biff.AssertEqual(rotated, 0)
+
+	_, err = p.Rotate(ctx, "missing")
+	biff.AssertTrue(errors.Is(err, store.ErrUnknownKey))
+}
+
+type invalidSecret struct {
+	*store.Id
+	Pin int `json:"pin" store:"encrypted"`
+}
+
+func TestFieldEncryptedStore_InvalidTag(t *testing.T) {
+	_, err := store.NewFieldEncryptedStore[invalidSecret](store.NewStoreMemory[invalidSecret](), newKeyring(t))
+	biff.AssertNotNil(err)
+}
+
+type secretMap struct {
+	*store.Id
+	Cards map[string]testutils.SecretCard `json:"cards"`
+}
+
+func TestFieldEncryptedStore_Map(t *testing.T) {
+
+	ctx := context.Background()
+	raw := store.NewStoreMemory[secretMap]()
+	p := newFieldEncryptedStore(t, raw)
+
+	original := &secretMap{
+		Id:    store.NewId("m"),
+		Cards: map[string]testutils.SecretCard{"main": {Number: "4111"}},
+	}
+	biff.AssertNil(p.Put(ctx, original))
+	biff.AssertEqual(original.Cards["main"].Number, "4111") // the copy is encrypted
+
+	stored, err := raw.Get(ctx, "m")
+	biff.AssertNil(err)
+	biff.AssertTrue(strings.HasPrefix(stored.Cards["main"].Number, "k1:"))
+
+	item, err := p.Get(ctx, "m")
+	biff.AssertNil(err)
+	biff.AssertEqual(item.Cards["main"].Number, "4111")
+}
+
+type secretAny struct {
+	*store.Id
+	Any any `json:"any"`
+}
+
+func TestFieldEncryptedStore_Interface(t *testing.T) {
+	_, err := store.NewFieldEncryptedStore[secretAny](store.NewStoreMemory[secretAny](), newKeyring(t))
+	biff.AssertNotNil(err)
+}
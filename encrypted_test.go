@@ -0,0 +1,165 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+)
+
+func newKeyring(t *testing.T) *store.Keyring {
+	keyring, err := store.NewKeyring("k1", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	})
+	biff.AssertNil(err)
+	return keyring
+}
+
+func newEncryptedStore(t *testing.T) *store.EncryptedStore[testutils.TestItem] {
+	return store.NewEncryptedStore[testutils.TestItem](store.NewStoreMemory[store.EncryptedRecord](), newKeyring(t))
+}
+
+func TestEncryptedStore(t *testing.T) {
+	testutils.SuitePersistencer(newEncryptedStore(t), t)
+}
+
+func TestEncryptedStore_Pagination(t *testing.T) {
+	testutils.SuitePagination(newEncryptedStore(t), t)
+}
+
+func TestEncryptedStore_Iterable(t *testing.T) {
+	testutils.SuiteIterable(newEncryptedStore(t), t)
+}
+
+func TestEncryptedStore_Batch(t *testing.T) {
+	testutils.SuiteBatch(newEncryptedStore(t), t)
+}
+
+func TestEncryptedStore_Transactor(t *testing.T) {
+	testutils.SuiteTransactor(newEncryptedStore(t), t)
+}
+
+func TestEncryptedStore_VersionDeleter(t *testing.T) {
+	testutils.SuiteVersionDeleter(newEncryptedStore(t), t)
+}
+
+func TestEncryptedStore_Aliasing(t *testing.T) {
+	testutils.SuiteAliasing(newEncryptedStore(t), t)
+}
+
+func TestEncryptedStore_Disk(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	disk, err := store.NewStoreDisk[store.EncryptedRecord](dir)
+	biff.AssertNil(err)
+	p := store.NewEncryptedStore[testutils.TestItem](disk, newKeyring(t))
+
+	testutils.SuitePersistencer(p, t)
+
+	biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("secret"), Title: "my secret title"}))
+	data, err := os.ReadFile(path.Join(dir, "secret.json"))
+	biff.AssertNil(err)
+	biff.AssertTrue(bytes.Contains(data, []byte(`"key": "k1"`)))
+	biff.AssertTrue(!bytes.Contains(data, []byte("my secret title")))
+}
+
+func TestEncryptedStore_Rotate(t *testing.T) {
+
+	ctx := context.Background()
+	records := store.NewStoreMemory[store.EncryptedRecord]()
+	keyring := newKeyring(t)
+	p := store.NewEncryptedStore[testutils.TestItem](records, keyring)
+
+	for _, id := range []string{"a", "b", "c"} {
+		biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId(id), Title: id}))
+	}
+
+	keyOf := func(id string) string {
+		record, err := records.Get(ctx, id)
+		biff.AssertNil(err)
+		return record.Key
+	}
+
+	t.Run("Unknown key", func(t *testing.T) {
+		_, err := p.Rotate(ctx, "missing")
+		biff.AssertTrue(errors.Is(err, store.ErrUnknownKey))
+		biff.AssertEqual(keyring.Current(), "k1")
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		rotated, err := p.Rotate(ctx, "k2")
+		biff.AssertNil(err)
+		biff.AssertEqual(rotated, 3)
+		biff.AssertEqual(keyOf("a"), "k2")
+
+		item, err := p.Get(ctx, "a")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "a")
+		biff.AssertEqual(item.GetVersion(), int64(2)) // written again
+
+		rotated, err = p.Rotate(ctx, "k2")
+		biff.AssertNil(err)
+		biff.AssertEqual(rotated, 0)
+	})
+
+	t.Run("New records use the current key", func(t *testing.T) {
+		biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("d")}))
+		biff.AssertEqual(keyOf("d"), "k2")
+	})
+
+	t.Run("Old records stay readable", func(t *testing.T) {
+		biff.AssertNil(keyring.SetCurrent("k1"))
+		biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("e"), Title: "e"}))
+		biff.AssertNil(keyring.SetCurrent("k2"))
+
+		item, err := p.Get(ctx, "e")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "e")
+	})
+
+	t.Run("Missing key", func(t *testing.T) {
+		other := store.NewEncryptedStore[testutils.TestItem](records, func() *store.Keyring {
+			keyring, err := store.NewKeyring("k3", map[string][]byte{"k3": bytes.Repeat([]byte{3}, 16)})
+			biff.AssertNil(err)
+			return keyring
+		}())
+
+		_, err := other.Get(ctx, "a")
+		biff.AssertTrue(errors.Is(err, store.ErrUnknownKey))
+	})
+}
+
+func TestEncryptedStore_Tampering(t *testing.T) {
+
+	ctx := context.Background()
+	records := store.NewStoreMemory[store.EncryptedRecord]()
+	p := store.NewEncryptedStore[testutils.TestItem](records, newKeyring(t))
+
+	biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("a"), Title: "a"}))
+	biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("b"), Title: "b"}))
+
+	// the record of a can not be moved to b
+	a, err := records.Get(ctx, "a")
+	biff.AssertNil(err)
+	b, err := records.Get(ctx, "b")
+	biff.AssertNil(err)
+	b.Data = a.Data
+	biff.AssertNil(records.Put(ctx, b))
+
+	_, err = p.Get(ctx, "b")
+	biff.AssertNotNil(err)
+}
+
+func TestKeyring_InvalidKey(t *testing.T) {
+	_, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("short")})
+	biff.AssertNotNil(err)
+}
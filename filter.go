@@ -0,0 +1,295 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+type Operator string
+
+const (
+	OpEq     Operator = "eq"
+	OpNe     Operator = "ne"
+	OpLt     Operator = "lt"
+	OpLte    Operator = "lte"
+	OpGt     Operator = "gt"
+	OpGte    Operator = "gte"
+	OpIn     Operator = "in"
+	OpExists Operator = "exists"
+	OpAnd    Operator = "and"
+	OpOr     Operator = "or"
+)
+
+// Filter is a small backend agnostic query model. Field is a dot separated
+// path over the JSON representation of the item (e.g. "title" or
+// "subitems.0.field1"). The zero Filter matches everything.
+//
+// Semantics shared by all backends:
+//   - eq/in never match a missing field, ne always does.
+//   - lt/lte/gt/gte only compare numbers with numbers and strings with strings
+//     (byte order), a field of another type never matches.
+//   - exists matches fields present in the document, even if they are null.
+type Filter struct {
+	Op      Operator `json:"op,omitempty"`
+	Field   string   `json:"field,omitempty"`
+	Value   any      `json:"value,omitempty"`
+	Values  []any    `json:"values,omitempty"`  // used by in
+	Filters []Filter `json:"filters,omitempty"` // used by and/or
+}
+
+// Querier finds the items matching a filter. Without sort fields the order of
+// the results is unspecified. List and ListPage can not be sorted (pages are
+// in id order), the sorted listing of all the items is Find with an empty
+// filter, e.g. Find(ctx, Filter{}, Desc("counter")), and every store sorts
+// like SortItems.
+type Querier[T Identifier] interface {
+	Find(ctx context.Context, filter Filter, sort ...SortField) ([]*T, error)
+}
+
+func Eq(field string, value any) Filter {
+	return Filter{Op: OpEq, Field: field, Value: value}
+}
+
+func Ne(field string, value any) Filter {
+	return Filter{Op: OpNe, Field: field, Value: value}
+}
+
+func Lt(field string, value any) Filter {
+	return Filter{Op: OpLt, Field: field, Value: value}
+}
+
+func Lte(field string, value any) Filter {
+	return Filter{Op: OpLte, Field: field, Value: value}
+}
+
+func Gt(field string, value any) Filter {
+	return Filter{Op: OpGt, Field: field, Value: value}
+}
+
+func Gte(field string, value any) Filter {
+	return Filter{Op: OpGte, Field: field, Value: value}
+}
+
+func In(field string, values ...any) Filter {
+	return Filter{Op: OpIn, Field: field, Values: values}
+}
+
+func Exists(field string, exists bool) Filter {
+	return Filter{Op: OpExists, Field: field, Value: exists}
+}
+
+func And(filters ...Filter) Filter {
+	return Filter{Op: OpAnd, Filters: filters}
+}
+
+func Or(filters ...Filter) Filter {
+	return Filter{Op: OpOr, Filters: filters}
+}
+
+// IsEmpty returns true if the filter matches everything
+func (f Filter) IsEmpty() bool {
+	return f.Op == ""
+}
+
+// Validate checks the filter is well formed so backends can compile it
+// without further checks.
+func (f Filter) Validate() error {
+	switch f.Op {
+	case "":
+		return nil
+	case OpAnd, OpOr:
+		for _, sub := range f.Filters {
+			if sub.IsEmpty() {
+				return fmt.Errorf("%w: empty filter inside '%s'", ErrInvalidFilter, f.Op)
+			}
+			if err := sub.Validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if f.Field == "" {
+		return fmt.Errorf("%w: '%s' requires a field", ErrInvalidFilter, f.Op)
+	}
+
+	switch f.Op {
+	case OpEq, OpNe, OpIn:
+		return nil
+	case OpLt, OpLte, OpGt, OpGte:
+		if _, ok := normalize(f.Value).(float64); ok {
+			return nil
+		}
+		if _, ok := f.Value.(string); ok {
+			return nil
+		}
+		return fmt.Errorf("%w: '%s' only compares numbers or strings", ErrInvalidFilter, f.Op)
+	case OpExists:
+		if _, ok := f.Value.(bool); !ok {
+			return fmt.Errorf("%w: 'exists' requires a boolean", ErrInvalidFilter)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: unknown operator '%s'", ErrInvalidFilter, f.Op)
+}
+
+// Path splits the field into its parts
+func (f Filter) Path() []string {
+	return strings.Split(f.Field, ".")
+}
+
+// Match evaluates the filter in process against the JSON representation of
+// item. It is used by stores without a native query language.
+func Match(item any, filter Filter) (bool, error) {
+	if err := filter.Validate(); err != nil {
+		return false, err
+	}
+	return match(normalize(item), filter), nil
+}
+
+// FilterItems returns the items matching the filter, preserving order
+func FilterItems[T Identifier](items []*T, filter Filter) ([]*T, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := []*T{}
+	for _, item := range items {
+		if filter.IsEmpty() || match(normalize(item), filter) {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+func match(doc any, f Filter) bool {
+	switch f.Op {
+	case "":
+		return true
+	case OpAnd:
+		for _, sub := range f.Filters {
+			if !match(doc, sub) {
+				return false
+			}
+		}
+		return true
+	case OpOr:
+		for _, sub := range f.Filters {
+			if match(doc, sub) {
+				return true
+			}
+		}
+		return false
+	}
+
+	value, found := lookup(doc, f.Path())
+
+	switch f.Op {
+	case OpEq:
+		return found && reflect.DeepEqual(value, normalize(f.Value))
+	case OpNe:
+		return !found || !reflect.DeepEqual(value, normalize(f.Value))
+	case OpIn:
+		if !found {
+			return false
+		}
+		for _, v := range f.Values {
+			if reflect.DeepEqual(value, normalize(v)) {
+				return true
+			}
+		}
+		return false
+	case OpExists:
+		return found == f.Value.(bool)
+	case OpLt, OpLte, OpGt, OpGte:
+		if !found {
+			return false
+		}
+		c, ok := compare(value, normalize(f.Value))
+		if !ok {
+			return false
+		}
+		switch f.Op {
+		case OpLt:
+			return c < 0
+		case OpLte:
+			return c <= 0
+		case OpGt:
+			return c > 0
+		default:
+			return c >= 0
+		}
+	}
+
+	return false
+}
+
+// compare returns -1, 0 or 1 if a and b are both numbers or both strings
+func compare(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+	return 0, false
+}
+
+func lookup(doc any, path []string) (any, bool) {
+	current := doc
+	for _, part := range path {
+		switch node := current.(type) {
+		case map[string]any:
+			value, ok := node[part]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// normalize converts any value to its generic JSON representation so values
+// coming from filters and items can be compared.
+func normalize(value any) any {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var result any
+	if err := json.Unmarshal(b, &result); err != nil {
+		return value
+	}
+	return result
+}
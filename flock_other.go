@@ -0,0 +1,29 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package store
+
+import (
+	"os"
+	"sync"
+)
+
+// Without flock the lock only works inside this process: sharing a data
+// directory between processes is not safe on these platforms.
+var fileLocks sync.Map // file name -> *sync.Mutex
+
+func lockFile(file *os.File) error {
+	mutex, _ := fileLocks.LoadOrStore(file.Name(), &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	mutex, _ := fileLocks.Load(file.Name())
+	mutex.(*sync.Mutex).Unlock()
+	return nil
+}
+
+func tryLockFile(file *os.File) (bool, error) {
+	mutex, _ := fileLocks.LoadOrStore(file.Name(), &sync.Mutex{})
+	return mutex.(*sync.Mutex).TryLock(), nil
+}
@@ -2,11 +2,17 @@ package store
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"sync"
 )
 
 type StoreCached[T Identifier] struct {
-	persistence Storer[T] // Persistent storage (e.g., StoreDisk)
-	cache       Storer[T] // Caching layer (e.g., StoreMemory)
+	persistence Storer[T]  // Persistent storage (e.g., StoreDisk)
+	cache       Storer[T]  // Caching layer (e.g., StoreMemory)
+	codec       Codec      // copies the items put into the cache, nil is Clone
+	strictMutex sync.Mutex // held by strict writes without transactions, see writeStrict
 }
 
 func NewStoreCached[T Identifier](persistence Storer[T], cache Storer[T]) (*StoreCached[T], error) {
@@ -21,27 +27,249 @@ func NewStoreCached[T Identifier](persistence Storer[T], cache Storer[T]) (*Stor
 		return nil, err
 	}
 
+	s := &StoreCached[T]{
+		persistence: persistence,
+		cache:       cache,
+	}
 	for _, item := range items {
-		_ = cache.Put(context.Background(), item)
+		_ = s.cacheStored(context.Background(), item)
 	}
 
-	return &StoreCached[T]{
-		persistence: persistence,
-		cache:       cache,
-	}, nil
+	return s, nil
+}
+
+// SetCodec changes how items are copied before they are put into the cache.
+// The persistence and the cache keep their own codecs, set on them before
+// NewStoreCached.
+func (s *StoreCached[T]) SetCodec(codec Codec) {
+	s.codec = codec
 }
 
 func (s *StoreCached[T]) List(ctx context.Context) ([]*T, error) {
 	return s.cache.List(ctx)
 }
 
+func (s *StoreCached[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	if iterable, ok := s.cache.(Iterable[T]); ok {
+		return iterable.Iterate(ctx)
+	}
+	return IterateItems(s.cache.List(ctx))
+}
+
+func (s *StoreCached[T]) ListPage(ctx context.Context, req PageRequest) (*Page[T], error) {
+	if pager, ok := s.cache.(Pager[T]); ok {
+		return pager.ListPage(ctx, req)
+	}
+
+	items, err := s.cache.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return PageItems(items, req)
+}
+
+func (s *StoreCached[T]) Find(ctx context.Context, filter Filter, sort ...SortField) ([]*T, error) {
+	if querier, ok := s.cache.(Querier[T]); ok {
+		return querier.Find(ctx, filter, sort...)
+	}
+
+	items, err := s.cache.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err = FilterItems(items, filter)
+	if err != nil {
+		return nil, err
+	}
+	return items, SortItems(items, sort)
+}
+
+// uniqueChecker is implemented by caches with unique indexes
+type uniqueChecker[T Identifier] interface {
+	checkUniqueItem(item *T) error
+}
+
+// checkUnique rejects items that the cache would reject for its unique
+// indexes before they are persisted. It is a best effort check, a concurrent
+// write can still break it between the check and the cache update.
+func (s *StoreCached[T]) checkUnique(item *T) error {
+	if checker, ok := s.cache.(uniqueChecker[T]); ok {
+		return checker.checkUniqueItem(item)
+	}
+	return nil
+}
+
 func (s *StoreCached[T]) Put(ctx context.Context, item *T) error {
+	if err := s.checkUnique(item); err != nil {
+		return err
+	}
+
 	// 1. Persist first (source of truth)
 	if err := s.persistence.Put(ctx, item); err != nil {
 		return err
 	}
 	// 2. Update cache
-	return s.cache.Put(ctx, item)
+	return s.cacheStored(ctx, item)
+}
+
+// cacheStored puts in the cache a copy of an item already stored (and
+// versioned) by the persistence so both keep the same version. The cache is
+// expected to increment the version on Put like every store does.
+func (s *StoreCached[T]) cacheStored(ctx context.Context, item *T) error {
+	id := (*item).GetId()
+	version := (*item).GetVersion()
+
+	put := func() error {
+		cached, err := copyItem(s.codec, item)
+		if err != nil {
+			return err
+		}
+		(*cached).SetVersion(version - 1)
+		return s.cache.Put(ctx, cached)
+	}
+
+	err := put()
+	if errors.Is(err, ErrVersionGone) {
+		current, err := s.cache.Get(ctx, id)
+		if err == nil && current != nil && (*current).GetVersion() >= version {
+			return nil // the cache already has this or a newer version
+		}
+
+		// The cache is behind, e.g. changed by another process, replace it
+		_ = s.cache.Delete(ctx, id)
+		return put()
+	}
+
+	return err
+}
+
+// Create checks and writes in a transaction (see WithTx) so the cache is
+// locked until the item is persisted. Persistences without transactions
+// check it themselves, see writeStrict.
+func (s *StoreCached[T]) Create(ctx context.Context, item *T) error {
+	if _, ok := s.persistence.(Transactor[T]); !ok {
+		return s.writeStrict(ctx, item, true)
+	}
+
+	id := (*item).GetId()
+	version := (*item).GetVersion()
+
+	err := s.WithTx(ctx, func(tx Storer[T]) error {
+		current, err := tx.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			return ErrAlreadyExists
+		}
+		(*item).SetVersion(0)
+		return tx.Put(ctx, item)
+	})
+	if err != nil {
+		(*item).SetVersion(version)
+	}
+	if errors.Is(err, ErrVersionGone) {
+		return ErrAlreadyExists // created meanwhile
+	}
+	return err
+}
+
+// Update checks and writes in a transaction (see WithTx) so the cache is
+// locked until the item is persisted. Persistences without transactions
+// check it themselves, see writeStrict.
+func (s *StoreCached[T]) Update(ctx context.Context, item *T) error {
+	if _, ok := s.persistence.(Transactor[T]); !ok {
+		return s.writeStrict(ctx, item, false)
+	}
+
+	id := (*item).GetId()
+	version := (*item).GetVersion()
+
+	err := s.WithTx(ctx, func(tx Storer[T]) error {
+		current, err := tx.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return ErrNotFound
+		}
+		return tx.Put(ctx, item)
+	})
+	if err != nil {
+		(*item).SetVersion(version)
+	}
+	return err
+}
+
+// writeStrict creates or updates item with the StrictStorer of the
+// persistence, which can not run transactions (e.g. StoreInception), and then
+// puts it into the cache. Strict writes are serialized so the cache gets them
+// in the same order as the persistence.
+func (s *StoreCached[T]) writeStrict(ctx context.Context, item *T, create bool) error {
+	strict, ok := s.persistence.(StrictStorer[T])
+	if !ok {
+		return ErrTxNotSupported
+	}
+	if err := s.checkUnique(item); err != nil {
+		return err
+	}
+
+	s.strictMutex.Lock()
+	defer s.strictMutex.Unlock()
+
+	write := strict.Update
+	if create {
+		write = strict.Create
+	}
+	// 1. Persist first (source of truth)
+	if err := write(ctx, item); err != nil {
+		return err
+	}
+	// 2. Update cache
+	return s.cacheStored(ctx, item)
+}
+
+func (s *StoreCached[T]) PutMany(ctx context.Context, items []*T) error {
+	errs := DuplicatedIds(items)
+	valid := []*T{}
+	positions := []int{}
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+		if errs[i] = s.checkUnique(item); errs[i] == nil {
+			valid = append(valid, item)
+			positions = append(positions, i)
+		}
+	}
+
+	// 1. Persist first (source of truth)
+	err := PutMany(ctx, s.persistence, valid)
+	batchErr, isBatch := err.(*BatchError)
+	if err != nil && !isBatch {
+		return err
+	}
+
+	// 2. Update cache with the items that were persisted
+	for j, item := range valid {
+		if isBatch && batchErr.Errors[j] != nil {
+			errs[positions[j]] = batchErr.Errors[j]
+			continue
+		}
+		if cacheErr := s.cacheStored(ctx, item); cacheErr != nil {
+			return cacheErr
+		}
+	}
+
+	return NewBatchError(errs)
+}
+
+// GetBy answers from the cache, which is where the indexes are kept
+func (s *StoreCached[T]) GetBy(ctx context.Context, index, value string) ([]*T, error) {
+	if getter, ok := s.cache.(IndexGetter[T]); ok {
+		return getter.GetBy(ctx, index, value)
+	}
+	return nil, fmt.Errorf("%w: '%s', the cache has no indexes", ErrUnknownIndex, index)
 }
 
 func (s *StoreCached[T]) Get(ctx context.Context, id string) (*T, error) {
@@ -61,11 +289,52 @@ func (s *StoreCached[T]) Get(ctx context.Context, id string) (*T, error) {
 	}
 
 	// 3. Update cache (read repair / populate)
-	_ = s.cache.Put(ctx, item)
+	_ = s.cacheStored(ctx, item)
 
 	return item, nil
 }
 
+func (s *StoreCached[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+	// 1. Check cache
+	result, err := GetMany(ctx, s.cache, ids)
+	if err != nil {
+		result = make([]*T, len(ids))
+	}
+
+	missing := []string{}
+	for i, item := range result {
+		if item == nil {
+			missing = append(missing, ids[i])
+		}
+	}
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	// 2. Fallback to persistence
+	found, err := GetMany(ctx, s.persistence, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	byId := map[string]*T{}
+	for _, item := range found {
+		if item == nil {
+			continue
+		}
+		byId[(*item).GetId()] = item
+		// 3. Update cache (read repair / populate)
+		_ = s.cacheStored(ctx, item)
+	}
+	for i, item := range result {
+		if item == nil {
+			result[i] = byId[ids[i]]
+		}
+	}
+
+	return result, nil
+}
+
 func (s *StoreCached[T]) Delete(ctx context.Context, id string) error {
 	// 1. Delete from persistence
 	if err := s.persistence.Delete(ctx, id); err != nil {
@@ -74,3 +343,164 @@ func (s *StoreCached[T]) Delete(ctx context.Context, id string) error {
 	// 2. Delete from cache
 	return s.cache.Delete(ctx, id)
 }
+
+// DeleteVersion relies on the persistence if it can delete by version,
+// otherwise it checks the version against the cache and deletes from both.
+func (s *StoreCached[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+	if deleter, ok := s.persistence.(VersionDeleter[T]); ok {
+		// 1. Delete from persistence
+		if err := deleter.DeleteVersion(ctx, id, version); err != nil {
+			return err
+		}
+		// 2. Delete from cache
+		return s.cache.Delete(ctx, id)
+	}
+
+	current, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return ErrNotFound
+	}
+	if (*current).GetVersion() != version {
+		return ErrVersionGone
+	}
+
+	// 1. Delete from persistence
+	if err := s.persistence.Delete(ctx, id); err != nil {
+		return err
+	}
+	// 2. Delete from cache
+	return s.cache.Delete(ctx, id)
+}
+
+func (s *StoreCached[T]) DeleteMany(ctx context.Context, ids []string) error {
+	// 1. Delete from persistence
+	if err := DeleteMany(ctx, s.persistence, ids); err != nil {
+		return err
+	}
+	// 2. Delete from cache
+	return DeleteMany(ctx, s.cache, ids)
+}
+
+// hookTransactor is implemented by caches able to run a hook on commit
+type hookTransactor[T Identifier] interface {
+	withTx(ctx context.Context, fn func(tx Storer[T]) error, hook txHook[T]) error
+}
+
+// WithTx runs the transaction against the cache, the optimistic checks are
+// done there. On commit the writes are persisted first (source of truth) in a
+// persistence transaction, which checks the versions again, and only then
+// become visible in the cache. Caches without commit hooks (e.g. in other
+// packages) are updated once the transaction is run against the persistence.
+func (s *StoreCached[T]) WithTx(ctx context.Context, fn func(tx Storer[T]) error) error {
+	persistence, ok := s.persistence.(Transactor[T])
+	if !ok {
+		return ErrTxNotSupported
+	}
+	cache, ok := s.cache.(hookTransactor[T])
+	if !ok {
+		return s.withPersistenceTx(ctx, persistence, fn)
+	}
+
+	return cache.withTx(ctx, fn, func(ctx context.Context, puts []*T, deletes []string) error {
+		return persistence.WithTx(ctx, func(tx Storer[T]) error {
+			for _, item := range puts {
+				// The cache already incremented the version, the
+				// persistence increments it again from the same base
+				(*item).SetVersion((*item).GetVersion() - 1)
+				if err := tx.Put(ctx, item); err != nil {
+					return err
+				}
+			}
+			for _, id := range deletes {
+				if err := tx.Delete(ctx, id); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// withPersistenceTx runs fn in a persistence transaction and then applies
+// its writes to the cache
+func (s *StoreCached[T]) withPersistenceTx(ctx context.Context, persistence Transactor[T], fn func(tx Storer[T]) error) error {
+	writes := map[string]recordedWrite[T]{}
+	order := []string{}
+	err := persistence.WithTx(ctx, func(tx Storer[T]) error {
+		return fn(&recordingTx[T]{Storer: tx, codec: s.codec, writes: writes, order: &order})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range order {
+		write := writes[id]
+		if write.copied == nil {
+			err = s.cache.Delete(ctx, id)
+		} else {
+			// The version is set on the item put once committed
+			(*write.copied).SetVersion((*write.item).GetVersion())
+			err = s.cacheStored(ctx, write.copied)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordedWrite is the last write of an id, nil items mean deleted
+type recordedWrite[T Identifier] struct {
+	item   *T // as put by the transaction
+	copied *T // copy done when it was put
+}
+
+// recordingTx keeps the last write of every id done through a transaction
+type recordingTx[T Identifier] struct {
+	Storer[T]
+	codec  Codec
+	writes map[string]recordedWrite[T]
+	order  *[]string
+}
+
+func (r *recordingTx[T]) record(id string, write recordedWrite[T]) {
+	if _, ok := r.writes[id]; !ok {
+		*r.order = append(*r.order, id)
+	}
+	r.writes[id] = write
+}
+
+func (r *recordingTx[T]) Put(ctx context.Context, item *T) error {
+	copied, err := copyItem(r.codec, item)
+	if err != nil {
+		return err
+	}
+	if err := r.Storer.Put(ctx, item); err != nil {
+		return err
+	}
+	r.record((*item).GetId(), recordedWrite[T]{item: item, copied: copied})
+	return nil
+}
+
+func (r *recordingTx[T]) Delete(ctx context.Context, id string) error {
+	if err := r.Storer.Delete(ctx, id); err != nil {
+		return err
+	}
+	r.record(id, recordedWrite[T]{})
+	return nil
+}
+
+// Watch streams the changes seen by the cache, or by the persistence if the
+// cache can not be watched
+func (s *StoreCached[T]) Watch(ctx context.Context, from string) (<-chan ChangeEvent[T], error) {
+	if watcher, ok := s.cache.(Watcher[T]); ok {
+		return watcher.Watch(ctx, from)
+	}
+	if watcher, ok := s.persistence.(Watcher[T]); ok {
+		return watcher.Watch(ctx, from)
+	}
+	return nil, ErrWatchNotSupported
+}
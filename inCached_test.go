@@ -19,3 +19,131 @@ func TestStoreCached(t *testing.T) {
 	testutils.SuitePersistencer(p, t)
 	testutils.SuiteOptimisticLocking(p, t)
 }
+
+func TestStoreCached_Pagination(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached(disk, nil)
+	biff.AssertNil(err)
+
+	testutils.SuitePagination(p, t)
+}
+
+func TestStoreCached_Querier(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached(disk, nil)
+	biff.AssertNil(err)
+
+	testutils.SuiteQuerier(p, t)
+}
+
+func TestStoreCached_Iterable(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached(disk, nil)
+	biff.AssertNil(err)
+
+	testutils.SuiteIterable(p, t)
+}
+
+func TestStoreCached_Batch(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached(disk, nil)
+	biff.AssertNil(err)
+
+	testutils.SuiteBatch(p, t)
+}
+
+func TestStoreCached_Transactor(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached(disk, nil)
+	biff.AssertNil(err)
+
+	testutils.SuiteTransactor(p, t)
+}
+
+func TestStoreCached_Watcher(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached(disk, nil)
+	biff.AssertNil(err)
+
+	testutils.SuiteWatcher(p, t)
+}
+
+func TestStoreCached_VersionDeleter(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached(disk, nil)
+	biff.AssertNil(err)
+
+	testutils.SuiteVersionDeleter(p, t)
+}
+
+func TestStoreCached_Aliasing(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached(disk, nil)
+	biff.AssertNil(err)
+
+	testutils.SuiteAliasing(p, t)
+}
+
+func TestStoreCached_Indexer(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached[testutils.TestItem](disk, store.NewStoreMemory(testutils.TestItemIndexes...))
+	biff.AssertNil(err)
+
+	testutils.SuiteIndexer(p, t)
+}
+
+func TestStoreCached_UniqueConstraints(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir(), testutils.TestItemConstraints...)
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached(disk, nil)
+	biff.AssertNil(err)
+
+	testutils.SuiteUniqueConstraints(p, t)
+}
+
+// nonTransactional hides WithTx from a store, like StoreInception
+type nonTransactional[T store.Identifier] struct {
+	store.Storer[T]
+	store.StrictStorer[T]
+}
+
+func TestStoreCached_NonTransactional(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	p, err := store.NewStoreCached[testutils.TestItem](nonTransactional[testutils.TestItem]{disk, disk}, nil)
+	biff.AssertNil(err)
+
+	testutils.SuitePersistencer(p, t)
+	testutils.SuiteOptimisticLocking(p, t)
+}
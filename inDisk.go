@@ -2,18 +2,47 @@ package store
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"iter"
 	"log"
 	"os"
 	"path"
-	"strings"
+	"slices"
+	"sort"
+	"sync"
+	"time"
 )
 
+// StoreDisk keeps one file per item, JSON unless other codec is set (see
+// SetCodec) and optionally compressed (see SetCompression). Files are named
+// after the id, escaped if needed (see encodeId), and can be spread in
+// subdirectories (see SetShards). Writes take a file lock of the
+// id (see lock) and check versions like StoreMemory, so several processes can
+// share the same data directory.
+//
+// Unique constraints are enforced with an index kept in memory, built when
+// the store is created. Values freed by other processes are detected, but
+// values taken by other processes after that are not: unique constraints are
+// only safe if a single process writes.
 type StoreDisk[T Identifier] struct {
-	dataDir string
+	dataDir       string
+	watchInterval time.Duration
+	codec         Codec
+	extension     string // of the item files, given by the codec
+	compression   Compression
+	shards        int
+	unique        indexSet[T]
+	uniqueMutex   sync.Mutex // held from the unique check to the reindex
 }
 
+// lockDir is the directory inside dataDir where the lock files are kept
+const lockDir = ".locks"
+
+// lockStripes is the number of lock files, ids share them by hash so the lock
+// directory does not grow with the items
+const lockStripes = 1024
+
 func NewStoreDiskCached[T Identifier](dataDir string) (*StoreCached[T], error) {
 	// This is a helper to create a cached store with a disk backend
 	// It is not required to use the store, but it is a convenience function to
@@ -25,62 +54,280 @@ func NewStoreDiskCached[T Identifier](dataDir string) (*StoreCached[T], error) {
 	return NewStoreCached(disk, NewStoreMemory[T]())
 }
 
-func NewStoreDisk[T Identifier](dataDir string) (*StoreDisk[T], error) {
+func NewStoreDisk[T Identifier](dataDir string, constraints ...UniqueConstraint) (*StoreDisk[T], error) {
 
 	// ensure dir
-	err := os.MkdirAll(dataDir, 0777)
+	err := os.MkdirAll(path.Join(dataDir, lockDir), 0777)
 	if err != nil {
 		return nil, fmt.Errorf("ERROR: ensure data dir '%s': %s\n", dataDir, err.Error())
 	}
 
-	return &StoreDisk[T]{
-		dataDir: dataDir,
-	}, nil
+	f := &StoreDisk[T]{
+		dataDir:       dataDir,
+		watchInterval: time.Second,
+		codec:         JSONCodec{Indent: "    "},
+		extension:     ".json",
+		unique:        newIndexSet(UniqueIndexes[T](constraints...)),
+	}
+
+	if err := f.buildUnique(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
 }
 
-func (f *StoreDisk[T]) List(ctx context.Context) ([]*T, error) {
-	// Read directory directly
-	entries, err := os.ReadDir(f.dataDir)
+// SetCodec changes the format of the files. They are named with the extension
+// of the codec (".bin" if it has no Extension method), files of other codecs
+// are ignored. It must be called before the store is used.
+func (f *StoreDisk[T]) SetCodec(codec Codec) error {
+	f.codec = codec
+	f.extension = ".bin"
+	if e, ok := codec.(extensioner); ok {
+		f.extension = e.Extension()
+	}
+	return f.buildUnique()
+}
+
+// SetCompression changes the compression of the files written from now on,
+// their extension gets ".gz" or ".zst" appended. Files in any compression are
+// read, so existing files keep working until they are written again or
+// migrated (see Migrate). It must be called before the store is used.
+func (f *StoreDisk[T]) SetCompression(compression Compression) error {
+	if err := compression.validate(); err != nil {
+		return err
+	}
+	f.compression = compression
+	return nil
+}
+
+// buildUnique loads the unique index from the files
+func (f *StoreDisk[T]) buildUnique() error {
+	if len(f.unique) == 0 {
+		return nil
+	}
+
+	for _, index := range f.unique {
+		index.entries.Clear()
+	}
+	items, err := f.List(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("reading directory: %s", err.Error())
+		return err
 	}
+	for _, item := range items {
+		f.unique.reindex((*item).GetId(), nil, item)
+	}
+	return nil
+}
 
+func (f *StoreDisk[T]) List(ctx context.Context) ([]*T, error) {
 	var result []*T
-	for _, entry := range entries {
-		if entry.IsDir() || !strings.EqualFold(".json", path.Ext(entry.Name())) {
+	for file, err := range f.files(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if !f.isCurrent(file) {
 			continue
 		}
 
-		filename := path.Join(f.dataDir, entry.Name())
-		file, err := os.Open(filename)
+		item, err := f.read(file.filename, file.compression)
 		if err != nil {
-			log.Printf("error opening '%s': %s\n", filename, err.Error())
+			log.Printf("error reading '%s': %s\n", file.filename, err.Error())
 			continue
 		}
+		result = append(result, item)
+	}
 
-		var item *T
-		if err := json.NewDecoder(file).Decode(&item); err != nil {
-			log.Printf("error decoding '%s': %s\n", filename, err.Error())
-			file.Close()
+	return result, nil
+}
+
+func (f *StoreDisk[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		// Directories are read in chunks to keep memory constant
+		for file, err := range f.files(ctx) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !f.isCurrent(file) {
+				continue
+			}
+
+			item, err := f.Get(ctx, file.id)
+			if err != nil {
+				log.Printf("error reading '%s': %s\n", file.id, err.Error())
+				continue
+			}
+			if item == nil {
+				continue // deleted meanwhile
+			}
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (f *StoreDisk[T]) ListPage(ctx context.Context, req PageRequest) (*Page[T], error) {
+	after, err := DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are not sorted by id (shards, '-' < '.'), so sort by id explicitly
+	ids := []string{}
+	for file, err := range f.files(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if !f.isCurrent(file) {
 			continue
 		}
-		file.Close()
+		if req.Cursor != "" && file.id <= after {
+			continue
+		}
+		ids = append(ids, file.id)
+	}
+	sort.Strings(ids)
+
+	limit := req.GetLimit()
+	result := []*T{}
+	for _, id := range ids {
+		if len(result) > limit {
+			break
+		}
+		item, err := f.Get(ctx, id)
+		if err != nil {
+			log.Printf("error reading '%s': %s\n", id, err.Error())
+			continue
+		}
+		if item == nil {
+			continue // deleted meanwhile
+		}
 		result = append(result, item)
 	}
 
-	return result, nil
+	return NewPage(result, limit), nil
+}
+
+func (f *StoreDisk[T]) Find(ctx context.Context, filter Filter, sort ...SortField) ([]*T, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ValidateSort(sort); err != nil {
+		return nil, err
+	}
+
+	items, err := f.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err = FilterItems(items, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, SortItems(items, sort)
 }
 
 func (f *StoreDisk[T]) Put(ctx context.Context, item *T) error {
 	id := (*item).GetId()
-	targetFilename := path.Join(f.dataDir, id+".json")
+
+	unlock, err := f.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := f.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	version := (*item).GetVersion()
+	if current != nil && (*current).GetVersion() != version {
+		return ErrVersionGone
+	}
+
+	return f.write(current, item, version+1)
+}
+
+// lockStripe returns the lock file shared by id, from 0 to lockStripes - 1
+func lockStripe(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % lockStripes)
+}
+
+// lock blocks until it gets the exclusive lock of id, shared with other
+// processes using the same data directory. The lock is the one of its stripe
+// (see lockStripes), so it also excludes other ids of the same stripe. Lock
+// files are never removed, removing a file while others wait on it would break
+// the exclusion.
+func (f *StoreDisk[T]) lock(id string) (unlock func(), err error) {
+	return f.lockStripe(lockStripe(id))
+}
+
+func (f *StoreDisk[T]) lockStripe(stripe int) (unlock func(), err error) {
+	filename := path.Join(f.dataDir, lockDir, fmt.Sprintf("%03x.lock", stripe))
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock '%s': %s", filename, err.Error())
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("locking '%s': %s", filename, err.Error())
+	}
+
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// lockAll locks the stripes of several ids in order, so two processes locking
+// the same ids can not deadlock. Each stripe is locked once, flock would
+// block on a second lock of the same file.
+func (f *StoreDisk[T]) lockAll(ids []string) (unlock func(), err error) {
+	stripes := []int{}
+	for _, id := range ids {
+		stripes = append(stripes, lockStripe(id))
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+
+	unlocks := []func(){}
+	unlock = func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+
+	for _, stripe := range stripes {
+		u, err := f.lockStripe(stripe)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, u)
+	}
+
+	return unlock, nil
+}
+
+// writeTemp persists the item into a temp file in the same directory (ensures
+// same filesystem for atomic rename)
+func (f *StoreDisk[T]) writeTemp(item *T) (tmpName string, err error) {
+	id := (*item).GetId()
 
 	// 1. Create temp file in the same directory (ensures same filesystem for atomic rename)
-	tmpFile, err := os.CreateTemp(f.dataDir, fmt.Sprintf("tmp-%s-*.json", id))
+	// The name does not end like item files, so it is never listed
+	tmpFile, err := os.CreateTemp(f.dataDir, fmt.Sprintf("tmp-%s-*.tmp", encodeId(id)))
 	if err != nil {
-		return fmt.Errorf("creating temp file: %s", err.Error())
+		return "", fmt.Errorf("creating temp file: %s", err.Error())
 	}
-	tmpName := tmpFile.Name()
+	tmpName = tmpFile.Name()
 
 	// Cleanup temp file in case of failure
 	defer func() {
@@ -90,58 +337,568 @@ func (f *StoreDisk[T]) Put(ctx context.Context, item *T) error {
 		}
 	}()
 
-	// 2. Write JSON
-	e := json.NewEncoder(tmpFile)
-	e.SetIndent("", "    ")
-	if err = e.Encode(item); err != nil {
-		return fmt.Errorf("interim persistence %s: %s\n", tmpName, err.Error())
+	// 2. Encode
+	data, err := f.codec.Marshal(item)
+	if err == nil {
+		data, err = f.compression.compress(data)
+	}
+	if err != nil {
+		return "", fmt.Errorf("encoding item '%s': %s", id, err.Error())
+	}
+	if _, err = tmpFile.Write(data); err != nil {
+		return "", fmt.Errorf("interim persistence %s: %s\n", tmpName, err.Error())
 	}
 
 	// 3. Sync to disk (optional but safer)
 	if err = tmpFile.Sync(); err != nil {
-		return fmt.Errorf("syncing temp file: %s", err.Error())
+		return "", fmt.Errorf("syncing temp file: %s", err.Error())
 	}
 
 	// Close explicitly before rename (defer Close is too late for Windows, good practice generally)
 	tmpFile.Close()
 
+	return tmpName, nil
+}
+
+// commitTemp atomically replaces the item file with the temp file and removes
+// the other files of the item (see removeStale)
+func (f *StoreDisk[T]) commitTemp(tmpName, id string) error {
+	targetFilename := f.filename(id, f.compression)
+	target := itemFile{id: id, filename: targetFilename, compression: f.compression, ambiguous: f.shards == 0 && encodeId(id) != id}
+	if !f.holds(target) {
+		os.Remove(tmpName)
+		return fmt.Errorf("%s holds another item written before ids were escaped, Migrate it first", targetFilename)
+	}
+	if f.shards > 0 {
+		if err := os.MkdirAll(path.Dir(targetFilename), 0777); err != nil {
+			os.Remove(tmpName)
+			return fmt.Errorf("ensure dir '%s': %s", path.Dir(targetFilename), err.Error())
+		}
+	}
+
 	// 4. Atomic Rename
-	if err = os.Rename(tmpName, targetFilename); err != nil {
+	if err := os.Rename(tmpName, targetFilename); err != nil {
+		os.Remove(tmpName)
 		return fmt.Errorf("renaming %s to %s: %s", tmpName, targetFilename, err.Error())
 	}
 
+	return f.removeStale(id)
+}
+
+// removeStale removes the files of id that are not in the current compression
+// or layout
+func (f *StoreDisk[T]) removeStale(id string) error {
+	current := f.filename(id, f.compression)
+	for _, location := range f.locations(id) {
+		if location.filename == current || !f.holds(location) {
+			continue
+		}
+		if err := os.Remove(location.filename); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("item '%s' persistence error: %s", id, err.Error())
+		}
+	}
+
 	return nil
 }
 
-func (f *StoreDisk[T]) Get(ctx context.Context, id string) (*T, error) {
-	filename := path.Join(f.dataDir, id+".json")
+// filename of the item id in the given compression
+func (f *StoreDisk[T]) filename(id string, compression Compression) string {
+	return path.Join(f.dir(id), encodeId(id)+f.extension+compression.suffix())
+}
 
-	file, err := os.Open(filename)
-	if os.IsNotExist(err) {
-		return nil, nil // Not found
+// preferred returns the compressions in the order they are read: the one
+// being written first
+func (f *StoreDisk[T]) preferred() []Compression {
+	result := []Compression{f.compression}
+	for _, compression := range compressions {
+		if compression != f.compression {
+			result = append(result, compression)
+		}
 	}
+	return result
+}
+
+// read decodes the item file
+func (f *StoreDisk[T]) read(filename string, compression Compression) (*T, error) {
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	data, err = compression.decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing: %s", err.Error())
+	}
 
 	var item *T
-	if err := json.NewDecoder(file).Decode(&item); err != nil {
-		return nil, fmt.Errorf("decoding item '%s': %s", id, err.Error())
+	if err := f.codec.Unmarshal(data, &item); err != nil {
+		return nil, fmt.Errorf("decoding: %s", err.Error())
 	}
-
 	return item, nil
 }
 
-func (f *StoreDisk[T]) Delete(ctx context.Context, id string) error {
-	filename := path.Join(f.dataDir, id+".json")
-	err := os.Remove(filename)
+func (f *StoreDisk[T]) Create(ctx context.Context, item *T) error {
+	id := (*item).GetId()
+
+	unlock, err := f.lock(id)
 	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := f.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		return ErrAlreadyExists
+	}
+
+	return f.write(nil, item, 1)
+}
+
+func (f *StoreDisk[T]) Update(ctx context.Context, item *T) error {
+	id := (*item).GetId()
+
+	unlock, err := f.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := f.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return ErrNotFound
+	}
+	version := (*item).GetVersion()
+	if (*current).GetVersion() != version {
+		return ErrVersionGone
+	}
+
+	return f.write(current, item, version+1)
+}
+
+// write stores the item with the given version keeping the unique
+// constraints, current is the item being replaced (nil if new). The id must be
+// locked.
+func (f *StoreDisk[T]) write(current, item *T, version int64) error {
+	unlock := f.lockUnique()
+	defer unlock()
+
+	if err := f.checkUnique([]*T{item}, nil); err != nil {
+		return err
+	}
+	if err := f.writeVersion(item, version); err != nil {
+		return err
+	}
+	f.unique.reindex((*item).GetId(), current, item)
+
+	return nil
+}
+
+// lockUnique serializes the writes of this process if there are unique
+// constraints
+func (f *StoreDisk[T]) lockUnique() (unlock func()) {
+	if len(f.unique) == 0 {
+		return func() {}
+	}
+	f.uniqueMutex.Lock()
+	return f.uniqueMutex.Unlock
+}
+
+// checkUnique does not trust the index when it reports a conflict, the file
+// could have been changed by another process
+func (f *StoreDisk[T]) checkUnique(puts []*T, deletes []string) error {
+	return f.unique.checkUniqueFunc(puts, deletes, func(index *memoryIndex[T], id, key string) bool {
+		item, err := f.Get(context.Background(), id)
+		if err != nil {
+			return true // can not tell, assume it does
+		}
+		return item != nil && index.key(item) == key
+	})
+}
+
+// writeVersion stores the item with the given version and sets it on item
+// only if it succeeds
+func (f *StoreDisk[T]) writeVersion(item *T, version int64) error {
+	previous := (*item).GetVersion()
+	(*item).SetVersion(version)
+	tmpName, err := f.writeTemp(item)
+	if err == nil {
+		err = f.commitTemp(tmpName, (*item).GetId())
+	}
+	if err != nil {
+		(*item).SetVersion(previous)
+	}
+	return err
+}
+
+func (f *StoreDisk[T]) PutMany(ctx context.Context, items []*T) error {
+	return putEach[T](ctx, f, items)
+}
+
+// Get reads the first file of the item found in its locations (see
+// locations)
+func (f *StoreDisk[T]) Get(ctx context.Context, id string) (*T, error) {
+	for _, location := range f.locations(id) {
+		item, err := f.read(location.filename, location.compression)
 		if os.IsNotExist(err) {
-			return nil // Already deleted or never existed, benign
+			continue
 		}
-		return fmt.Errorf("item '%s' persistence error: %s", id, err.Error())
+		if err != nil {
+			return nil, fmt.Errorf("reading item '%s': %s", id, err.Error())
+		}
+		if location.ambiguous && item != nil && (*item).GetId() != id {
+			continue // the file of another id, see holds
+		}
+		return item, nil
 	}
 
+	return nil, nil // Not found
+}
+
+func (f *StoreDisk[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+	return getEach[T](ctx, f, ids)
+}
+
+func (f *StoreDisk[T]) Delete(ctx context.Context, id string) error {
+	unlock, err := f.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if len(f.unique) == 0 {
+		return f.remove(id)
+	}
+
+	current, err := f.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return f.removeCurrent(id, current)
+}
+
+func (f *StoreDisk[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+	unlock, err := f.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := f.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return ErrNotFound
+	}
+	if (*current).GetVersion() != version {
+		return ErrVersionGone
+	}
+
+	return f.removeCurrent(id, current)
+}
+
+// removeCurrent removes id, which is current, from disk and from the unique
+// index. The id must be locked.
+func (f *StoreDisk[T]) removeCurrent(id string, current *T) error {
+	unlock := f.lockUnique()
+	defer unlock()
+
+	if err := f.remove(id); err != nil {
+		return err
+	}
+	f.unique.reindex(id, current, nil)
+
 	return nil
 }
+
+// remove deletes the files of id in every compression and location
+func (f *StoreDisk[T]) remove(id string) error {
+	for _, location := range f.locations(id) {
+		if !f.holds(location) {
+			continue
+		}
+		err := os.Remove(location.filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // Already deleted or never existed, benign
+			}
+			return fmt.Errorf("item '%s' persistence error: %s", id, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Migrate rewrites the files that are not in the current compression, e.g.
+// after SetCompression, and moves the ones that are not in the current layout
+// or were named before ids were escaped. It returns how many were rewritten or
+// moved. Items keep their version. It is safe to run while the store is used.
+func (f *StoreDisk[T]) Migrate(ctx context.Context) (int, error) {
+	migrated := 0
+	for file, err := range f.files(ctx) {
+		if err != nil {
+			return migrated, err
+		}
+		if file.filename == f.filename(file.id, file.compression) && file.compression == f.compression {
+			continue
+		}
+
+		moved, rewritten := false, false
+		if file.filename != f.filename(file.id, file.compression) {
+			moved, err = f.relocate(file)
+			if err != nil {
+				return migrated, err
+			}
+		}
+		if file.compression != f.compression {
+			rewritten, err = f.migrate(ctx, file.id)
+			if err != nil {
+				return migrated, err
+			}
+		}
+		if moved || rewritten {
+			migrated++
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrate rewrites id in the current compression if it is not yet
+func (f *StoreDisk[T]) migrate(ctx context.Context, id string) (bool, error) {
+	unlock, err := f.lock(id)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	item, err := f.Get(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if item == nil {
+		return false, nil // deleted meanwhile
+	}
+	if _, err := os.Stat(f.filename(id, f.compression)); err == nil {
+		// written meanwhile, only the stale files are left
+		return false, f.removeStale(id)
+	}
+
+	tmpName, err := f.writeTemp(item)
+	if err != nil {
+		return false, err
+	}
+	return true, f.commitTemp(tmpName, id)
+}
+
+func (f *StoreDisk[T]) DeleteMany(ctx context.Context, ids []string) error {
+	return deleteEach[T](ctx, f, ids)
+}
+
+// WithTx stages the writes in memory and applies them on commit with all the
+// touched ids locked. All items are written to temp files first and then
+// renamed, so a failure while writing leaves the store untouched. A crash
+// in the middle of the renames can apply part of the transaction.
+func (f *StoreDisk[T]) WithTx(ctx context.Context, fn func(tx Storer[T]) error) error {
+	tx := newStagedTx[T](f, true, f.codec)
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	unlock, err := f.lockAll(tx.order)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	currents := map[string]*T{}
+	for _, id := range tx.order {
+		current, err := f.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if tx.entries[id].changed(current) {
+			return ErrVersionGone
+		}
+		currents[id] = current
+	}
+
+	puts, deletes := tx.writes()
+
+	unlockUnique := f.lockUnique()
+	defer unlockUnique()
+
+	if err := f.checkUnique(puts, deletes); err != nil {
+		return err
+	}
+
+	tmpNames := []string{}
+	for _, item := range puts {
+		tmpName, err := f.writeTemp(item)
+		if err != nil {
+			for _, tmpName := range tmpNames {
+				os.Remove(tmpName)
+			}
+			return err
+		}
+		tmpNames = append(tmpNames, tmpName)
+	}
+
+	for i, item := range puts {
+		id := (*item).GetId()
+		if err := f.commitTemp(tmpNames[i], id); err != nil {
+			return err
+		}
+		f.unique.reindex(id, currents[id], item)
+	}
+	for _, id := range deletes {
+		if err := f.remove(id); err != nil {
+			return err
+		}
+		f.unique.reindex(id, currents[id], nil)
+	}
+
+	tx.commit()
+	return nil
+}
+
+// SetWatchInterval changes how often the data directory is scanned by Watch
+func (f *StoreDisk[T]) SetWatchInterval(interval time.Duration) {
+	f.watchInterval = interval
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	version int64
+}
+
+// Watch polls the data directory and diffs it with the previous scan, so it
+// also detects changes done by other processes. Several writes to the same
+// item between two scans are reported as a single event. Resume is not
+// supported.
+func (f *StoreDisk[T]) Watch(ctx context.Context, from string) (<-chan ChangeEvent[T], error) {
+	if from != "" {
+		return nil, ErrResumeNotSupported
+	}
+
+	previous, err := f.scan(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan ChangeEvent[T])
+	go func() {
+		defer close(out)
+
+		ticker := time.NewTicker(f.watchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, err := f.scan(ctx, previous)
+			if err != nil {
+				log.Printf("watching '%s': %s\n", f.dataDir, err.Error())
+				continue
+			}
+
+			events := []ChangeEvent[T]{}
+			for id, state := range current {
+				old, existed := previous[id]
+				if existed && old.modTime.Equal(state.modTime) && old.size == state.size {
+					current[id] = old // keep known version
+					continue
+				}
+				item, err := f.Get(ctx, id)
+				if err != nil || item == nil {
+					// being written or already removed, forget the new state so
+					// the next scan tells
+					if existed {
+						current[id] = old
+					} else {
+						delete(current, id)
+					}
+					continue
+				}
+				event := ChangeEvent[T]{
+					Op:         ChangeInsert,
+					Id:         id,
+					NewVersion: (*item).GetVersion(),
+					Item:       item,
+				}
+				if existed {
+					event.Op = ChangeUpdate
+					event.OldVersion = old.version
+				}
+				state.version = event.NewVersion
+				current[id] = state
+				events = append(events, event)
+			}
+			for id, old := range previous {
+				if _, exists := current[id]; !exists {
+					events = append(events, ChangeEvent[T]{
+						Op:         ChangeDelete,
+						Id:         id,
+						OldVersion: old.version,
+					})
+				}
+			}
+			previous = current
+
+			sort.Slice(events, func(i, j int) bool {
+				return events[i].Id < events[j].Id
+			})
+			for _, event := range events {
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// scan returns the state of all the items in the data directory, versions are
+// read only for items that are not in previous (or nil to read them all)
+func (f *StoreDisk[T]) scan(ctx context.Context, previous map[string]fileState) (map[string]fileState, error) {
+	result := map[string]fileState{}
+	for file, err := range f.files(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if !f.isCurrent(file) {
+			continue
+		}
+		id := file.id
+		info, err := file.entry.Info()
+		if err != nil {
+			continue // removed meanwhile
+		}
+
+		state := fileState{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+		if previous == nil {
+			if item, err := f.Get(ctx, id); err == nil && item != nil {
+				state.version = (*item).GetVersion()
+			}
+		}
+		result[id] = state
+	}
+
+	return result, nil
+}
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"iter"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxShards is the maximum number of shard levels, each one splits the items
+// in 256 directories
+const maxShards = 4
+
+// encodeId makes id safe as a filename: bytes other than ASCII letters,
+// digits, '-', '_' and '.' are escaped as %XX, and so is a leading '.', so an
+// id can not leave its directory nor be taken for the lock directory. Ids that
+// were already safe keep their name.
+func encodeId(id string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		safe := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' && i > 0
+		if safe {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// decodeId reverses encodeId, names encodeId can not produce (written before
+// ids were encoded) are taken as they are
+func decodeId(name string) string {
+	id, err := url.PathUnescape(name)
+	if err != nil || encodeId(id) != name {
+		return name
+	}
+	return id
+}
+
+// shardDir returns the directory of id relative to the data directory, a
+// level of two hex chars of its hash for every shard (e.g. "ab/cd")
+func shardDir(id string, shards int) string {
+	sum := sha256.Sum256([]byte(id))
+	hash := hex.EncodeToString(sum[:shards])
+
+	parts := []string{}
+	for i := 0; i < shards; i++ {
+		parts = append(parts, hash[2*i:2*i+2])
+	}
+	return path.Join(parts...)
+}
+
+// isShardDir reports if name can be a level of shardDir
+func isShardDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// SetShards spreads the files in hash-sharded subdirectories, as many levels
+// deep as shards (up to 4, 0 keeps all the files in the data directory), so
+// no directory gets too big. Files in other layouts are moved to the new one,
+// those left in the data directory (e.g. if moving was interrupted or written
+// by a process without shards) are still read until they are written again
+// or migrated (see Migrate). Processes sharing the data directory must use the
+// same shards. It must be called before the store is used.
+func (f *StoreDisk[T]) SetShards(shards int) error {
+	if shards < 0 || shards > maxShards {
+		return fmt.Errorf("shards must be between 0 and %d, got %d", maxShards, shards)
+	}
+	f.shards = shards
+
+	ctx := context.Background()
+	for file, err := range f.files(ctx) {
+		if err != nil {
+			return err
+		}
+		if path.Dir(file.filename) == f.dir(file.id) {
+			continue
+		}
+		if _, err := f.relocate(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dir returns the directory of the files of id
+func (f *StoreDisk[T]) dir(id string) string {
+	return path.Join(f.dataDir, shardDir(id, f.shards))
+}
+
+// itemFile is a file with an item, found in any of the places it is looked
+// for (see locations)
+type itemFile struct {
+	id          string
+	filename    string
+	compression Compression
+	entry       os.DirEntry // only set when walking the directories
+	ambiguous   bool        // the name can also be the one of another id, see holds
+}
+
+// locations returns where the files of id are read from, in order: the
+// current layout, the data directory without shards, and the name of id not
+// encoded. Each of them in every compression, the one being written first.
+func (f *StoreDisk[T]) locations(id string) []itemFile {
+	name := encodeId(id)
+	dirs := [][2]string{{f.dir(id), name}}
+	if f.shards > 0 {
+		dirs = append(dirs, [2]string{f.dataDir, name})
+	}
+	if name != id && id != "" && id != "." && id != ".." && id != lockDir && !strings.Contains(id, "/") {
+		dirs = append(dirs, [2]string{f.dataDir, id})
+	}
+
+	result := []itemFile{}
+	for _, dir := range dirs {
+		for _, compression := range f.preferred() {
+			result = append(result, itemFile{
+				id:          id,
+				filename:    path.Join(dir[0], dir[1]+f.extension+compression.suffix()),
+				compression: compression,
+				ambiguous:   dir[0] == f.dataDir && (dir[1] != id || decodeId(id) != id),
+			})
+		}
+	}
+	return result
+}
+
+// holds returns if the file of an ambiguous location is the one of its id: in
+// the data directory "100%25off" is both the name of "100%off" and the legacy
+// name of "100%25off"
+func (f *StoreDisk[T]) holds(location itemFile) bool {
+	if !location.ambiguous {
+		return true
+	}
+	item, err := f.read(location.filename, location.compression)
+	return err != nil || item == nil || (*item).GetId() == location.id
+}
+
+// files walks the data directory and its shard directories, reading them in
+// chunks to keep memory constant. The files of an item that are not current
+// (see isCurrent) are also yielded.
+func (f *StoreDisk[T]) files(ctx context.Context) iter.Seq2[itemFile, error] {
+	return func(yield func(itemFile, error) bool) {
+		f.walk(ctx, f.dataDir, 0, yield)
+	}
+}
+
+// walk yields the files in dir and the shard directories below, it returns
+// false if the walk must stop
+func (f *StoreDisk[T]) walk(ctx context.Context, dir string, depth int, yield func(itemFile, error) bool) bool {
+	d, err := os.Open(dir)
+	if err != nil {
+		return yield(itemFile{}, fmt.Errorf("reading directory: %s", err.Error()))
+	}
+	defer d.Close()
+
+	for {
+		entries, err := d.ReadDir(100)
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return yield(itemFile{}, fmt.Errorf("reading directory: %s", err.Error()))
+		}
+
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return yield(itemFile{}, err)
+			}
+
+			if entry.IsDir() {
+				if depth < maxShards && isShardDir(entry.Name()) && !f.walk(ctx, path.Join(dir, entry.Name()), depth+1, yield) {
+					return false
+				}
+				continue
+			}
+
+			name, compression, ok := f.parseName(entry.Name())
+			if !ok {
+				continue
+			}
+			file := itemFile{
+				id:          decodeId(name),
+				filename:    path.Join(dir, entry.Name()),
+				compression: compression,
+				entry:       entry,
+			}
+			if depth == 0 && file.id != name {
+				file.id = f.legacyId(file, name)
+			}
+			if !yield(file, nil) {
+				return false
+			}
+		}
+	}
+}
+
+// parseName returns the name of the id (see decodeId) and the compression of
+// an item filename
+func (f *StoreDisk[T]) parseName(filename string) (name string, compression Compression, ok bool) {
+	for _, compression := range compressions {
+		suffix := f.extension + compression.suffix()
+		if len(filename) > len(suffix) && strings.EqualFold(suffix, filename[len(filename)-len(suffix):]) {
+			return filename[:len(filename)-len(suffix)], compression, true
+		}
+	}
+	return "", "", false
+}
+
+// legacyId returns the id of a file in the data directory with an escaped
+// name, which can also be the id as is if it was written before ids were
+// encoded (e.g. "100%25off"). The item in the file tells.
+func (f *StoreDisk[T]) legacyId(file itemFile, name string) string {
+	item, err := f.read(file.filename, file.compression)
+	if err == nil && item != nil && (*item).GetId() == name {
+		return name
+	}
+	return file.id
+}
+
+// isCurrent reports if file is the one read by Get, an item can have several
+// files if a write or a move was interrupted
+func (f *StoreDisk[T]) isCurrent(file itemFile) bool {
+	for _, location := range f.locations(file.id) {
+		if location.filename == file.filename {
+			return true
+		}
+		if _, err := os.Stat(location.filename); err == nil {
+			return false
+		}
+	}
+	return false // not in the current layout, see SetShards
+}
+
+// relocate moves file to the directory of its id keeping the compression, or
+// removes it if the item already has files there. It reports if the file was
+// moved.
+func (f *StoreDisk[T]) relocate(file itemFile) (bool, error) {
+	unlock, err := f.lock(file.id)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	for _, compression := range compressions {
+		if _, err := os.Stat(f.filename(file.id, compression)); err == nil {
+			if err := os.Remove(file.filename); err != nil && !os.IsNotExist(err) {
+				return false, fmt.Errorf("item '%s' persistence error: %s", file.id, err.Error())
+			}
+			return false, nil
+		}
+	}
+
+	target := f.filename(file.id, file.compression)
+	if err := os.MkdirAll(path.Dir(target), 0777); err != nil {
+		return false, fmt.Errorf("ensure dir '%s': %s", path.Dir(target), err.Error())
+	}
+	if err := os.Rename(file.filename, target); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil // moved or deleted meanwhile
+		}
+		return false, fmt.Errorf("renaming %s to %s: %s", file.filename, target, err.Error())
+	}
+	return true, nil
+}
@@ -2,7 +2,17 @@ package store_test
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/fulldump/biff"
 	"github.com/holacloud/store"
@@ -14,11 +24,150 @@ func TestStoreDisk(t *testing.T) {
 	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
 	biff.AssertNil(err)
 
-	p, err := store.NewStoreCached[testutils.TestItem](disk, nil)
+	testutils.SuitePersistencer(disk, t)
+	testutils.SuiteOptimisticLocking(disk, t)
+}
+
+func TestStoreDisk_SharedDirectory(t *testing.T) {
+
+	// Each StoreDisk opens its own lock files, like separate processes would
+	dir := t.TempDir()
+	stores := []*store.StoreDisk[testutils.TestItem]{}
+	for i := 0; i < 4; i++ {
+		disk, err := store.NewStoreDisk[testutils.TestItem](dir)
+		biff.AssertNil(err)
+		stores = append(stores, disk)
+	}
+
+	ctx := context.Background()
+	biff.AssertNil(stores[0].Put(ctx, &testutils.TestItem{Id: store.NewId("shared")}))
+
+	w := &sync.WaitGroup{}
+	increments := 25
+	for _, disk := range stores {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			for i := 0; i < increments; {
+				item, err := disk.Get(ctx, "shared")
+				biff.AssertNil(err)
+				item.Counter++
+				err = disk.Put(ctx, item)
+				if errors.Is(err, store.ErrVersionGone) {
+					continue
+				}
+				biff.AssertNil(err)
+				i++
+			}
+		}()
+	}
+	w.Wait()
+
+	item, err := stores[0].Get(ctx, "shared")
+	biff.AssertNil(err)
+	biff.AssertEqual(item.Counter, len(stores)*increments)
+	biff.AssertEqual(item.GetVersion(), int64(len(stores)*increments+1))
+}
+
+func TestStoreDisk_Pagination(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	testutils.SuitePagination(disk, t)
+}
+
+func TestStoreDisk_Querier(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	testutils.SuiteQuerier(disk, t)
+}
+
+func TestStoreDisk_Iterable(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	testutils.SuiteIterable(disk, t)
+}
+
+func TestStoreDisk_Batch(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
 	biff.AssertNil(err)
 
-	testutils.SuitePersistencer(p, t)
-	testutils.SuiteOptimisticLocking(p, t)
+	testutils.SuiteBatch(disk, t)
+}
+
+func TestStoreDisk_Transactor(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	testutils.SuiteTransactor(disk, t)
+}
+
+func TestStoreDisk_Watcher(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+	disk.SetWatchInterval(10 * time.Millisecond)
+
+	testutils.SuiteWatcher(disk, t)
+}
+
+func TestStoreDisk_WatcherUnreadable(t *testing.T) {
+
+	dir := t.TempDir()
+	disk, err := store.NewStoreDisk[testutils.TestItem](dir)
+	biff.AssertNil(err)
+	disk.SetWatchInterval(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := disk.Watch(ctx, "")
+	biff.AssertNil(err)
+
+	// A file being written can not be read yet, it is reported once it can
+	filename := path.Join(dir, "half.json")
+	biff.AssertNil(os.WriteFile(filename, []byte(`{"id": "half", "ver`), 0644))
+	time.Sleep(50 * time.Millisecond)
+	biff.AssertNil(os.WriteFile(filename, []byte(`{"id": "half", "version": 1, "title": "done"}`), 0644))
+
+	select {
+	case event := <-events:
+		biff.AssertEqual(event.Op, store.ChangeInsert)
+		biff.AssertEqual(event.Id, "half")
+		biff.AssertEqual(event.Item.Title, "done")
+	case <-time.After(2 * time.Second):
+		t.Fatal("the change was never reported")
+	}
+}
+
+func TestStoreDisk_VersionDeleter(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	testutils.SuiteVersionDeleter(disk, t)
+}
+
+func TestStoreDisk_Aliasing(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	testutils.SuiteAliasing(disk, t)
+}
+
+func TestStoreDisk_UniqueConstraints(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir(), testutils.TestItemConstraints...)
+	biff.AssertNil(err)
+
+	testutils.SuiteUniqueConstraints(disk, t)
 }
 
 func TestStoreDisk_Load(t *testing.T) {
@@ -52,3 +201,424 @@ func TestStoreDisk_Load(t *testing.T) {
 	biff.AssertNil(err)
 	biff.AssertEqual(item.Title, "test")
 }
+
+func TestStoreDisk_Compression(t *testing.T) {
+	for _, compression := range []store.Compression{store.CompressionGzip, store.CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+
+			newStore := func() *store.StoreDisk[testutils.TestItem] {
+				disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+				biff.AssertNil(err)
+				biff.AssertNil(disk.SetCompression(compression))
+				return disk
+			}
+
+			testutils.SuitePersistencer(newStore(), t)
+			testutils.SuiteTransactor(newStore(), t)
+		})
+	}
+}
+
+func TestStoreDisk_CompressionUnknown(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	biff.AssertNotNil(disk.SetCompression("lzma"))
+}
+
+func TestStoreDisk_CompressionMigrate(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	files := func() []string {
+		entries, err := os.ReadDir(dir)
+		biff.AssertNil(err)
+		result := []string{}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				result = append(result, entry.Name())
+			}
+		}
+		return result
+	}
+
+	// Legacy plain files
+	plain, err := store.NewStoreDisk[testutils.TestItem](dir)
+	biff.AssertNil(err)
+	for _, id := range []string{"a", "b", "c"} {
+		biff.AssertNil(plain.Put(ctx, &testutils.TestItem{Id: store.NewId(id), Title: id}))
+	}
+	biff.AssertEqual(files(), []string{"a.json", "b.json", "c.json"})
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](dir)
+	biff.AssertNil(err)
+	biff.AssertNil(disk.SetCompression(store.CompressionZstd))
+
+	t.Run("Read legacy files", func(t *testing.T) {
+		item, err := disk.Get(ctx, "a")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "a")
+
+		items, err := disk.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(items), 3)
+	})
+
+	t.Run("Write replaces the legacy file", func(t *testing.T) {
+		item, err := disk.Get(ctx, "a")
+		biff.AssertNil(err)
+		item.Title = "a2"
+		biff.AssertNil(disk.Put(ctx, item))
+
+		biff.AssertEqual(files(), []string{"a.json.zst", "b.json", "c.json"})
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		migrated, err := disk.Migrate(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(migrated, 2)
+		biff.AssertEqual(files(), []string{"a.json.zst", "b.json.zst", "c.json.zst"})
+
+		item, err := disk.Get(ctx, "b")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "b")
+		biff.AssertEqual(item.GetVersion(), int64(1)) // versions are kept
+
+		migrated, err = disk.Migrate(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(migrated, 0)
+	})
+
+	t.Run("Interrupted write", func(t *testing.T) {
+		// a stale legacy file is ignored while the compressed one exists
+		biff.AssertNil(os.WriteFile(path.Join(dir, "b.json"), []byte(`{"id":"b","title":"stale"}`), 0666))
+
+		item, err := disk.Get(ctx, "b")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "b")
+
+		items, err := disk.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(items), 3)
+
+		biff.AssertNil(disk.Delete(ctx, "b"))
+		biff.AssertEqual(files(), []string{"a.json.zst", "c.json.zst"})
+	})
+}
+
+func TestStoreDisk_UnsafeIds(t *testing.T) {
+
+	ctx := context.Background()
+	parent := t.TempDir()
+	dir := path.Join(parent, "data")
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](dir)
+	biff.AssertNil(err)
+
+	ids := []string{"../escaped", "a/b", ".locks", "..", "with space", "%41", "ñ"}
+	for _, id := range ids {
+		biff.AssertNil(disk.Put(ctx, &testutils.TestItem{Id: store.NewId(id), Title: id}))
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		for _, id := range ids {
+			item, err := disk.Get(ctx, id)
+			biff.AssertNil(err)
+			biff.AssertEqual(item.Title, id)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		items, err := disk.List(ctx)
+		biff.AssertNil(err)
+		listed := []string{}
+		for _, item := range items {
+			listed = append(listed, item.GetId())
+		}
+		sort.Strings(listed)
+		expected := slices.Clone(ids)
+		sort.Strings(expected)
+		biff.AssertEqual(listed, expected)
+	})
+
+	t.Run("Files stay in the data directory", func(t *testing.T) {
+		entries, err := os.ReadDir(parent)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(entries), 1)
+
+		_, err = os.Stat(path.Join(dir, "%2E.%2Fescaped.json"))
+		biff.AssertNil(err)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		for _, id := range ids {
+			biff.AssertNil(disk.Delete(ctx, id))
+		}
+		items, err := disk.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(items), 0)
+	})
+}
+
+func TestStoreDisk_LockStripes(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	disk, err := store.NewStoreDisk[testutils.TestItem](dir)
+	biff.AssertNil(err)
+
+	// More ids than stripes, a transaction locks stripes shared by its ids
+	err = disk.WithTx(ctx, func(tx store.Storer[testutils.TestItem]) error {
+		for i := 0; i < 2000; i++ {
+			if err := tx.Put(ctx, &testutils.TestItem{Id: store.NewId(strconv.Itoa(i))}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	biff.AssertNil(err)
+
+	locks, err := os.ReadDir(path.Join(dir, ".locks"))
+	biff.AssertNil(err)
+	biff.AssertTrue(len(locks) <= 1024)
+}
+
+func TestStoreDisk_Shards(t *testing.T) {
+
+	newStore := func() *store.StoreDisk[testutils.TestItem] {
+		disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		biff.AssertNil(disk.SetShards(2))
+		return disk
+	}
+
+	testutils.SuitePersistencer(newStore(), t)
+	testutils.SuitePagination(newStore(), t)
+	testutils.SuiteIterable(newStore(), t)
+	testutils.SuiteTransactor(newStore(), t)
+	testutils.SuiteUniqueConstraints(func() *store.StoreDisk[testutils.TestItem] {
+		disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir(), testutils.TestItemConstraints...)
+		biff.AssertNil(err)
+		biff.AssertNil(disk.SetShards(2))
+		return disk
+	}(), t)
+
+	t.Run("Watcher", func(t *testing.T) {
+		disk := newStore()
+		disk.SetWatchInterval(10 * time.Millisecond)
+		testutils.SuiteWatcher(disk, t)
+	})
+}
+
+func TestStoreDisk_ShardsInvalid(t *testing.T) {
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+
+	biff.AssertNotNil(disk.SetShards(-1))
+	biff.AssertNotNil(disk.SetShards(5))
+}
+
+func TestStoreDisk_ShardsMigrate(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	files := func() []string {
+		result := []string{}
+		err := filepath.WalkDir(dir, func(name string, entry os.DirEntry, err error) error {
+			if entry.IsDir() && entry.Name() == ".locks" {
+				return filepath.SkipDir
+			}
+			if !entry.IsDir() {
+				relative, _ := filepath.Rel(dir, name)
+				result = append(result, filepath.ToSlash(relative))
+			}
+			return err
+		})
+		biff.AssertNil(err)
+		return result
+	}
+
+	// Flat layout, including a file written before ids were escaped
+	flat, err := store.NewStoreDisk[testutils.TestItem](dir)
+	biff.AssertNil(err)
+	for _, id := range []string{"a", "b", "c"} {
+		biff.AssertNil(flat.Put(ctx, &testutils.TestItem{Id: store.NewId(id), Title: id}))
+	}
+	biff.AssertNil(os.WriteFile(path.Join(dir, "with space.json"), []byte(`{"id":"with space","version":1,"title":"legacy"}`), 0666))
+
+	t.Run("Read legacy names", func(t *testing.T) {
+		item, err := flat.Get(ctx, "with space")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "legacy")
+
+		items, err := flat.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(items), 4)
+	})
+
+	t.Run("Migrate legacy names", func(t *testing.T) {
+		migrated, err := flat.Migrate(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(migrated, 1)
+		biff.AssertEqual(files(), []string{"a.json", "b.json", "c.json", "with%20space.json"})
+
+		item, err := flat.Get(ctx, "with space")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "legacy")
+	})
+
+	disk, err := store.NewStoreDisk[testutils.TestItem](dir)
+	biff.AssertNil(err)
+	biff.AssertNil(disk.SetShards(2))
+
+	t.Run("Files are moved to the shards", func(t *testing.T) {
+		for _, name := range files() {
+			biff.AssertEqual(len(strings.Split(name, "/")), 3)
+		}
+
+		items, err := disk.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(items), 4)
+
+		item, err := disk.Get(ctx, "a")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "a")
+		biff.AssertEqual(item.GetVersion(), int64(1))
+	})
+
+	t.Run("Flat files are still read", func(t *testing.T) {
+		biff.AssertNil(flat.Put(ctx, &testutils.TestItem{Id: store.NewId("d"), Title: "d"}))
+
+		item, err := disk.Get(ctx, "d")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "d")
+
+		item.Title = "d2"
+		biff.AssertNil(disk.Put(ctx, item))
+		_, err = os.Stat(path.Join(dir, "d.json"))
+		biff.AssertTrue(os.IsNotExist(err))
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		// a flat file left behind, e.g. by an interrupted SetShards
+		biff.AssertNil(os.WriteFile(path.Join(dir, "e.json"), []byte(`{"id":"e","version":1,"title":"e"}`), 0666))
+
+		migrated, err := disk.Migrate(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(migrated, 1)
+
+		for _, name := range files() {
+			biff.AssertEqual(len(strings.Split(name, "/")), 3)
+		}
+
+		item, err := disk.Get(ctx, "e")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "e")
+
+		migrated, err = disk.Migrate(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(migrated, 0)
+	})
+
+	t.Run("Back to flat", func(t *testing.T) {
+		biff.AssertNil(disk.SetShards(0))
+		biff.AssertEqual(files(), []string{"a.json", "b.json", "c.json", "d.json", "e.json", "with%20space.json"})
+
+		items, err := disk.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(items), 6)
+	})
+}
+
+func TestStoreDisk_MigrateEscapedLegacyNames(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	ids := func(items []*testutils.TestItem) []string {
+		result := []string{}
+		for _, item := range items {
+			result = append(result, item.GetId())
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	// Legacy ids that are also valid escaped names, next to the escaped
+	// name of another id
+	disk, err := store.NewStoreDisk[testutils.TestItem](dir)
+	biff.AssertNil(err)
+	biff.AssertNil(os.WriteFile(path.Join(dir, "100%25off.json"), []byte(`{"id":"100%25off","version":1,"title":"legacy"}`), 0666))
+	biff.AssertNil(os.WriteFile(path.Join(dir, "a%2Fb.json"), []byte(`{"id":"a%2Fb","version":1,"title":"legacy"}`), 0666))
+
+	t.Run("Read legacy names", func(t *testing.T) {
+		items, err := disk.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(ids(items), []string{"100%25off", "a%2Fb"})
+
+		item, err := disk.Get(ctx, "100%25off")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "legacy")
+
+		item, err = disk.Get(ctx, "100%off")
+		biff.AssertNil(err)
+		biff.AssertNil(item)
+
+		item, err = disk.Get(ctx, "a/b")
+		biff.AssertNil(err)
+		biff.AssertNil(item)
+	})
+
+	t.Run("Writing over a legacy name fails", func(t *testing.T) {
+		err := disk.Put(ctx, &testutils.TestItem{Id: store.NewId("a/b"), Title: "escaped"})
+		biff.AssertNotNil(err)
+
+		item, err := disk.Get(ctx, "a%2Fb")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "legacy")
+	})
+
+	t.Run("Migrate legacy names", func(t *testing.T) {
+		migrated, err := disk.Migrate(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(migrated, 2)
+		biff.AssertNil(disk.Put(ctx, &testutils.TestItem{Id: store.NewId("a/b"), Title: "escaped"}))
+
+		items, err := disk.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(ids(items), []string{"100%25off", "a%2Fb", "a/b"})
+
+		item, err := disk.Get(ctx, "a%2Fb")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "legacy")
+
+		item, err = disk.Get(ctx, "a/b")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "escaped")
+
+		migrated, err = disk.Migrate(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(migrated, 0)
+	})
+
+	t.Run("Delete keeps the escaped name of another id", func(t *testing.T) {
+		biff.AssertNil(disk.Put(ctx, &testutils.TestItem{Id: store.NewId("100%off"), Title: "escaped"}))
+		biff.AssertNil(disk.Delete(ctx, "100%25off"))
+
+		item, err := disk.Get(ctx, "100%off")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "escaped")
+	})
+
+	t.Run("Shards", func(t *testing.T) {
+		biff.AssertNil(disk.SetShards(2))
+
+		items, err := disk.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(ids(items), []string{"100%off", "a%2Fb", "a/b"})
+	})
+}
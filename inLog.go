@@ -0,0 +1,1033 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// StoreLog is an embedded store in the style of Bitcask: every write is
+// appended to the active segment file and the location of the last record of
+// every id is kept in memory (the key directory), so writes are one append
+// and reads one read at a known offset. Deletes append a tombstone.
+//
+// Segments are sealed when they reach a maximum size (see SetMaxSegmentSize)
+// and a hint file with their key directory is written next to them, so
+// opening the store does not read the values. Sealed segments are merged in
+// the background when too many of their bytes are dead (see SetMergeRatio and
+// Merge). Records are checksummed: the torn writes found at the end of the
+// log when the store is opened are discarded.
+//
+// A data directory can only be used by one StoreLog at a time (see Close).
+type StoreLog[T Identifier] struct {
+	dir            string
+	dirLock        *os.File
+	codec          Codec
+	maxSegmentSize int64
+	sync           bool
+	mergeRatio     float64
+
+	mutex       sync.Mutex   // serializes the writes
+	keyMutex    sync.RWMutex // guards keys and segments, held while reading a segment
+	keys        map[string]logEntry
+	segments    map[uint64]*os.File
+	active      uint64 // segment being written
+	activeSize  int64
+	activeHints []byte // of the records of the active segment
+	nextSegment uint64
+	seq         uint64
+	totalBytes  int64 // of all the segments
+	liveBytes   int64 // of the records in keys
+
+	unique  indexSet[T]
+	changes broadcaster[T]
+
+	merging     sync.Mutex // held by Merge
+	mergeNeeded chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+	merger      sync.WaitGroup
+}
+
+// mergeFile lists the segments replaced by a merge once its segments are
+// written, the merge is finished when the store is opened if it was
+// interrupted
+const mergeFile = "merge"
+
+// ErrLocked is returned when the data directory is being used by other store
+var ErrLocked = errors.New("locked")
+
+// NewStoreLog opens or creates the log in dir, loading the key directory. It
+// must be closed to release dir.
+func NewStoreLog[T Identifier](dir string, constraints ...UniqueConstraint) (*StoreLog[T], error) {
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("ensure data dir '%s': %s", dir, err.Error())
+	}
+
+	dirLock, err := os.OpenFile(path.Join(dir, "lock"), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock: %s", err.Error())
+	}
+	locked, err := tryLockFile(dirLock)
+	if err != nil || !locked {
+		dirLock.Close()
+		if err == nil {
+			err = ErrLocked
+		}
+		return nil, fmt.Errorf("locking data dir '%s': %w", dir, err)
+	}
+
+	f := &StoreLog[T]{
+		dir:            dir,
+		dirLock:        dirLock,
+		codec:          JSONCodec{},
+		maxSegmentSize: 64 * 1024 * 1024,
+		sync:           true,
+		mergeRatio:     0.5,
+		keys:           map[string]logEntry{},
+		segments:       map[uint64]*os.File{},
+		unique:         newIndexSet(UniqueIndexes[T](constraints...)),
+		mergeNeeded:    make(chan struct{}, 1),
+		closed:         make(chan struct{}),
+	}
+
+	if err := f.load(); err != nil {
+		f.closeFiles()
+		return nil, err
+	}
+	if err := f.buildUnique(); err != nil {
+		f.closeFiles()
+		return nil, err
+	}
+
+	f.merger.Add(1)
+	go f.mergeLoop()
+
+	return f, nil
+}
+
+// SetCodec changes the encoding of the items, existing segments must have
+// been written with the same codec. It must be called before the store is
+// used.
+func (f *StoreLog[T]) SetCodec(codec Codec) error {
+	f.codec = codec
+	return f.buildUnique()
+}
+
+// SetMaxSegmentSize changes the size at which the active segment is sealed
+// (64MB by default). It must be called before the store is used.
+func (f *StoreLog[T]) SetMaxSegmentSize(size int64) {
+	f.maxSegmentSize = size
+}
+
+// SetSync changes if every write waits for the data to reach the disk (true
+// by default). Without it writes are faster but the last ones can be lost if
+// the machine crashes. It must be called before the store is used.
+func (f *StoreLog[T]) SetSync(sync bool) {
+	f.sync = sync
+}
+
+// SetMergeRatio changes the fraction of dead bytes (0.5 by default) that
+// starts a merge in the background when a segment is sealed, 0 disables it.
+// It must be called before the store is used.
+func (f *StoreLog[T]) SetMergeRatio(ratio float64) {
+	f.mergeRatio = ratio
+}
+
+// Close stops the background merge, closes the segments and releases the data
+// directory
+func (f *StoreLog[T]) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+	})
+	f.merger.Wait()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.closeFiles()
+}
+
+func (f *StoreLog[T]) closeFiles() error {
+	f.keyMutex.Lock()
+	defer f.keyMutex.Unlock()
+
+	var result error
+	for segment, file := range f.segments {
+		if err := file.Close(); err != nil && result == nil {
+			result = err
+		}
+		delete(f.segments, segment)
+	}
+	if f.dirLock != nil {
+		unlockFile(f.dirLock)
+		f.dirLock.Close()
+		f.dirLock = nil
+	}
+	return result
+}
+
+// load finishes an interrupted merge and reads the key directory from the
+// hint files, or from the segments if they have none
+func (f *StoreLog[T]) load() error {
+	if err := f.finishMerge(); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return fmt.Errorf("reading directory: %s", err.Error())
+	}
+	segments := []uint64{}
+	for _, entry := range entries {
+		if segment, ok := parseSegmentName(entry.Name()); ok && !entry.IsDir() {
+			segments = append(segments, segment)
+		}
+	}
+	slices.Sort(segments)
+
+	// records are applied by seq, merged segments have old records
+	tombstones := map[string]uint64{}
+	apply := func(key string, e logEntry) {
+		f.seq = max(f.seq, e.seq)
+		if current, ok := f.keys[key]; ok && current.seq >= e.seq {
+			return
+		}
+		if seq, ok := tombstones[key]; ok && seq >= e.seq {
+			return
+		}
+		if e.kind == logDelete {
+			delete(f.keys, key)
+			tombstones[key] = e.seq
+			return
+		}
+		f.keys[key] = e
+	}
+
+	for i, segment := range segments {
+		active := i == len(segments)-1
+		if err := f.loadSegment(segment, active, apply); err != nil {
+			return err
+		}
+	}
+
+	if len(segments) == 0 {
+		if err := f.createActive(1); err != nil {
+			return err
+		}
+	}
+
+	for key, e := range f.keys {
+		e.kind = logPut
+		f.keys[key] = e
+		f.liveBytes += e.size
+	}
+
+	return nil
+}
+
+// loadSegment opens a segment and applies its entries, the active segment is
+// truncated after its last valid record
+func (f *StoreLog[T]) loadSegment(segment uint64, active bool, apply func(key string, e logEntry)) error {
+	filename := path.Join(f.dir, segmentName(segment))
+
+	flag := os.O_RDONLY
+	if active {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(filename, flag, 0666)
+	if err != nil {
+		return fmt.Errorf("opening segment '%s': %s", filename, err.Error())
+	}
+	f.segments[segment] = file
+	f.nextSegment = max(f.nextSegment, segment+1)
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("opening segment '%s': %s", filename, err.Error())
+	}
+	size := info.Size()
+
+	if !active {
+		err := readHints(path.Join(f.dir, hintName(segment)), segment, apply)
+		if err == nil {
+			f.totalBytes += size
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("reading hints of '%s': %s\n", filename, err.Error())
+		}
+	}
+
+	valid, hints, err := scanSegment(file, segment, apply)
+	if err != nil && err != errCorrupted {
+		return fmt.Errorf("reading segment '%s': %s", filename, err.Error())
+	}
+
+	if active {
+		if valid < size {
+			log.Printf("discarding %d bytes at the end of '%s'\n", size-valid, filename)
+			if err := file.Truncate(valid); err != nil {
+				return fmt.Errorf("truncating segment '%s': %s", filename, err.Error())
+			}
+		}
+		f.active = segment
+		f.activeSize = valid
+		f.activeHints = hints
+		f.totalBytes += valid
+		return nil
+	}
+
+	if valid < size {
+		log.Printf("ignoring %d damaged bytes at the end of '%s'\n", size-valid, filename)
+	}
+	if err := writeFileAtomic(path.Join(f.dir, hintName(segment)), hints); err != nil {
+		log.Printf("writing hints of '%s': %s\n", filename, err.Error())
+	}
+	f.totalBytes += size
+	return nil
+}
+
+// createActive starts a new empty active segment, the previous one (if any)
+// must be sealed
+func (f *StoreLog[T]) createActive(segment uint64) error {
+	filename := path.Join(f.dir, segmentName(segment))
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	if err != nil {
+		return fmt.Errorf("creating segment '%s': %s", filename, err.Error())
+	}
+
+	f.keyMutex.Lock()
+	f.segments[segment] = file
+	f.keyMutex.Unlock()
+
+	f.active = segment
+	f.activeSize = 0
+	f.activeHints = nil
+	f.nextSegment = segment + 1
+	return nil
+}
+
+// seal syncs the active segment, writes its hints and starts a new one. It
+// must be called with the mutex held.
+func (f *StoreLog[T]) seal() error {
+	if err := f.segments[f.active].Sync(); err != nil {
+		return fmt.Errorf("syncing segment: %s", err.Error())
+	}
+	if err := writeFileAtomic(path.Join(f.dir, hintName(f.active)), f.activeHints); err != nil {
+		return fmt.Errorf("writing hints: %s", err.Error())
+	}
+	if err := f.createActive(f.nextSegment); err != nil {
+		return err
+	}
+
+	if f.mergeRatio > 0 && float64(f.totalBytes-f.liveBytes) >= f.mergeRatio*float64(f.totalBytes) {
+		select {
+		case f.mergeNeeded <- struct{}{}:
+		default: // already requested
+		}
+	}
+	return nil
+}
+
+// buildUnique loads the unique index from the segments
+func (f *StoreLog[T]) buildUnique() error {
+	if len(f.unique) == 0 {
+		return nil
+	}
+
+	for _, index := range f.unique {
+		index.entries.Clear()
+	}
+	for id := range f.keys {
+		item, err := f.Get(context.Background(), id)
+		if err != nil {
+			return err
+		}
+		f.unique.reindex(id, nil, item)
+	}
+	return nil
+}
+
+// read returns the record of entry
+func (f *StoreLog[T]) read(e logEntry) (*logRecord, error) {
+	f.keyMutex.RLock()
+	defer f.keyMutex.RUnlock()
+	return f.readLocked(e)
+}
+
+// readLocked is read with the keyMutex held
+func (f *StoreLog[T]) readLocked(e logEntry) (*logRecord, error) {
+	file, ok := f.segments[e.segment]
+	if !ok {
+		return nil, fmt.Errorf("segment %d not found", e.segment)
+	}
+	data := make([]byte, e.size)
+	if _, err := file.ReadAt(data, e.offset); err != nil {
+		return nil, err
+	}
+	return decodeRecord(data)
+}
+
+// entry returns the entry of id if it exists
+func (f *StoreLog[T]) entry(id string) (logEntry, bool) {
+	f.keyMutex.RLock()
+	defer f.keyMutex.RUnlock()
+	e, ok := f.keys[id]
+	return e, ok
+}
+
+func (f *StoreLog[T]) Get(ctx context.Context, id string) (*T, error) {
+	f.keyMutex.RLock()
+	e, ok := f.keys[id]
+	if !ok {
+		f.keyMutex.RUnlock()
+		return nil, nil
+	}
+	record, err := f.readLocked(e)
+	f.keyMutex.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("reading item '%s': %s", id, err.Error())
+	}
+
+	var item *T
+	if err := f.codec.Unmarshal(record.value, &item); err != nil {
+		return nil, fmt.Errorf("decoding item '%s': %s", id, err.Error())
+	}
+	return item, nil
+}
+
+func (f *StoreLog[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+	return getEach[T](ctx, f, ids)
+}
+
+// ids returns the ids in the key directory, sorted
+func (f *StoreLog[T]) ids() []string {
+	f.keyMutex.RLock()
+	ids := make([]string, 0, len(f.keys))
+	for id := range f.keys {
+		ids = append(ids, id)
+	}
+	f.keyMutex.RUnlock()
+
+	sort.Strings(ids)
+	return ids
+}
+
+func (f *StoreLog[T]) List(ctx context.Context) ([]*T, error) {
+	result := []*T{}
+	for item, err := range f.Iterate(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// Iterate returns the items sorted by id, the ids are taken when it starts
+func (f *StoreLog[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		for _, id := range f.ids() {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+
+			item, err := f.Get(ctx, id)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if item == nil {
+				continue // deleted meanwhile
+			}
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (f *StoreLog[T]) ListPage(ctx context.Context, req PageRequest) (*Page[T], error) {
+	after, err := DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := f.ids()
+	if req.Cursor != "" {
+		ids = ids[sort.SearchStrings(ids, after+"\x00"):]
+	}
+
+	limit := req.GetLimit()
+	result := []*T{}
+	for _, id := range ids {
+		if len(result) > limit {
+			break
+		}
+		item, err := f.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if item == nil {
+			continue // deleted meanwhile
+		}
+		result = append(result, item)
+	}
+
+	return NewPage(result, limit), nil
+}
+
+func (f *StoreLog[T]) Find(ctx context.Context, filter Filter, sort ...SortField) ([]*T, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ValidateSort(sort); err != nil {
+		return nil, err
+	}
+
+	items, err := f.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err = FilterItems(items, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, SortItems(items, sort)
+}
+
+func (f *StoreLog[T]) Put(ctx context.Context, item *T) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.put(item, false); err != nil {
+		return err
+	}
+	return f.syncActive()
+}
+
+func (f *StoreLog[T]) Create(ctx context.Context, item *T) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, exists := f.entry((*item).GetId()); exists {
+		return ErrAlreadyExists
+	}
+	previous := (*item).GetVersion()
+	(*item).SetVersion(0)
+	if err := f.put(item, false); err != nil {
+		(*item).SetVersion(previous)
+		return err
+	}
+	return f.syncActive()
+}
+
+func (f *StoreLog[T]) Update(ctx context.Context, item *T) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.put(item, true); err != nil {
+		return err
+	}
+	return f.syncActive()
+}
+
+func (f *StoreLog[T]) PutMany(ctx context.Context, items []*T) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	errs := DuplicatedIds(items)
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+		errs[i] = f.put(item, false)
+	}
+	if err := f.syncActive(); err != nil {
+		return err
+	}
+
+	return NewBatchError(errs)
+}
+
+// put appends item with the next version, it must exist if mustExist. It
+// must be called with the mutex held and does not sync.
+func (f *StoreLog[T]) put(item *T, mustExist bool) error {
+	id := (*item).GetId()
+	version := (*item).GetVersion()
+
+	e, exists := f.entry(id)
+	if !exists && mustExist {
+		return ErrNotFound
+	}
+	if exists && e.version != version {
+		return ErrVersionGone
+	}
+
+	var current *T
+	if exists && len(f.unique) > 0 {
+		var err error
+		if current, err = f.Get(context.Background(), id); err != nil {
+			return err
+		}
+	}
+	if err := f.unique.checkUnique([]*T{item}, nil); err != nil {
+		return err
+	}
+
+	(*item).SetVersion(version + 1)
+	if err := f.append([]*T{item}, nil, false); err != nil {
+		(*item).SetVersion(version)
+		return err
+	}
+	f.unique.reindex(id, current, item)
+
+	if exists {
+		f.changes.publish(ChangeUpdate, id, version, version+1, item)
+	} else {
+		f.changes.publish(ChangeInsert, id, 0, version+1, item)
+	}
+	return nil
+}
+
+// append writes the puts (with their version already set) and the deletes in
+// a single write, in a batch if atomic, and updates the key directory. It
+// must be called with the mutex held and does not sync.
+func (f *StoreLog[T]) append(puts []*T, deletes []string, atomic bool) error {
+	records := []*logRecord{}
+	for _, item := range puts {
+		value, err := f.codec.Marshal(item)
+		if err != nil {
+			return fmt.Errorf("encoding item '%s': %s", (*item).GetId(), err.Error())
+		}
+		f.seq++
+		records = append(records, &logRecord{
+			seq:     f.seq,
+			kind:    logPut,
+			version: (*item).GetVersion(),
+			key:     (*item).GetId(),
+			value:   value,
+		})
+	}
+	for _, id := range deletes {
+		f.seq++
+		records = append(records, &logRecord{seq: f.seq, kind: logDelete, key: id})
+	}
+
+	if f.activeSize >= f.maxSegmentSize {
+		if err := f.seal(); err != nil {
+			return err
+		}
+	}
+
+	buf := []byte{}
+	if atomic {
+		f.seq++
+		buf = appendRecord(buf, &logRecord{seq: f.seq, kind: logBatch, version: int64(len(records))})
+	}
+	offsets := []int64{}
+	for _, record := range records {
+		offsets = append(offsets, f.activeSize+int64(len(buf)))
+		buf = appendRecord(buf, record)
+	}
+
+	file := f.segments[f.active]
+	if _, err := file.WriteAt(buf, f.activeSize); err != nil {
+		file.Truncate(f.activeSize)
+		return fmt.Errorf("writing segment: %s", err.Error())
+	}
+	f.activeSize += int64(len(buf))
+	f.totalBytes += int64(len(buf))
+
+	f.keyMutex.Lock()
+	defer f.keyMutex.Unlock()
+
+	for i, record := range records {
+		e := logEntry{
+			segment: f.active,
+			offset:  offsets[i],
+			size:    record.size(),
+			version: record.version,
+			seq:     record.seq,
+			kind:    record.kind,
+		}
+		f.activeHints = appendHint(f.activeHints, record.key, e)
+
+		if previous, ok := f.keys[record.key]; ok {
+			f.liveBytes -= previous.size
+		}
+		if record.kind == logDelete {
+			delete(f.keys, record.key)
+			continue
+		}
+		f.keys[record.key] = e
+		f.liveBytes += e.size
+	}
+
+	return nil
+}
+
+// syncActive makes the writes durable if sync is enabled
+func (f *StoreLog[T]) syncActive() error {
+	if !f.sync {
+		return nil
+	}
+	if err := f.segments[f.active].Sync(); err != nil {
+		return fmt.Errorf("syncing segment: %s", err.Error())
+	}
+	return nil
+}
+
+func (f *StoreLog[T]) Delete(ctx context.Context, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.delete(id, nil); err != nil {
+		return err
+	}
+	return f.syncActive()
+}
+
+func (f *StoreLog[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.delete(id, &version); err != nil {
+		return err
+	}
+	return f.syncActive()
+}
+
+func (f *StoreLog[T]) DeleteMany(ctx context.Context, ids []string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, id := range ids {
+		if err := f.delete(id, nil); err != nil {
+			return err
+		}
+	}
+	return f.syncActive()
+}
+
+// delete appends a tombstone for id if it exists, only if it is at version
+// (if not nil). It must be called with the mutex held and does not sync.
+func (f *StoreLog[T]) delete(id string, version *int64) error {
+	e, exists := f.entry(id)
+	if !exists {
+		if version != nil {
+			return ErrNotFound
+		}
+		return nil
+	}
+	if version != nil && e.version != *version {
+		return ErrVersionGone
+	}
+
+	var current *T
+	if len(f.unique) > 0 {
+		var err error
+		if current, err = f.Get(context.Background(), id); err != nil {
+			return err
+		}
+	}
+
+	if err := f.append(nil, []string{id}, false); err != nil {
+		return err
+	}
+	f.unique.reindex(id, current, nil)
+	f.changes.publish(ChangeDelete, id, e.version, 0, nil)
+
+	return nil
+}
+
+// WithTx stages the writes in memory and appends them on commit in a single
+// batch, which is discarded as a whole if it is found torn when the store is
+// opened
+func (f *StoreLog[T]) WithTx(ctx context.Context, fn func(tx Storer[T]) error) error {
+	tx := newStagedTx[T](f, true, f.codec)
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	currents := map[string]*T{}
+	for _, id := range tx.order {
+		current, err := f.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if tx.entries[id].changed(current) {
+			return ErrVersionGone
+		}
+		currents[id] = current
+	}
+
+	puts, deletes := tx.writes()
+	if err := f.unique.checkUnique(puts, deletes); err != nil {
+		return err
+	}
+	if err := f.append(puts, deletes, true); err != nil {
+		return err
+	}
+	if err := f.syncActive(); err != nil {
+		return err
+	}
+
+	for _, item := range puts {
+		id := (*item).GetId()
+		f.unique.reindex(id, currents[id], item)
+		if current := currents[id]; current != nil {
+			f.changes.publish(ChangeUpdate, id, (*current).GetVersion(), (*item).GetVersion(), item)
+		} else {
+			f.changes.publish(ChangeInsert, id, 0, (*item).GetVersion(), item)
+		}
+	}
+	for _, id := range deletes {
+		f.unique.reindex(id, currents[id], nil)
+		f.changes.publish(ChangeDelete, id, (*currents[id]).GetVersion(), 0, nil)
+	}
+
+	tx.commit()
+	return nil
+}
+
+// Watch streams the changes done through this store, resume is not supported
+func (f *StoreLog[T]) Watch(ctx context.Context, from string) (<-chan ChangeEvent[T], error) {
+	if from != "" {
+		return nil, ErrResumeNotSupported
+	}
+	return f.changes.subscribe(ctx), nil
+}
+
+func (f *StoreLog[T]) mergeLoop() {
+	defer f.merger.Done()
+	for {
+		select {
+		case <-f.closed:
+			return
+		case <-f.mergeNeeded:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-f.closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		if err := f.Merge(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("merging '%s': %s\n", f.dir, err.Error())
+		}
+		cancel()
+	}
+}
+
+// Merge rewrites the sealed segments (the active one is sealed first) keeping
+// only the live records, which also drops the tombstones. Writes go on while
+// it runs.
+func (f *StoreLog[T]) Merge(ctx context.Context) error {
+	f.merging.Lock()
+	defer f.merging.Unlock()
+
+	// 1. Seal the active segment, everything before is merged
+	f.mutex.Lock()
+	if f.activeSize > 0 {
+		if err := f.seal(); err != nil {
+			f.mutex.Unlock()
+			return err
+		}
+	}
+	inputs := map[uint64]bool{}
+	f.keyMutex.RLock()
+	for segment := range f.segments {
+		if segment != f.active {
+			inputs[segment] = true
+		}
+	}
+	type copied struct {
+		id       string
+		old, new logEntry
+	}
+	copies := []*copied{}
+	for id, e := range f.keys {
+		if inputs[e.segment] {
+			copies = append(copies, &copied{id: id, old: e})
+		}
+	}
+	f.keyMutex.RUnlock()
+	f.mutex.Unlock()
+
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	// 2. Copy the live records to new segments, in the order they are
+	sort.Slice(copies, func(i, j int) bool {
+		if copies[i].old.segment != copies[j].old.segment {
+			return copies[i].old.segment < copies[j].old.segment
+		}
+		return copies[i].old.offset < copies[j].old.offset
+	})
+
+	outputs := map[uint64]*os.File{}
+	outputSizes := map[uint64]int64{}
+	discard := func() {
+		for segment, file := range outputs {
+			file.Close()
+			os.Remove(path.Join(f.dir, segmentName(segment)))
+			os.Remove(path.Join(f.dir, hintName(segment)))
+		}
+	}
+
+	var output *os.File
+	var segment uint64
+	buf := []byte{}
+	hints := []byte{}
+	size := int64(0)
+	flush := func() error {
+		if output == nil {
+			return nil
+		}
+		if _, err := output.Write(buf); err != nil {
+			return err
+		}
+		if err := output.Sync(); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path.Join(f.dir, hintName(segment)), hints); err != nil {
+			return err
+		}
+		outputSizes[segment] = size
+		output, buf, hints, size = nil, buf[:0], hints[:0], 0
+		return nil
+	}
+
+	for _, c := range copies {
+		if err := ctx.Err(); err != nil {
+			discard()
+			return err
+		}
+
+		if output == nil || size >= f.maxSegmentSize {
+			if err := flush(); err != nil {
+				discard()
+				return err
+			}
+			f.mutex.Lock()
+			segment = f.nextSegment
+			f.nextSegment++
+			f.mutex.Unlock()
+
+			file, err := os.OpenFile(path.Join(f.dir, segmentName(segment)), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+			if err != nil {
+				discard()
+				return err
+			}
+			output = file
+			outputs[segment] = file
+		}
+
+		record, err := f.read(c.old)
+		if err != nil {
+			discard()
+			return fmt.Errorf("reading item '%s': %s", c.id, err.Error())
+		}
+		c.new = c.old
+		c.new.segment = segment
+		c.new.offset = size
+		buf = appendRecord(buf, record)
+		hints = appendHint(hints, c.id, c.new)
+		size += c.new.size
+	}
+	if err := flush(); err != nil {
+		discard()
+		return err
+	}
+
+	// 3. Commit: from now on the inputs are not needed
+	manifest := []byte{}
+	for segment := range inputs {
+		manifest = strconv.AppendUint(manifest, segment, 10)
+		manifest = append(manifest, '\n')
+	}
+	if err := writeFileAtomic(path.Join(f.dir, mergeFile), manifest); err != nil {
+		discard()
+		return err
+	}
+
+	// 4. Point the key directory to the copies still alive and swap the files
+	f.mutex.Lock()
+	f.keyMutex.Lock()
+	for _, c := range copies {
+		if current, ok := f.keys[c.id]; ok && current == c.old {
+			f.keys[c.id] = c.new
+		}
+	}
+	for segment, file := range outputs {
+		f.segments[segment] = file
+		f.totalBytes += outputSizes[segment]
+	}
+	for segment := range inputs {
+		file := f.segments[segment]
+		if info, err := file.Stat(); err == nil {
+			f.totalBytes -= info.Size()
+		}
+		file.Close()
+		delete(f.segments, segment)
+	}
+	f.keyMutex.Unlock()
+	f.mutex.Unlock()
+
+	// a merge requested by the seal above is already done
+	select {
+	case <-f.mergeNeeded:
+	default:
+	}
+
+	return f.finishMerge()
+}
+
+// finishMerge removes the segments replaced by a merge
+func (f *StoreLog[T]) finishMerge() error {
+	manifest, err := os.ReadFile(path.Join(f.dir, mergeFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading merge: %s", err.Error())
+	}
+
+	for _, line := range bytes.Fields(manifest) {
+		segment, err := strconv.ParseUint(string(line), 10, 64)
+		if err != nil {
+			return fmt.Errorf("reading merge: %s", err.Error())
+		}
+		for _, name := range []string{segmentName(segment), hintName(segment)} {
+			if err := os.Remove(path.Join(f.dir, name)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("removing merged segment: %s", err.Error())
+			}
+		}
+	}
+
+	if err := os.Remove(path.Join(f.dir, mergeFile)); err != nil {
+		return fmt.Errorf("removing merge: %s", err.Error())
+	}
+	return nil
+}
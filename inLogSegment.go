@@ -0,0 +1,279 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Kinds of the records of StoreLog
+const (
+	logPut    byte = 1
+	logDelete byte = 2
+	logBatch  byte = 3 // the next version records are written atomically
+)
+
+// logHeaderSize is the size of the header of a record: crc32 of the rest,
+// seq, kind, version, key length and value length. The key and the value
+// follow.
+const logHeaderSize = 4 + 8 + 1 + 8 + 4 + 4
+
+// hintHeaderSize is the size of the header of a hint: crc32 of the rest, seq,
+// kind, version, offset and size of the record, and key length. The key
+// follows.
+const hintHeaderSize = 4 + 8 + 1 + 8 + 8 + 4 + 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorrupted = errors.New("corrupted record")
+
+// logRecord is an entry of a segment. seq grows with every record written, so
+// the last record of an id is the one with the greatest seq wherever it is
+// (merges copy records to newer segments).
+type logRecord struct {
+	seq     uint64
+	kind    byte
+	version int64
+	key     string
+	value   []byte
+}
+
+func (r *logRecord) size() int64 {
+	return int64(logHeaderSize + len(r.key) + len(r.value))
+}
+
+// appendRecord encodes r at the end of buf
+func appendRecord(buf []byte, r *logRecord) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0) // crc
+	buf = binary.BigEndian.AppendUint64(buf, r.seq)
+	buf = append(buf, r.kind)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.version))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(r.key)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(r.value)))
+	buf = append(buf, r.key...)
+	buf = append(buf, r.value...)
+	binary.BigEndian.PutUint32(buf[start:], crc32.Checksum(buf[start+4:], crcTable))
+	return buf
+}
+
+// decodeRecord decodes a whole record, checking its crc
+func decodeRecord(data []byte) (*logRecord, error) {
+	if len(data) < logHeaderSize {
+		return nil, errCorrupted
+	}
+	keyLength := int(binary.BigEndian.Uint32(data[21:]))
+	valueLength := int(binary.BigEndian.Uint32(data[25:]))
+	if len(data) != logHeaderSize+keyLength+valueLength {
+		return nil, errCorrupted
+	}
+	if binary.BigEndian.Uint32(data) != crc32.Checksum(data[4:], crcTable) {
+		return nil, errCorrupted
+	}
+	return &logRecord{
+		seq:     binary.BigEndian.Uint64(data[4:]),
+		kind:    data[12],
+		version: int64(binary.BigEndian.Uint64(data[13:])),
+		key:     string(data[logHeaderSize : logHeaderSize+keyLength]),
+		value:   data[logHeaderSize+keyLength:],
+	}, nil
+}
+
+// readRecord reads the next record of r, io.EOF if there are no more and
+// errCorrupted if it is torn or damaged. Records can not be longer than
+// remaining.
+func readRecord(r *bufio.Reader, remaining int64) (*logRecord, int64, error) {
+	header, err := r.Peek(logHeaderSize)
+	if err == io.EOF && len(header) == 0 {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, errCorrupted
+	}
+	length := logHeaderSize + int64(binary.BigEndian.Uint32(header[21:])) + int64(binary.BigEndian.Uint32(header[25:]))
+	if length > remaining {
+		return nil, 0, errCorrupted
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, errCorrupted
+	}
+	record, err := decodeRecord(data)
+	return record, length, err
+}
+
+// logEntry is where the last record of an id is
+type logEntry struct {
+	segment uint64
+	offset  int64
+	size    int64
+	version int64
+	seq     uint64
+	kind    byte // logDelete only while loading, keys has only puts
+}
+
+// appendHint encodes the entry of key at the end of buf
+func appendHint(buf []byte, key string, e logEntry) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0) // crc
+	buf = binary.BigEndian.AppendUint64(buf, e.seq)
+	buf = append(buf, e.kind)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.version))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.offset))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(e.size))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(key)))
+	buf = append(buf, key...)
+	binary.BigEndian.PutUint32(buf[start:], crc32.Checksum(buf[start+4:], crcTable))
+	return buf
+}
+
+// readHints decodes a whole hint file, a damaged hint file is not used
+func readHints(filename string, segment uint64, fn func(key string, e logEntry)) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	type hint struct {
+		key string
+		e   logEntry
+	}
+	hints := []hint{}
+	for len(data) > 0 {
+		if len(data) < hintHeaderSize {
+			return errCorrupted
+		}
+		length := hintHeaderSize + int(binary.BigEndian.Uint32(data[33:]))
+		if len(data) < length || binary.BigEndian.Uint32(data) != crc32.Checksum(data[4:length], crcTable) {
+			return errCorrupted
+		}
+		hints = append(hints, hint{
+			key: string(data[hintHeaderSize:length]),
+			e: logEntry{
+				segment: segment,
+				seq:     binary.BigEndian.Uint64(data[4:]),
+				kind:    data[12],
+				version: int64(binary.BigEndian.Uint64(data[13:])),
+				offset:  int64(binary.BigEndian.Uint64(data[21:])),
+				size:    int64(binary.BigEndian.Uint32(data[29:])),
+			},
+		})
+		data = data[length:]
+	}
+
+	for _, h := range hints {
+		fn(h.key, h.e)
+	}
+	return nil
+}
+
+// scanSegment reads the records of a segment calling fn with the entry of
+// every put and delete, the records of a batch only if the whole batch is
+// there. It returns the size of the valid part of the segment and the hints
+// of it.
+func scanSegment(file *os.File, segment uint64, fn func(key string, e logEntry)) (valid int64, hints []byte, err error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(file, 0, info.Size()), 64*1024)
+
+	type pending struct {
+		key string
+		e   logEntry
+	}
+	batch := []pending{}
+	remaining := int64(0) // records left in the batch
+	offset := int64(0)
+
+	for {
+		record, length, err := readRecord(r, info.Size()-offset)
+		if err == io.EOF {
+			return valid, hints, nil
+		}
+		if err != nil {
+			return valid, hints, err
+		}
+
+		switch record.kind {
+		case logBatch:
+			if remaining > 0 {
+				return valid, hints, errCorrupted
+			}
+			remaining = record.version
+		case logPut, logDelete:
+			batch = append(batch, pending{key: record.key, e: logEntry{
+				segment: segment,
+				offset:  offset,
+				size:    length,
+				version: record.version,
+				seq:     record.seq,
+				kind:    record.kind,
+			}})
+			if remaining > 0 {
+				remaining--
+			}
+		default:
+			return valid, hints, errCorrupted
+		}
+		offset += length
+
+		if remaining == 0 {
+			for _, p := range batch {
+				fn(p.key, p.e)
+				hints = appendHint(hints, p.key, p.e)
+			}
+			batch = batch[:0]
+			valid = offset
+		}
+	}
+}
+
+func segmentName(segment uint64) string {
+	return fmt.Sprintf("%010d.log", segment)
+}
+
+func hintName(segment uint64) string {
+	return fmt.Sprintf("%010d.hint", segment)
+}
+
+// parseSegmentName returns the number of a segment file
+func parseSegmentName(name string) (uint64, bool) {
+	number, ok := strings.CutSuffix(name, ".log")
+	if !ok {
+		return 0, false
+	}
+	segment, err := strconv.ParseUint(number, 10, 64)
+	return segment, err == nil
+}
+
+// writeFileAtomic writes a file with a temp file and a rename, so it is never
+// found half written
+func writeFileAtomic(filename string, data []byte) error {
+	tmpFile, err := os.CreateTemp(path.Dir(filename), path.Base(filename)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name()) // fails once renamed
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
@@ -0,0 +1,279 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+)
+
+func newStoreLog(t *testing.T, dir string, constraints ...store.UniqueConstraint) *store.StoreLog[testutils.TestItem] {
+	p, err := store.NewStoreLog[testutils.TestItem](dir, constraints...)
+	biff.AssertNil(err)
+	t.Cleanup(func() {
+		p.Close()
+	})
+	return p
+}
+
+func TestStoreLog(t *testing.T) {
+	p := newStoreLog(t, t.TempDir())
+	testutils.SuitePersistencer(p, t)
+	testutils.SuiteOptimisticLocking(newStoreLog(t, t.TempDir()), t)
+}
+
+func TestStoreLog_Pagination(t *testing.T) {
+	testutils.SuitePagination(newStoreLog(t, t.TempDir()), t)
+}
+
+func TestStoreLog_Querier(t *testing.T) {
+	testutils.SuiteQuerier(newStoreLog(t, t.TempDir()), t)
+}
+
+func TestStoreLog_Iterable(t *testing.T) {
+	testutils.SuiteIterable(newStoreLog(t, t.TempDir()), t)
+}
+
+func TestStoreLog_Batch(t *testing.T) {
+	testutils.SuiteBatch(newStoreLog(t, t.TempDir()), t)
+}
+
+func TestStoreLog_Transactor(t *testing.T) {
+	testutils.SuiteTransactor(newStoreLog(t, t.TempDir()), t)
+}
+
+func TestStoreLog_Watcher(t *testing.T) {
+	testutils.SuiteWatcher(newStoreLog(t, t.TempDir()), t)
+}
+
+func TestStoreLog_VersionDeleter(t *testing.T) {
+	testutils.SuiteVersionDeleter(newStoreLog(t, t.TempDir()), t)
+}
+
+func TestStoreLog_Aliasing(t *testing.T) {
+	testutils.SuiteAliasing(newStoreLog(t, t.TempDir()), t)
+}
+
+func TestStoreLog_UniqueConstraints(t *testing.T) {
+	testutils.SuiteUniqueConstraints(newStoreLog(t, t.TempDir(), testutils.TestItemConstraints...), t)
+}
+
+func TestStoreLog_Reopen(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	p, err := store.NewStoreLog[testutils.TestItem](dir, testutils.TestItemConstraints...)
+	biff.AssertNil(err)
+
+	for _, id := range []string{"a", "b", "c"} {
+		biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId(id), Title: id, Description: "unique " + id}))
+	}
+	item, err := p.Get(ctx, "a")
+	biff.AssertNil(err)
+	item.Title = "a2"
+	biff.AssertNil(p.Put(ctx, item))
+	biff.AssertNil(p.Delete(ctx, "b"))
+
+	t.Run("Locked", func(t *testing.T) {
+		_, err := store.NewStoreLog[testutils.TestItem](dir)
+		biff.AssertTrue(errors.Is(err, store.ErrLocked))
+	})
+
+	biff.AssertNil(p.Close())
+
+	p = newStoreLog(t, dir, testutils.TestItemConstraints...)
+
+	items, err := p.List(ctx)
+	biff.AssertNil(err)
+	biff.AssertEqual(len(items), 2)
+	biff.AssertEqual(items[0].Title, "a2")
+	biff.AssertEqual(items[0].GetVersion(), int64(2))
+	biff.AssertEqual(items[1].Title, "c")
+
+	t.Run("Unique index is loaded", func(t *testing.T) {
+		err := p.Put(ctx, &testutils.TestItem{Id: store.NewId("d"), Description: "unique c"})
+		biff.AssertTrue(errors.Is(err, store.ErrUniqueViolation))
+	})
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	biff.AssertNil(err)
+	return files
+}
+
+func TestStoreLog_Merge(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	p, err := store.NewStoreLog[testutils.TestItem](dir)
+	biff.AssertNil(err)
+	p.SetMaxSegmentSize(1024)
+	p.SetMergeRatio(0)
+
+	for i := 0; i < 10; i++ {
+		biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId(fmt.Sprint("item-", i))}))
+	}
+	for n := 0; n < 20; n++ {
+		for i := 0; i < 10; i++ {
+			item, err := p.Get(ctx, fmt.Sprint("item-", i))
+			biff.AssertNil(err)
+			item.Counter++
+			biff.AssertNil(p.Put(ctx, item))
+		}
+	}
+	for i := 5; i < 10; i++ {
+		biff.AssertNil(p.Delete(ctx, fmt.Sprint("item-", i)))
+	}
+
+	before := len(segmentFiles(t, dir))
+	biff.AssertTrue(before > 5)
+
+	biff.AssertNil(p.Merge(ctx))
+	after := len(segmentFiles(t, dir))
+	biff.AssertTrue(after < 4)
+
+	check := func(p *store.StoreLog[testutils.TestItem]) {
+		items, err := p.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(items), 5)
+		for _, item := range items {
+			biff.AssertEqual(item.Counter, 20)
+			biff.AssertEqual(item.GetVersion(), int64(21))
+		}
+	}
+	check(p)
+
+	t.Run("Reopen after merge", func(t *testing.T) {
+		biff.AssertNil(p.Close())
+		p := newStoreLog(t, dir)
+		check(p)
+
+		_, err := os.Stat(filepath.Join(dir, "merge"))
+		biff.AssertTrue(os.IsNotExist(err))
+	})
+}
+
+func TestStoreLog_BackgroundMerge(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	p := newStoreLog(t, dir)
+	p.SetMaxSegmentSize(512)
+
+	item := &testutils.TestItem{Id: store.NewId("busy")}
+	for i := 0; i < 200; i++ {
+		item.Counter = i
+		biff.AssertNil(p.Put(ctx, item))
+	}
+
+	// the segments are merged until there are only a few
+	deadline := time.Now().Add(5 * time.Second)
+	for len(segmentFiles(t, dir)) > 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	biff.AssertTrue(len(segmentFiles(t, dir)) <= 3)
+
+	stored, err := p.Get(ctx, "busy")
+	biff.AssertNil(err)
+	biff.AssertEqual(stored.Counter, 199)
+	biff.AssertEqual(stored.GetVersion(), int64(200))
+}
+
+func TestStoreLog_Recovery(t *testing.T) {
+
+	ctx := context.Background()
+
+	// lastSegment returns the segment being written
+	lastSegment := func(dir string) string {
+		files := segmentFiles(t, dir)
+		return files[len(files)-1]
+	}
+
+	t.Run("Torn write", func(t *testing.T) {
+		dir := t.TempDir()
+		p, err := store.NewStoreLog[testutils.TestItem](dir)
+		biff.AssertNil(err)
+		biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("a"), Title: "a"}))
+		biff.AssertNil(p.Close())
+
+		file, err := os.OpenFile(lastSegment(dir), os.O_APPEND|os.O_WRONLY, 0666)
+		biff.AssertNil(err)
+		_, err = file.Write([]byte{1, 2, 3, 4, 5, 6, 7})
+		biff.AssertNil(err)
+		biff.AssertNil(file.Close())
+
+		p = newStoreLog(t, dir)
+		item, err := p.Get(ctx, "a")
+		biff.AssertNil(err)
+		biff.AssertEqual(item.Title, "a")
+
+		biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("b"), Title: "b"}))
+		biff.AssertNil(p.Close())
+
+		p = newStoreLog(t, dir)
+		items, err := p.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(items), 2)
+	})
+
+	t.Run("Damaged record", func(t *testing.T) {
+		dir := t.TempDir()
+		p, err := store.NewStoreLog[testutils.TestItem](dir)
+		biff.AssertNil(err)
+		item := &testutils.TestItem{Id: store.NewId("a"), Title: "first"}
+		biff.AssertNil(p.Put(ctx, item))
+		item.Title = "second"
+		biff.AssertNil(p.Put(ctx, item))
+		biff.AssertNil(p.Close())
+
+		data, err := os.ReadFile(lastSegment(dir))
+		biff.AssertNil(err)
+		data[len(data)-3] ^= 0xff
+		biff.AssertNil(os.WriteFile(lastSegment(dir), data, 0666))
+
+		p = newStoreLog(t, dir)
+		stored, err := p.Get(ctx, "a")
+		biff.AssertNil(err)
+		biff.AssertEqual(stored.Title, "first")
+		biff.AssertEqual(stored.GetVersion(), int64(1))
+	})
+
+	t.Run("Torn transaction", func(t *testing.T) {
+		dir := t.TempDir()
+		p, err := store.NewStoreLog[testutils.TestItem](dir)
+		biff.AssertNil(err)
+		biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("a"), Title: "a"}))
+		biff.AssertNil(p.WithTx(ctx, func(tx store.Storer[testutils.TestItem]) error {
+			if err := tx.Put(ctx, &testutils.TestItem{Id: store.NewId("b")}); err != nil {
+				return err
+			}
+			if err := tx.Put(ctx, &testutils.TestItem{Id: store.NewId("c")}); err != nil {
+				return err
+			}
+			return tx.Delete(ctx, "a")
+		}))
+		biff.AssertNil(p.Close())
+
+		// cut the last record of the transaction
+		info, err := os.Stat(lastSegment(dir))
+		biff.AssertNil(err)
+		biff.AssertNil(os.Truncate(lastSegment(dir), info.Size()-2))
+
+		p = newStoreLog(t, dir)
+		items, err := p.List(ctx)
+		biff.AssertNil(err)
+		biff.AssertEqual(len(items), 1)
+		biff.AssertEqual(items[0].GetId(), "a")
+	})
+}
@@ -2,7 +2,8 @@ package store
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"iter"
 	"sync"
 	"sync/atomic"
 )
@@ -10,6 +11,7 @@ import (
 type node[T any] struct {
 	item atomic.Pointer[T]
 	next atomic.Pointer[node[T]]
+	prev *node[T] // only used by writers, with the mutex held
 }
 
 type StoreMemory[T Identifier] struct {
@@ -19,12 +21,31 @@ type StoreMemory[T Identifier] struct {
 	// or in the correct order without synchronization primitives (like atomic or mutex).
 	// atomic.Pointer provides the necessary "happens-before" edges to ensure that initialization of the node
 	// happens before the head pointer is visible to readers.
-	head  atomic.Pointer[node[T]]
-	mutex sync.Mutex
+	head atomic.Pointer[node[T]]
+	// index maps every id to its node so lookups are O(1). sync.Map keeps
+	// readers lock free, it is optimized for keys written once and read many
+	// times, which is the case since updates replace the item of the node.
+	index   sync.Map // id -> *node[T]
+	indexes indexSet[T]
+	mutex   sync.Mutex
+	changes broadcaster[T]
+	codec   Codec // nil is Clone
 }
 
-func NewStoreMemory[T Identifier]() *StoreMemory[T] {
-	return &StoreMemory[T]{}
+// NewStoreMemory creates an empty store, maintaining the given secondary
+// indexes (see GetBy)
+func NewStoreMemory[T Identifier](indexes ...Index[T]) *StoreMemory[T] {
+	return &StoreMemory[T]{
+		indexes: newIndexSet(indexes),
+	}
+}
+
+// SetCodec makes the copies, done so callers never share memory with the
+// store, by encoding and decoding with codec instead of Clone. It must be
+// called before the store is used.
+func (f *StoreMemory[T]) SetCodec(codec Codec) {
+	f.codec = codec
+	f.changes.codec = codec
 }
 
 func (f *StoreMemory[T]) List(ctx context.Context) ([]*T, error) {
@@ -36,8 +57,10 @@ func (f *StoreMemory[T]) List(ctx context.Context) ([]*T, error) {
 		// safe copy
 		itemPtr := current.item.Load()
 		if itemPtr != nil { // Should be non-nil generally
-			var newItem *T
-			remarshal(itemPtr, &newItem)
+			newItem, err := copyItem(f.codec, itemPtr)
+			if err != nil {
+				return nil, err
+			}
 			result = append(result, newItem)
 		}
 
@@ -47,90 +70,415 @@ func (f *StoreMemory[T]) List(ctx context.Context) ([]*T, error) {
 	return result, nil
 }
 
+func (f *StoreMemory[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		// No lock needed for readers
+		current := f.head.Load()
+		for current != nil {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+
+			if itemPtr := current.item.Load(); itemPtr != nil {
+				// safe copy
+				newItem, err := copyItem(f.codec, itemPtr)
+				if !yield(newItem, err) || err != nil {
+					return
+				}
+			}
+
+			current = current.next.Load()
+		}
+	}
+}
+
+func (f *StoreMemory[T]) ListPage(ctx context.Context, req PageRequest) (*Page[T], error) {
+	// No lock needed for readers
+	var items []*T
+
+	current := f.head.Load()
+	for current != nil {
+		if itemPtr := current.item.Load(); itemPtr != nil {
+			items = append(items, itemPtr)
+		}
+		current = current.next.Load()
+	}
+
+	page, err := PageItems(items, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// safe copy only the items that are returned
+	for i, item := range page.Items {
+		newItem, err := copyItem(f.codec, item)
+		if err != nil {
+			return nil, err
+		}
+		page.Items[i] = newItem
+	}
+
+	return page, nil
+}
+
+func (f *StoreMemory[T]) Find(ctx context.Context, filter Filter, sort ...SortField) ([]*T, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ValidateSort(sort); err != nil {
+		return nil, err
+	}
+
+	// No lock needed for readers
+	result := []*T{}
+
+	current := f.head.Load()
+	for current != nil {
+		itemPtr := current.item.Load()
+		if itemPtr != nil && match(normalize(itemPtr), filter) {
+			// safe copy
+			newItem, err := copyItem(f.codec, itemPtr)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, newItem)
+		}
+		current = current.next.Load()
+	}
+
+	return result, SortItems(result, sort)
+}
+
 func (f *StoreMemory[T]) Put(ctx context.Context, item *T) error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
+	return f.put(item)
+}
+
+func (f *StoreMemory[T]) PutMany(ctx context.Context, items []*T) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	errs := DuplicatedIds(items)
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+		errs[i] = f.put(item)
+	}
+
+	return NewBatchError(errs)
+}
+
+// put must be called with the mutex held
+func (f *StoreMemory[T]) put(item *T) error {
 	id := (*item).GetId()
 	version := (*item).GetVersion()
 
 	// Check if exists
-	current := f.head.Load()
-
-	for current != nil {
+	if current := f.node(id); current != nil {
+		// Found, check version
 		currentItem := current.item.Load()
-		if (*currentItem).GetId() == id {
-			// Found, check version
-			if (*currentItem).GetVersion() != version {
-				return ErrVersionGone
-			}
-
-			// Update
-			(*item).SetVersion(version + 1)
-			current.item.Store(item)
-			return nil
+		if (*currentItem).GetVersion() != version {
+			return ErrVersionGone
+		}
+		if err := f.indexes.checkUnique([]*T{item}, nil); err != nil {
+			return err
+		}
 
+		// Update, keep a copy so the caller can not change the stored item
+		stored, err := copyItem(f.codec, item)
+		if err != nil {
+			return err
 		}
-		current = current.next.Load()
+		(*stored).SetVersion(version + 1)
+		(*item).SetVersion(version + 1)
+		f.indexes.reindex(id, currentItem, stored)
+		current.item.Store(stored)
+		f.changes.publish(ChangeUpdate, id, version, version+1, stored)
+		return nil
 	}
 
 	// Not found, insert new
-	(*item).SetVersion((*item).GetVersion() + 1)
+	if err := f.indexes.checkUnique([]*T{item}, nil); err != nil {
+		return err
+	}
+	stored, err := copyItem(f.codec, item)
+	if err != nil {
+		return err
+	}
+	(*stored).SetVersion(version + 1)
+	(*item).SetVersion(version + 1)
+	f.insert(stored)
+	f.changes.publish(ChangeInsert, id, 0, version+1, stored)
+
+	return nil
+}
+
+// node returns the node of id or nil, it is safe without lock
+func (f *StoreMemory[T]) node(id string) *node[T] {
+	n, ok := f.index.Load(id)
+	if !ok {
+		return nil
+	}
+	return n.(*node[T])
+}
+
+// insert adds a new node at the head, must be called with the mutex held
+func (f *StoreMemory[T]) insert(item *T) {
 	newNode := &node[T]{}
 	newNode.item.Store(item)
-	newNode.next.Store(f.head.Load())
 
+	head := f.head.Load()
+	newNode.next.Store(head)
+	if head != nil {
+		head.prev = newNode
+	}
+
+	// Publish the node fully initialized: first in the list, then in the index
 	f.head.Store(newNode)
+	f.index.Store((*item).GetId(), newNode)
+	f.indexes.reindex((*item).GetId(), nil, item)
+}
+
+func (f *StoreMemory[T]) Create(ctx context.Context, item *T) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.lookup((*item).GetId()) != nil {
+		return ErrAlreadyExists
+	}
+	if err := f.indexes.checkUnique([]*T{item}, nil); err != nil {
+		return err
+	}
+
+	stored, err := copyItem(f.codec, item)
+	if err != nil {
+		return err
+	}
+	(*stored).SetVersion(1)
+	(*item).SetVersion(1)
+	f.replace(stored)
+	return nil
+}
+
+func (f *StoreMemory[T]) Update(ctx context.Context, item *T) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.lookup((*item).GetId()) == nil {
+		return ErrNotFound
+	}
+
+	return f.put(item)
+}
+
+// Watch streams the changes done in this process, resume is not supported
+func (f *StoreMemory[T]) Watch(ctx context.Context, from string) (<-chan ChangeEvent[T], error) {
+	if from != "" {
+		return nil, ErrResumeNotSupported
+	}
+	return f.changes.subscribe(ctx), nil
+}
+
+func (f *StoreMemory[T]) WithTx(ctx context.Context, fn func(tx Storer[T]) error) error {
+	return f.withTx(ctx, fn, nil)
+}
+
+// txHook is called on commit with the store still locked and all versions
+// validated, if it fails nothing is applied. It allows StoreCached to persist
+// the transaction before it is visible in the cache.
+type txHook[T Identifier] func(ctx context.Context, puts []*T, deletes []string) error
 
+func (f *StoreMemory[T]) withTx(ctx context.Context, fn func(tx Storer[T]) error, hook txHook[T]) error {
+	tx := newStagedTx[T](f, true, f.codec)
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, id := range tx.order {
+		if tx.entries[id].changed(f.lookup(id)) {
+			return ErrVersionGone
+		}
+	}
+
+	puts, deletes := tx.writes()
+	if err := f.indexes.checkUnique(puts, deletes); err != nil {
+		return err
+	}
+	stored := make([]*T, len(puts))
+	for i, item := range puts {
+		var err error
+		if stored[i], err = copyItem(f.codec, item); err != nil {
+			return err
+		}
+	}
+	if hook != nil {
+		if err := hook(ctx, puts, deletes); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range stored {
+		f.replace(item)
+	}
+	for _, id := range deletes {
+		f.delete(id)
+	}
+
+	tx.commit()
 	return nil
 }
 
 func (f *StoreMemory[T]) Get(ctx context.Context, id string) (*T, error) {
 	// No lock needed for readers
-	current := f.head.Load()
-	for current != nil {
-		currentItem := current.item.Load()
-		if (*currentItem).GetId() == id {
+	currentItem := f.lookup(id)
+	if currentItem == nil {
+		return nil, nil
+	}
+
+	// Copy
+	return copyItem(f.codec, currentItem)
+}
+
+func (f *StoreMemory[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+	// No lock needed for readers
+	result := make([]*T, len(ids))
+	for i, id := range ids {
+		if currentItem := f.lookup(id); currentItem != nil {
 			// Copy
-			var newItem *T
-			remarshal(currentItem, &newItem)
-			return newItem, nil
+			newItem, err := copyItem(f.codec, currentItem)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = newItem
 		}
-		current = current.next.Load()
 	}
 
-	return nil, nil
+	return result, nil
 }
 
-func remarshal(in, out any) {
-	b, _ := json.Marshal(in)
-	_ = json.Unmarshal(b, &out)
+// GetBy is lock free like Get, an item changing meanwhile is returned only if
+// it still has the value
+func (f *StoreMemory[T]) GetBy(ctx context.Context, index, value string) ([]*T, error) {
+	idx, ok := f.indexes[index]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownIndex, index)
+	}
+
+	result := []*T{}
+	if value == "" {
+		return result, nil // empty keys are not indexed
+	}
+	for _, id := range idx.ids(value) {
+		currentItem := f.lookup(id)
+		if currentItem == nil || idx.key(currentItem) != value {
+			continue
+		}
+		// Copy
+		newItem, err := copyItem(f.codec, currentItem)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, newItem)
+	}
+
+	return result, nil
+}
+
+// checkUniqueItem checks the unique indexes for a single item without
+// locking, StoreCached uses it before persisting
+func (f *StoreMemory[T]) checkUniqueItem(item *T) error {
+	return f.indexes.checkUnique([]*T{item}, nil)
+}
+
+// lookup returns the stored item without copy
+func (f *StoreMemory[T]) lookup(id string) *T {
+	current := f.node(id)
+	if current == nil {
+		return nil
+	}
+	return current.item.Load()
+}
+
+// replace stores the item as is, without version checks, so it must be a
+// copy the caller does not keep. It must be called with the mutex held.
+func (f *StoreMemory[T]) replace(item *T) {
+	id := (*item).GetId()
+
+	if current := f.node(id); current != nil {
+		currentItem := current.item.Load()
+		f.indexes.reindex(id, currentItem, item)
+		current.item.Store(item)
+		f.changes.publish(ChangeUpdate, id, (*currentItem).GetVersion(), (*item).GetVersion(), item)
+		return
+	}
+
+	f.insert(item)
+	f.changes.publish(ChangeInsert, id, 0, (*item).GetVersion(), item)
 }
 
 func (f *StoreMemory[T]) Delete(ctx context.Context, id string) error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	current := f.head.Load()
-	var prev *node[T]
+	f.delete(id)
+	return nil
+}
 
-	for current != nil {
-		currentItem := current.item.Load()
-		if (*currentItem).GetId() == id {
-			// Found, remove
-			next := current.next.Load()
-			if prev == nil {
-				// Removing head
-				f.head.Store(next)
-			} else {
-				// Removing from middle/end
-				prev.next.Store(next)
-			}
-			return nil
-		}
-		prev = current
-		current = current.next.Load()
+func (f *StoreMemory[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	current := f.lookup(id)
+	if current == nil {
+		return ErrNotFound
+	}
+	if (*current).GetVersion() != version {
+		return ErrVersionGone
 	}
 
+	f.delete(id)
 	return nil
 }
+
+func (f *StoreMemory[T]) DeleteMany(ctx context.Context, ids []string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, id := range ids {
+		f.delete(id)
+	}
+	return nil
+}
+
+// delete must be called with the mutex held
+func (f *StoreMemory[T]) delete(id string) {
+	current := f.node(id)
+	if current == nil {
+		return
+	}
+
+	// Unlink, the removed node keeps its next so readers walking through it
+	// can continue
+	next := current.next.Load()
+	if current.prev == nil {
+		// Removing head
+		f.head.Store(next)
+	} else {
+		// Removing from middle/end
+		current.prev.next.Store(next)
+	}
+	if next != nil {
+		next.prev = current.prev
+	}
+	f.index.Delete(id)
+	f.indexes.reindex(id, current.item.Load(), nil)
+
+	f.changes.publish(ChangeDelete, id, (*current.item.Load()).GetVersion(), 0, nil)
+}
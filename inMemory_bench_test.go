@@ -0,0 +1,165 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+)
+
+// linkedMemory is the previous StoreMemory structure (a linked list scanned
+// on every operation), kept to compare with the hash indexed one.
+type linkedMemory[T store.Identifier] struct {
+	head  atomic.Pointer[linkedNode[T]]
+	mutex sync.Mutex
+}
+
+type linkedNode[T any] struct {
+	item atomic.Pointer[T]
+	next atomic.Pointer[linkedNode[T]]
+}
+
+func (f *linkedMemory[T]) List(ctx context.Context) ([]*T, error) {
+	var result []*T
+	for current := f.head.Load(); current != nil; current = current.next.Load() {
+		var newItem *T
+		remarshal(current.item.Load(), &newItem)
+		result = append(result, newItem)
+	}
+	return result, nil
+}
+
+func (f *linkedMemory[T]) Put(ctx context.Context, item *T) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	id := (*item).GetId()
+	version := (*item).GetVersion()
+	for current := f.head.Load(); current != nil; current = current.next.Load() {
+		if currentItem := current.item.Load(); (*currentItem).GetId() == id {
+			if (*currentItem).GetVersion() != version {
+				return store.ErrVersionGone
+			}
+			(*item).SetVersion(version + 1)
+			current.item.Store(item)
+			return nil
+		}
+	}
+
+	(*item).SetVersion(version + 1)
+	newNode := &linkedNode[T]{}
+	newNode.item.Store(item)
+	newNode.next.Store(f.head.Load())
+	f.head.Store(newNode)
+	return nil
+}
+
+func (f *linkedMemory[T]) Get(ctx context.Context, id string) (*T, error) {
+	for current := f.head.Load(); current != nil; current = current.next.Load() {
+		if currentItem := current.item.Load(); (*currentItem).GetId() == id {
+			var newItem *T
+			remarshal(currentItem, &newItem)
+			return newItem, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *linkedMemory[T]) Delete(ctx context.Context, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var prev *linkedNode[T]
+	for current := f.head.Load(); current != nil; current = current.next.Load() {
+		if (*current.item.Load()).GetId() == id {
+			if prev == nil {
+				f.head.Store(current.next.Load())
+			} else {
+				prev.next.Store(current.next.Load())
+			}
+			return nil
+		}
+		prev = current
+	}
+	return nil
+}
+
+func remarshal(in, out any) {
+	b, _ := json.Marshal(in)
+	_ = json.Unmarshal(b, &out)
+}
+
+var benchStores = []struct {
+	name string
+	new  func() store.Storer[testutils.TestItem]
+}{
+	{"linked", func() store.Storer[testutils.TestItem] { return &linkedMemory[testutils.TestItem]{} }},
+	{"hashed", func() store.Storer[testutils.TestItem] { return store.NewStoreMemory[testutils.TestItem]() }},
+}
+
+func benchFill(b *testing.B, p store.Storer[testutils.TestItem], n int) {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("item-%d", i)
+		if err := p.Put(ctx, &testutils.TestItem{Id: store.NewId(id), Title: id}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStoreMemory_Get(b *testing.B) {
+	for _, size := range []int{1_000, 10_000} {
+		for _, s := range benchStores {
+			b.Run(fmt.Sprintf("%s/%d", s.name, size), func(b *testing.B) {
+				p := s.new()
+				benchFill(b, p, size)
+				ctx := context.Background()
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := p.Get(ctx, fmt.Sprintf("item-%d", i%size)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkStoreMemory_Concurrency is the "Concurrency" scenario of
+// testutils.SuitePersistencer (put and delete from concurrent goroutines) over
+// a store that already holds many items. Run it with -race to reproduce the
+// test conditions.
+func BenchmarkStoreMemory_Concurrency(b *testing.B) {
+	for _, size := range []int{1_000, 10_000} {
+		for _, s := range benchStores {
+			b.Run(fmt.Sprintf("%s/%d", s.name, size), func(b *testing.B) {
+				p := s.new()
+				benchFill(b, p, size)
+				ctx := context.Background()
+				next := atomic.Int64{}
+
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						id := fmt.Sprintf("concurrent-%d", next.Add(1))
+						if err := p.Put(ctx, &testutils.TestItem{Id: store.NewId(id), Title: id}); err != nil {
+							b.Fatal(err)
+						}
+						if _, err := p.Get(ctx, id); err != nil {
+							b.Fatal(err)
+						}
+						if err := p.Delete(ctx, id); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			})
+		}
+	}
+}
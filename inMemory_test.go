@@ -14,3 +14,44 @@ func TestInMemory(t *testing.T) {
 	testutils.SuitePersistencer(p, t)
 	testutils.SuiteOptimisticLocking(p, t)
 }
+
+func TestInMemory_Pagination(t *testing.T) {
+	testutils.SuitePagination(store.NewStoreMemory[testutils.TestItem](), t)
+}
+
+func TestInMemory_Querier(t *testing.T) {
+	testutils.SuiteQuerier(store.NewStoreMemory[testutils.TestItem](), t)
+}
+
+func TestInMemory_Iterable(t *testing.T) {
+	testutils.SuiteIterable(store.NewStoreMemory[testutils.TestItem](), t)
+}
+
+func TestInMemory_Batch(t *testing.T) {
+	testutils.SuiteBatch(store.NewStoreMemory[testutils.TestItem](), t)
+}
+
+func TestInMemory_Transactor(t *testing.T) {
+	testutils.SuiteTransactor(store.NewStoreMemory[testutils.TestItem](), t)
+}
+
+func TestInMemory_Watcher(t *testing.T) {
+	testutils.SuiteWatcher(store.NewStoreMemory[testutils.TestItem](), t)
+}
+
+func TestInMemory_VersionDeleter(t *testing.T) {
+	testutils.SuiteVersionDeleter(store.NewStoreMemory[testutils.TestItem](), t)
+}
+
+func TestInMemory_Aliasing(t *testing.T) {
+	testutils.SuiteAliasing(store.NewStoreMemory[testutils.TestItem](), t)
+}
+
+func TestInMemory_Indexer(t *testing.T) {
+	testutils.SuiteIndexer(store.NewStoreMemory(testutils.TestItemIndexes...), t)
+}
+
+func TestInMemory_UniqueConstraints(t *testing.T) {
+	p := store.NewStoreMemory(store.UniqueIndexes[testutils.TestItem](testutils.TestItemConstraints...)...)
+	testutils.SuiteUniqueConstraints(p, t)
+}
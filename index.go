@@ -0,0 +1,223 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownIndex = errors.New("unknown index")
+var ErrUniqueViolation = errors.New("unique violation")
+
+// UniqueViolationError tells which constraint (or unique index) was violated,
+// errors.Is(err, ErrUniqueViolation) is true.
+type UniqueViolationError struct {
+	Constraint string
+	Value      string // empty if the backend does not report it
+}
+
+func (e *UniqueViolationError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("%s: constraint '%s'", ErrUniqueViolation, e.Constraint)
+	}
+	return fmt.Sprintf("%s: constraint '%s' already has '%s'", ErrUniqueViolation, e.Constraint, e.Value)
+}
+
+func (e *UniqueViolationError) Is(target error) bool {
+	return target == ErrUniqueViolation
+}
+
+// UniqueConstraint declares that no two items can have the same value in
+// Field, a dot separated path over the JSON representation of the item like
+// in Filter. Items where the field is missing, null or "" are not
+// constrained. Non string values are compared by their JSON text, like
+// postgres ->> does.
+type UniqueConstraint struct {
+	Name  string `json:"name"`
+	Field string `json:"field"`
+}
+
+// Path splits the field into its parts
+func (c UniqueConstraint) Path() []string {
+	return strings.Split(c.Field, ".")
+}
+
+// UniqueIndexes converts constraints into unique indexes for StoreMemory
+func UniqueIndexes[T Identifier](constraints ...UniqueConstraint) []Index[T] {
+	result := []Index[T]{}
+	for _, c := range constraints {
+		path := c.Path()
+		result = append(result, Index[T]{
+			Name: c.Name,
+			Key: func(item *T) string {
+				return fieldKey(normalize(item), path)
+			},
+			Unique: true,
+		})
+	}
+	return result
+}
+
+// fieldKey returns the text of a field, empty if missing or null
+func fieldKey(doc any, path []string) string {
+	value, found := lookup(doc, path)
+	if !found || value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+// Index declares a secondary index. Key extracts the indexed value from an
+// item, an empty key means the item is not indexed. If Unique is set two
+// items can not have the same key and writes breaking it fail with
+// ErrUniqueViolation.
+type Index[T Identifier] struct {
+	Name   string
+	Key    func(item *T) string
+	Unique bool
+}
+
+// IndexGetter returns the items whose key in the index is value, sorted by
+// id. It fails with ErrUnknownIndex if the index is not declared.
+type IndexGetter[T Identifier] interface {
+	GetBy(ctx context.Context, index, value string) ([]*T, error)
+}
+
+// memoryIndex keeps the ids of every key. Like StoreMemory, readers do not
+// lock: the slices of ids are never modified, writers replace them.
+type memoryIndex[T Identifier] struct {
+	Index[T]
+	entries sync.Map // key -> []string (sorted ids)
+}
+
+func (i *memoryIndex[T]) ids(key string) []string {
+	ids, ok := i.entries.Load(key)
+	if !ok {
+		return nil
+	}
+	return ids.([]string)
+}
+
+// add must be called with the store mutex held
+func (i *memoryIndex[T]) add(key, id string) {
+	if key == "" {
+		return
+	}
+	ids := i.ids(key)
+	pos, found := slices.BinarySearch(ids, id)
+	if found {
+		return
+	}
+	i.entries.Store(key, slices.Insert(slices.Clone(ids), pos, id))
+}
+
+// remove must be called with the store mutex held
+func (i *memoryIndex[T]) remove(key, id string) {
+	if key == "" {
+		return
+	}
+	ids := i.ids(key)
+	pos, found := slices.BinarySearch(ids, id)
+	if !found {
+		return
+	}
+	if len(ids) == 1 {
+		i.entries.Delete(key)
+		return
+	}
+	i.entries.Store(key, slices.Delete(slices.Clone(ids), pos, pos+1))
+}
+
+// key returns the key of item, empty for nil
+func (i *memoryIndex[T]) key(item *T) string {
+	if item == nil {
+		return ""
+	}
+	return i.Key(item)
+}
+
+// indexSet are the indexes of a store by name. The set itself is not
+// modified after it is created.
+type indexSet[T Identifier] map[string]*memoryIndex[T]
+
+func newIndexSet[T Identifier](indexes []Index[T]) indexSet[T] {
+	result := indexSet[T]{}
+	for _, index := range indexes {
+		result[index.Name] = &memoryIndex[T]{Index: index}
+	}
+	return result
+}
+
+// reindex moves id from the keys of old to the keys of new, nil old means
+// inserted and nil new deleted. It must be called with the store mutex held.
+func (s indexSet[T]) reindex(id string, old, new *T) {
+	for _, index := range s {
+		oldKey, newKey := index.key(old), index.key(new)
+		if oldKey == newKey {
+			continue
+		}
+		index.add(newKey, id)
+		index.remove(oldKey, id)
+	}
+}
+
+// checkUnique checks the unique indexes as if puts were stored and deletes
+// removed. It must be called with the store mutex held.
+func (s indexSet[T]) checkUnique(puts []*T, deletes []string) error {
+	return s.checkUniqueFunc(puts, deletes, nil)
+}
+
+// checkUniqueFunc is checkUnique where holds, if not nil, confirms that an id
+// found in the index still has the key. It allows StoreDisk to not trust an
+// index that other processes could have made stale.
+func (s indexSet[T]) checkUniqueFunc(puts []*T, deletes []string, holds func(index *memoryIndex[T], id, key string) bool) error {
+	touched := map[string]bool{}
+	for _, item := range puts {
+		touched[(*item).GetId()] = true
+	}
+	for _, id := range deletes {
+		touched[id] = true
+	}
+
+	for _, index := range s {
+		if !index.Unique {
+			continue
+		}
+		claimed := map[string]string{} // key -> id, within puts
+		for _, item := range puts {
+			id := (*item).GetId()
+			key := index.key(item)
+			if key == "" {
+				continue
+			}
+			if other, ok := claimed[key]; ok && other != id {
+				return uniqueViolation(index.Name, key)
+			}
+			claimed[key] = id
+			for _, other := range index.ids(key) {
+				// touched ids are checked with their new keys
+				if other == id || touched[other] {
+					continue
+				}
+				if holds != nil && !holds(index, other, key) {
+					continue
+				}
+				return uniqueViolation(index.Name, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func uniqueViolation(constraint, value string) error {
+	return &UniqueViolationError{Constraint: constraint, Value: value}
+}
@@ -3,6 +3,7 @@ package store
 import (
 	"context"
 	"errors"
+	"fmt"
 )
 
 type Identifier interface {
@@ -12,10 +13,44 @@ type Identifier interface {
 }
 
 var ErrVersionGone = errors.New("version gone")
+var ErrNotFound = errors.New("not found")
+var ErrAlreadyExists = errors.New("already exists")
+var ErrUnavailable = errors.New("unavailable")
 
+// Storer is implemented by every store. Get returns nil without error if id
+// is not stored (see GetExisting), ErrNotFound is only returned by the
+// operations that need the item to exist (e.g. Update or DeleteVersion).
 type Storer[T Identifier] interface {
 	List(ctx context.Context) ([]*T, error)
 	Put(ctx context.Context, item *T) error
 	Get(ctx context.Context, id string) (*T, error)
 	Delete(ctx context.Context, id string) error
 }
+
+// VersionDeleter deletes an item only if it is still at the given version,
+// otherwise it returns ErrVersionGone (or ErrNotFound if it does not exist).
+type VersionDeleter[T Identifier] interface {
+	DeleteVersion(ctx context.Context, id string, version int64) error
+}
+
+// GetExisting gets the item id from s, failing with ErrNotFound if it is not
+// stored
+func GetExisting[T Identifier](ctx context.Context, s Storer[T], id string) (*T, error) {
+	item, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return item, nil
+}
+
+// Unavailable wraps err (if not nil) so errors.Is(err, ErrUnavailable) is true
+// while keeping the original error in the chain.
+func Unavailable(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
@@ -0,0 +1,28 @@
+package store
+
+import (
+	"context"
+	"iter"
+)
+
+// Iterable streams all the items of a store without materializing the whole
+// collection. Breaking the loop releases any underlying resource (cursors,
+// rows, connections...). An error is yielded at most once, as the last element.
+type Iterable[T Identifier] interface {
+	Iterate(ctx context.Context) iter.Seq2[*T, error]
+}
+
+// IterateItems adapts an already materialized list of items
+func IterateItems[T Identifier](items []*T, err error) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		for _, item := range items {
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SortField orders results by a dot separated JSON path (same as Filter).
+// Results are always tie-broken by id ascending so order is deterministic.
+//
+// Values are ordered by type first: missing or null, numbers, strings, and
+// then anything else. Numbers are compared numerically and strings in byte
+// order. Objects, arrays and booleans are not compared with each other.
+type SortField struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc,omitempty"`
+}
+
+func Asc(field string) SortField {
+	return SortField{Field: field}
+}
+
+func Desc(field string) SortField {
+	return SortField{Field: field, Desc: true}
+}
+
+// Path splits the field into its parts
+func (s SortField) Path() []string {
+	return strings.Split(s.Field, ".")
+}
+
+func ValidateSort(fields []SortField) error {
+	for _, field := range fields {
+		if field.Field == "" {
+			return fmt.Errorf("%w: sort requires a field", ErrInvalidFilter)
+		}
+	}
+	return nil
+}
+
+// SortItems sorts items in place following the sort specification, it is
+// used by stores without native sorting.
+func SortItems[T Identifier](items []*T, fields []SortField) error {
+	if err := ValidateSort(fields); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	type entry struct {
+		item *T
+		keys []any
+	}
+
+	entries := make([]entry, len(items))
+	for i, item := range items {
+		doc := normalize(item)
+		keys := make([]any, len(fields))
+		for j, field := range fields {
+			keys[j], _ = lookup(doc, field.Path())
+		}
+		entries[i] = entry{item: item, keys: keys}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		for k, field := range fields {
+			c := compareSort(entries[i].keys[k], entries[j].keys[k])
+			if c == 0 {
+				continue
+			}
+			if field.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return (*entries[i].item).GetId() < (*entries[j].item).GetId()
+	})
+
+	for i := range entries {
+		items[i] = entries[i].item
+	}
+
+	return nil
+}
+
+// SortBucket returns the relative position of the type of a JSON value when
+// sorting, it is shared by all backends so types are ordered the same way.
+func SortBucket(value any) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case float64:
+		return 1
+	case string:
+		return 2
+	case map[string]any:
+		return 3
+	case []any:
+		return 4
+	case bool:
+		return 5
+	}
+	return 6
+}
+
+func compareSort(a, b any) int {
+	ba, bb := SortBucket(a), SortBucket(b)
+	if ba != bb {
+		return ba - bb
+	}
+	c, _ := compare(a, b)
+	return c
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sort"
+)
+
+// DefaultPageLimit is used when PageRequest.Limit is zero or negative.
+const DefaultPageLimit = 100
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type PageRequest struct {
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"` // opaque, as returned in Page.NextCursor
+}
+
+type Page[T Identifier] struct {
+	Items      []*T   `json:"items"`
+	NextCursor string `json:"next_cursor"` // empty when there are no more items
+}
+
+// Pager lists the items in pages ordered by id, to list them in another order
+// see Querier.
+type Pager[T Identifier] interface {
+	ListPage(ctx context.Context, req PageRequest) (*Page[T], error)
+}
+
+// GetLimit returns the requested limit or DefaultPageLimit if not set.
+func (r PageRequest) GetLimit() int {
+	if r.Limit <= 0 {
+		return DefaultPageLimit
+	}
+	return r.Limit
+}
+
+// EncodeCursor wraps a backend specific position into an opaque cursor.
+func EncodeCursor(position string) string {
+	if position == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// DecodeCursor is the inverse of EncodeCursor, an empty cursor means start.
+func DecodeCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	return string(b), nil
+}
+
+// PageItems paginates an already materialized list of items using keyset
+// pagination on id. It is useful for stores that cannot paginate natively.
+func PageItems[T Identifier](items []*T, req PageRequest) (*Page[T], error) {
+	after, err := DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*T, 0, len(items))
+	for _, item := range items {
+		if req.Cursor != "" && (*item).GetId() <= after {
+			continue
+		}
+		sorted = append(sorted, item)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return (*sorted[i]).GetId() < (*sorted[j]).GetId()
+	})
+
+	return NewPage(sorted, req.GetLimit()), nil
+}
+
+// NewPage builds a page from up to limit+1 items sorted by id, the extra item
+// is only used to know if there is a next page.
+func NewPage[T Identifier](items []*T, limit int) *Page[T] {
+	page := &Page[T]{
+		Items: items,
+	}
+	if len(items) > limit {
+		page.Items = items[:limit]
+		page.NextCursor = EncodeCursor((*page.Items[limit-1]).GetId())
+	}
+	if page.Items == nil {
+		page.Items = []*T{}
+	}
+	return page
+}
@@ -0,0 +1,18 @@
+package store
+
+import (
+	"context"
+	"iter"
+)
+
+// RangeScanner streams items in id order (byte order) by ranges of ids,
+// without materializing them. Like Iterable, breaking the loop releases any
+// underlying resource and an error is yielded at most once, as the last
+// element.
+//
+// ScanRange yields the items with from <= id < to, an empty to means no upper
+// bound. ScanPrefix yields the items whose id starts with prefix.
+type RangeScanner[T Identifier] interface {
+	ScanRange(ctx context.Context, from, to string) iter.Seq2[*T, error]
+	ScanPrefix(ctx context.Context, prefix string) iter.Seq2[*T, error]
+}
@@ -0,0 +1,654 @@
+package storebadger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/holacloud/store"
+)
+
+// StoreBadger keeps the items in a badger database (an LSM tree) keyed by id,
+// so they are ordered by id (byte order). Every value is the version (8 bytes,
+// big endian) followed by the encoded item. Writes are serialized by id with
+// in-process locks, the database directory can only be used by one store.
+type StoreBadger[T store.Identifier] struct {
+	db         *badger.DB
+	codec      store.Codec
+	durability Durability
+	locks      *keyLocks
+	closed     chan struct{}
+	closeOnce  sync.Once
+	stopSync   chan struct{} // stops the syncLoop running, if any
+	syncer     sync.WaitGroup
+}
+
+// Durability is when the writes reach the disk, see SetDurability
+type Durability int
+
+const (
+	DurabilitySync     Durability = iota // every write waits for the disk
+	DurabilityInterval                   // synced in the background periodically
+	DurabilityNone                       // left to badger and the operating system
+)
+
+// New opens or creates the database in dir. It must be closed to release dir,
+// opening a dir in use fails with store.ErrLocked.
+func New[T store.Identifier](dir string) (*StoreBadger[T], error) {
+
+	options := badger.DefaultOptions(dir).
+		WithLogger(nil).
+		WithSyncWrites(false) // see synced
+	db, err := badger.Open(options)
+	if err != nil {
+		// badger does not wrap the error of its directory lock
+		if strings.Contains(err.Error(), "Cannot acquire directory lock") {
+			return nil, fmt.Errorf("opening '%s': %w", dir, store.ErrLocked)
+		}
+		return nil, fmt.Errorf("opening '%s': %w", dir, err)
+	}
+
+	return &StoreBadger[T]{
+		db:         db,
+		codec:      store.JSONCodec{},
+		durability: DurabilitySync,
+		locks:      newKeyLocks(),
+		closed:     make(chan struct{}),
+	}, nil
+}
+
+// SetCodec changes how items are encoded. It must be called before the store
+// is used.
+func (f *StoreBadger[T]) SetCodec(codec store.Codec) {
+	f.codec = codec
+}
+
+// SetDurability changes when the writes reach the disk (DurabilitySync by
+// default). With DurabilityInterval the database is synced every interval in
+// the background, so a crash of the machine can lose the writes of the last
+// interval. With DurabilityNone writes survive a crash of the process but not
+// of the machine. It must be called before the store is used, calling it again
+// stops the background sync of the previous durability.
+func (f *StoreBadger[T]) SetDurability(durability Durability, interval time.Duration) error {
+	switch durability {
+	case DurabilitySync, DurabilityNone:
+	case DurabilityInterval:
+		if interval <= 0 {
+			return fmt.Errorf("sync interval must be positive, got %s", interval)
+		}
+	default:
+		return fmt.Errorf("unknown durability %d", durability)
+	}
+
+	if f.stopSync != nil {
+		close(f.stopSync)
+		f.stopSync = nil
+	}
+	if durability == DurabilityInterval {
+		f.stopSync = make(chan struct{})
+		f.syncer.Add(1)
+		go f.syncLoop(interval, f.stopSync)
+	}
+	f.durability = durability
+	return nil
+}
+
+func (f *StoreBadger[T]) syncLoop(interval time.Duration, stop chan struct{}) {
+	defer f.syncer.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.closed:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+			_ = f.db.Sync() // retried on the next tick, Close syncs anyway
+		}
+	}
+}
+
+// Close stops syncing in the background and closes the database, closing it
+// again does nothing
+func (f *StoreBadger[T]) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+	})
+	f.syncer.Wait()
+	return f.db.Close()
+}
+
+// synced waits for the writes to reach the disk if the durability requires it
+func (f *StoreBadger[T]) synced() error {
+	if f.durability != DurabilitySync {
+		return nil
+	}
+	return f.db.Sync()
+}
+
+// update applies fn in a write transaction. fn does not read, so badger has
+// no conflicts to detect: versions are checked with the ids locked.
+func (f *StoreBadger[T]) update(fn func(txn *badger.Txn) error) error {
+	if err := f.db.Update(fn); err != nil {
+		return err
+	}
+	return f.synced()
+}
+
+// encode returns the value of item at version
+func (f *StoreBadger[T]) encode(item *T, version int64) ([]byte, error) {
+	current := (*item).GetVersion()
+	(*item).SetVersion(version)
+	data, err := f.codec.Marshal(item)
+	(*item).SetVersion(current) // restore until it is stored
+	if err != nil {
+		return nil, err
+	}
+
+	value := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(data)), uint64(version))
+	return append(value, data...), nil
+}
+
+// decode returns the item of an entry of the database
+func (f *StoreBadger[T]) decode(entry *badger.Item) (*T, error) {
+	var item *T
+	err := entry.Value(func(value []byte) error {
+		if len(value) < 8 {
+			return errors.New("corrupted value")
+		}
+		if err := f.codec.Unmarshal(value[8:], &item); err != nil {
+			return err
+		}
+		(*item).SetVersion(int64(binary.BigEndian.Uint64(value)))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("item '%s': %w", entry.Key(), err)
+	}
+	return item, nil
+}
+
+func (f *StoreBadger[T]) get(txn *badger.Txn, id string) (*T, error) {
+	entry, err := txn.Get([]byte(id))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.decode(entry)
+}
+
+// version returns the current version of id, found is false if it is missing
+func (f *StoreBadger[T]) version(txn *badger.Txn, id string) (version int64, found bool, err error) {
+	entry, err := txn.Get([]byte(id))
+	if err == badger.ErrKeyNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	err = entry.Value(func(value []byte) error {
+		if len(value) < 8 {
+			return fmt.Errorf("item '%s': corrupted value", id)
+		}
+		version = int64(binary.BigEndian.Uint64(value))
+		return nil
+	})
+	return version, true, err
+}
+
+// currentVersion is version in its own read transaction
+func (f *StoreBadger[T]) currentVersion(id string) (version int64, found bool, err error) {
+	err = f.db.View(func(txn *badger.Txn) error {
+		version, found, err = f.version(txn, id)
+		return err
+	})
+	return
+}
+
+// List reads the items with Iterate
+func (f *StoreBadger[T]) List(ctx context.Context) ([]*T, error) {
+
+	result := []*T{}
+	for item, err := range f.Iterate(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+// Find streams the items keeping only the ones matching filter
+func (f *StoreBadger[T]) Find(ctx context.Context, filter store.Filter, sort ...store.SortField) ([]*T, error) {
+
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := store.ValidateSort(sort); err != nil {
+		return nil, err
+	}
+
+	result := []*T{}
+	for item, err := range f.Iterate(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if !filter.IsEmpty() {
+			matches, err := store.Match(item, filter)
+			if err != nil {
+				return nil, err
+			}
+			if !matches {
+				continue
+			}
+		}
+		result = append(result, item)
+	}
+
+	return result, store.SortItems(result, sort)
+}
+
+// Iterate streams the items in id order from a snapshot of the database,
+// writes are not blocked meanwhile
+func (f *StoreBadger[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return f.scan(ctx, nil, nil)
+}
+
+func (f *StoreBadger[T]) ScanRange(ctx context.Context, from, to string) iter.Seq2[*T, error] {
+	return f.scan(ctx, []byte(from), func(k []byte) bool {
+		return to == "" || bytes.Compare(k, []byte(to)) < 0
+	})
+}
+
+func (f *StoreBadger[T]) ScanPrefix(ctx context.Context, prefix string) iter.Seq2[*T, error] {
+	return f.scan(ctx, []byte(prefix), func(k []byte) bool {
+		return bytes.HasPrefix(k, []byte(prefix))
+	})
+}
+
+// scan yields the items from the key from (inclusive) while inRange (if not
+// nil) holds
+func (f *StoreBadger[T]) scan(ctx context.Context, from []byte, inRange func(k []byte) bool) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+
+		txn := f.db.NewTransaction(false)
+		defer txn.Discard()
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(from); it.Valid(); it.Next() {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			if inRange != nil && !inRange(it.Item().Key()) {
+				return
+			}
+
+			item, err := f.decode(it.Item())
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(item, nil) {
+				return
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+func (f *StoreBadger[T]) ListPage(ctx context.Context, req store.PageRequest) (*store.Page[T], error) {
+
+	after, err := store.DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := req.GetLimit()
+	result := []*T{}
+	err = f.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		it.Seek([]byte(after))
+		if req.Cursor != "" && it.Valid() && string(it.Item().Key()) == after {
+			it.Next()
+		}
+		for ; it.Valid() && len(result) <= limit; it.Next() {
+			item, err := f.decode(it.Item())
+			if err != nil {
+				return err
+			}
+			result = append(result, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store.NewPage(result, limit), nil
+}
+
+func (f *StoreBadger[T]) Put(ctx context.Context, item *T) error {
+
+	id := (*item).GetId()
+	version := (*item).GetVersion()
+	value, err := f.encode(item, version+1)
+	if err != nil {
+		return err
+	}
+
+	unlock := f.locks.lock(id)
+	defer unlock()
+
+	current, found, err := f.currentVersion(id)
+	if err != nil {
+		return err
+	}
+	if found && current != version {
+		return store.ErrVersionGone
+	}
+
+	err = f.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(id), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	(*item).SetVersion(version + 1)
+
+	return nil
+}
+
+func (f *StoreBadger[T]) Create(ctx context.Context, item *T) error {
+
+	id := (*item).GetId()
+	value, err := f.encode(item, 1)
+	if err != nil {
+		return err
+	}
+
+	unlock := f.locks.lock(id)
+	defer unlock()
+
+	_, found, err := f.currentVersion(id)
+	if err != nil {
+		return err
+	}
+	if found {
+		return store.ErrAlreadyExists
+	}
+
+	err = f.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(id), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	(*item).SetVersion(1)
+
+	return nil
+}
+
+func (f *StoreBadger[T]) Update(ctx context.Context, item *T) error {
+
+	id := (*item).GetId()
+	version := (*item).GetVersion()
+	value, err := f.encode(item, version+1)
+	if err != nil {
+		return err
+	}
+
+	unlock := f.locks.lock(id)
+	defer unlock()
+
+	current, found, err := f.currentVersion(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return store.ErrNotFound
+	}
+	if current != version {
+		return store.ErrVersionGone
+	}
+
+	err = f.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(id), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	(*item).SetVersion(version + 1)
+
+	return nil
+}
+
+// PutMany writes all the stored items with a single write batch, that is not
+// atomic: if it fails some of the items may have been written
+func (f *StoreBadger[T]) PutMany(ctx context.Context, items []*T) error {
+
+	errs := store.DuplicatedIds(items)
+
+	values := make([][]byte, len(items))
+	ids := []string{}
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+		values[i], errs[i] = f.encode(item, (*item).GetVersion()+1)
+		ids = append(ids, (*item).GetId())
+	}
+
+	unlock := f.locks.lock(ids...)
+	defer unlock()
+
+	err := f.db.View(func(txn *badger.Txn) error {
+		for i, item := range items {
+			if errs[i] != nil {
+				continue
+			}
+			current, found, err := f.version(txn, (*item).GetId())
+			if err != nil {
+				return err
+			}
+			if found && current != (*item).GetVersion() {
+				errs[i] = store.ErrVersionGone
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := f.db.NewWriteBatch()
+	defer batch.Cancel()
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+		if err := batch.Set([]byte((*item).GetId()), values[i]); err != nil {
+			return err
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+	if err := f.synced(); err != nil {
+		return err
+	}
+
+	for i, item := range items {
+		if errs[i] == nil {
+			(*item).SetVersion((*item).GetVersion() + 1)
+		}
+	}
+
+	return store.NewBatchError(errs)
+}
+
+func (f *StoreBadger[T]) Get(ctx context.Context, id string) (*T, error) {
+
+	var item *T
+	err := f.db.View(func(txn *badger.Txn) (err error) {
+		item, err = f.get(txn, id)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (f *StoreBadger[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+
+	result := make([]*T, len(ids))
+	err := f.db.View(func(txn *badger.Txn) error {
+		for i, id := range ids {
+			item, err := f.get(txn, id)
+			if err != nil {
+				return err
+			}
+			result[i] = item
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (f *StoreBadger[T]) Delete(ctx context.Context, id string) error {
+
+	unlock := f.locks.lock(id)
+	defer unlock()
+
+	return f.update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(id))
+	})
+}
+
+func (f *StoreBadger[T]) DeleteMany(ctx context.Context, ids []string) error {
+
+	unlock := f.locks.lock(ids...)
+	defer unlock()
+
+	batch := f.db.NewWriteBatch()
+	defer batch.Cancel()
+	for _, id := range ids {
+		if err := batch.Delete([]byte(id)); err != nil {
+			return err
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+
+	return f.synced()
+}
+
+func (f *StoreBadger[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+
+	unlock := f.locks.lock(id)
+	defer unlock()
+
+	current, found, err := f.currentVersion(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return store.ErrNotFound
+	}
+	if current != version {
+		return store.ErrVersionGone
+	}
+
+	return f.update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(id))
+	})
+}
+
+// WithTx stages the writes of fn (see store.Stage) and applies them in a
+// single badger transaction, after checking with the ids locked that none of
+// them has changed since fn read them. Transactions too big for badger fail
+// with badger.ErrTxnTooBig.
+func (f *StoreBadger[T]) WithTx(ctx context.Context, fn func(tx store.Storer[T]) error) error {
+
+	staged, err := store.Stage[T](f, f.codec, fn)
+	if err != nil {
+		return err
+	}
+
+	puts, deletes := staged.Writes()
+	values := make([][]byte, len(puts))
+	for i, item := range puts {
+		values[i], err = f.encode(item, (*item).GetVersion())
+		if err != nil {
+			return err
+		}
+	}
+
+	unlock := f.locks.lock(staged.Ids()...)
+	defer unlock()
+
+	err = f.db.View(func(txn *badger.Txn) error {
+		for _, id := range staged.Ids() {
+			current, err := f.get(txn, id)
+			if err != nil {
+				return err
+			}
+			if staged.Changed(id, current) {
+				return store.ErrVersionGone
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = f.update(func(txn *badger.Txn) error {
+		for i, item := range puts {
+			if err := txn.Set([]byte((*item).GetId()), values[i]); err != nil {
+				return err
+			}
+		}
+		for _, id := range deletes {
+			if err := txn.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	staged.Committed()
+	return nil
+}
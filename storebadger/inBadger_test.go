@@ -0,0 +1,221 @@
+package storebadger
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+)
+
+func TestInBadger(t *testing.T) {
+
+	p, err := New[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+	defer p.Close()
+
+	testutils.SuitePersistencer(p, t)
+	testutils.SuiteOptimisticLocking(p, t)
+
+	t.Run("Pagination", func(t *testing.T) {
+		p, err := New[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuitePagination(p, t)
+	})
+
+	t.Run("Querier", func(t *testing.T) {
+		p, err := New[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteQuerier(p, t)
+	})
+
+	t.Run("Iterable", func(t *testing.T) {
+		p, err := New[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteIterable(p, t)
+	})
+
+	t.Run("RangeScanner", func(t *testing.T) {
+		p, err := New[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteRangeScanner(p, t)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		p, err := New[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteBatch(p, t)
+	})
+
+	t.Run("Transactor", func(t *testing.T) {
+		p, err := New[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteTransactor(p, t)
+	})
+
+	t.Run("VersionDeleter", func(t *testing.T) {
+		p, err := New[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteVersionDeleter(p, t)
+	})
+
+	t.Run("Aliasing", func(t *testing.T) {
+		p, err := New[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteAliasing(p, t)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		records, err := New[store.EncryptedRecord](t.TempDir())
+		biff.AssertNil(err)
+		defer records.Close()
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p := store.NewEncryptedStore[testutils.TestItem](records, keyring)
+		testutils.SuitePersistencer(p, t)
+	})
+
+	t.Run("FieldEncrypted", func(t *testing.T) {
+		raw, err := New[testutils.SecretItem](t.TempDir())
+		biff.AssertNil(err)
+		defer raw.Close()
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p, err := store.NewFieldEncryptedStore[testutils.SecretItem](raw, keyring)
+		biff.AssertNil(err)
+		testutils.SuiteFieldEncryption(p, raw, t)
+	})
+
+	t.Run("DurabilityInterval", func(t *testing.T) {
+		p, err := New[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		defer p.Close()
+		biff.AssertNil(p.SetDurability(DurabilityInterval, 10*time.Millisecond))
+		testutils.SuiteBatch(p, t)
+	})
+
+	t.Run("DurabilityNone", func(t *testing.T) {
+		p, err := New[testutils.TestItem](t.TempDir())
+		biff.AssertNil(err)
+		defer p.Close()
+		biff.AssertNil(p.SetDurability(DurabilityNone, 0))
+		testutils.SuiteBatch(p, t)
+	})
+}
+
+func TestInBadger_Reopen(t *testing.T) {
+
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	p, err := New[testutils.TestItem](dir)
+	biff.AssertNil(err)
+	biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("my-id"), Title: "persisted"}))
+
+	t.Run("Locked", func(t *testing.T) {
+		_, err := New[testutils.TestItem](dir)
+		biff.AssertTrue(errors.Is(err, store.ErrLocked))
+	})
+
+	biff.AssertNil(p.Close())
+
+	p, err = New[testutils.TestItem](dir)
+	biff.AssertNil(err)
+	defer p.Close()
+
+	item, err := p.Get(ctx, "my-id")
+	biff.AssertNil(err)
+	biff.AssertEqual(item.Title, "persisted")
+	biff.AssertEqual(item.GetVersion(), int64(1))
+}
+
+func TestInBadger_DurabilityInvalid(t *testing.T) {
+
+	p, err := New[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+	defer p.Close()
+
+	biff.AssertNotNil(p.SetDurability(DurabilityInterval, 0))
+	biff.AssertNotNil(p.SetDurability(Durability(42), time.Second))
+}
+
+func TestInBadger_DurabilityChanged(t *testing.T) {
+
+	p, err := New[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+	defer p.Close()
+
+	biff.AssertNil(p.SetDurability(DurabilityInterval, 10*time.Millisecond))
+	biff.AssertNil(p.SetDurability(DurabilityInterval, 20*time.Millisecond))
+	biff.AssertNil(p.SetDurability(DurabilitySync, 0))
+
+	// No background sync is left running
+	p.syncer.Wait()
+}
+
+func TestInBadger_CloseTwice(t *testing.T) {
+
+	p, err := New[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+	biff.AssertNil(p.SetDurability(DurabilityInterval, 10*time.Millisecond))
+
+	biff.AssertNil(p.Close())
+	biff.AssertNil(p.Close())
+}
+
+func TestInBadger_ConcurrentPut(t *testing.T) {
+
+	p, err := New[testutils.TestItem](t.TempDir())
+	biff.AssertNil(err)
+	defer p.Close()
+	biff.AssertNil(p.SetDurability(DurabilityNone, 0))
+
+	ctx := context.Background()
+	biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("counter")}))
+
+	// Every increment retries on conflict, none of them can be lost
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				item, err := p.Get(ctx, "counter")
+				if err != nil {
+					errs <- err
+					return
+				}
+				item.Counter++
+				err = p.Put(ctx, item)
+				if errors.Is(err, store.ErrVersionGone) {
+					continue
+				}
+				errs <- err
+				return
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		biff.AssertNil(err)
+	}
+
+	item, err := p.Get(ctx, "counter")
+	biff.AssertNil(err)
+	biff.AssertEqual(item.Counter, 50)
+	biff.AssertEqual(item.GetVersion(), int64(51))
+}
@@ -0,0 +1,61 @@
+package storebadger
+
+import (
+	"slices"
+	"sync"
+)
+
+// keyLocks serializes the writes of every id, the lock of an id only exists
+// while somebody holds it or waits for it
+type keyLocks struct {
+	mutex sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{
+		locks: map[string]*keyLock{},
+	}
+}
+
+// lock takes the locks of ids in order, so two callers locking overlapping
+// ids can not deadlock. Repeated ids are locked once.
+func (l *keyLocks) lock(ids ...string) (unlock func()) {
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	locks := make([]*keyLock, len(ids))
+	l.mutex.Lock()
+	for i, id := range ids {
+		lock, ok := l.locks[id]
+		if !ok {
+			lock = &keyLock{}
+			l.locks[id] = lock
+		}
+		lock.refs++
+		locks[i] = lock
+	}
+	l.mutex.Unlock()
+
+	for _, lock := range locks {
+		lock.Lock()
+	}
+
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		for i, lock := range locks {
+			lock.Unlock()
+			lock.refs--
+			if lock.refs == 0 {
+				delete(l.locks, ids[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package storebolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"time"
+
+	"github.com/holacloud/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+// StoreBolt keeps the items of a collection in a bucket of a bolt database,
+// keyed by id so they are ordered by id (byte order). Every value is the
+// version (8 bytes, big endian) followed by the encoded item.
+type StoreBolt[T store.Identifier] struct {
+	db       *bolt.DB
+	bucket   []byte
+	codec    store.Codec
+	tx       *bolt.Tx  // not nil inside WithTx
+	restores *[]func() // inside WithTx, restore the versions of the items written
+}
+
+// scanChunk is the number of items read by every read transaction of Iterate
+// and the scans, so a loop in progress never keeps a transaction open
+const scanChunk = 100
+
+// Open opens (or creates) a bolt database file to be shared by the stores of
+// its collections (see New). Only one process can have the file open, others
+// fail with store.ErrLocked after waiting for a second.
+func Open(filename string) (*bolt.DB, error) {
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %s", store.ErrLocked, filename)
+	}
+	return db, err
+}
+
+// New ensures the bucket of the collection. Closing db is up to the caller.
+func New[T store.Identifier](db *bolt.DB, collection string) (*StoreBolt[T], error) {
+
+	bucket := []byte(collection)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ensure bucket '%s': %w", collection, err)
+	}
+
+	return &StoreBolt[T]{
+		db:     db,
+		bucket: bucket,
+		codec:  store.JSONCodec{},
+	}, nil
+}
+
+// SetCodec changes how items are encoded. It must be called before the store
+// is used.
+func (f *StoreBolt[T]) SetCodec(codec store.Codec) {
+	f.codec = codec
+}
+
+// encode returns the value of item at version
+func (f *StoreBolt[T]) encode(item *T, version int64) ([]byte, error) {
+	current := (*item).GetVersion()
+	(*item).SetVersion(version)
+	data, err := f.codec.Marshal(item)
+	(*item).SetVersion(current) // restore until it is stored
+	if err != nil {
+		return nil, err
+	}
+
+	value := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(data)), uint64(version))
+	return append(value, data...), nil
+}
+
+// decode returns the item of a value, value is only valid during the bolt
+// transaction so nothing of it is kept
+func (f *StoreBolt[T]) decode(value []byte) (*T, error) {
+	if len(value) < 8 {
+		return nil, errors.New("corrupted value")
+	}
+
+	var item *T
+	if err := f.codec.Unmarshal(value[8:], &item); err != nil {
+		return nil, err
+	}
+	(*item).SetVersion(valueVersion(value))
+
+	return item, nil
+}
+
+// valueVersion returns the version of a value, 0 if it is missing
+func valueVersion(value []byte) int64 {
+	if len(value) < 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+// view runs fn in a read transaction, or in the one of WithTx
+func (f *StoreBolt[T]) view(fn func(tx *bolt.Tx) error) error {
+	if f.tx != nil {
+		return fn(f.tx)
+	}
+	return f.db.View(fn)
+}
+
+// update runs fn in a read-write transaction, or in the one of WithTx
+func (f *StoreBolt[T]) update(fn func(tx *bolt.Tx) error) error {
+	if f.tx != nil {
+		return fn(f.tx)
+	}
+	return f.db.Update(fn)
+}
+
+func (f *StoreBolt[T]) get(tx *bolt.Tx, id string) (*T, error) {
+	value := tx.Bucket(f.bucket).Get([]byte(id))
+	if value == nil {
+		return nil, nil
+	}
+	return f.decode(value)
+}
+
+func (f *StoreBolt[T]) List(ctx context.Context) ([]*T, error) {
+
+	result := []*T{}
+	err := f.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(f.bucket).ForEach(func(k, v []byte) error {
+			item, err := f.decode(v)
+			if err != nil {
+				return fmt.Errorf("item '%s': %w", k, err)
+			}
+			result = append(result, item)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (f *StoreBolt[T]) Find(ctx context.Context, filter store.Filter, sort ...store.SortField) ([]*T, error) {
+
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := store.ValidateSort(sort); err != nil {
+		return nil, err
+	}
+
+	items, err := f.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err = store.FilterItems(items, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, store.SortItems(items, sort)
+}
+
+func (f *StoreBolt[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return f.scan(ctx, nil, nil)
+}
+
+func (f *StoreBolt[T]) ScanRange(ctx context.Context, from, to string) iter.Seq2[*T, error] {
+	return f.scan(ctx, []byte(from), func(k []byte) bool {
+		return to == "" || bytes.Compare(k, []byte(to)) < 0
+	})
+}
+
+func (f *StoreBolt[T]) ScanPrefix(ctx context.Context, prefix string) iter.Seq2[*T, error] {
+	return f.scan(ctx, []byte(prefix), func(k []byte) bool {
+		return bytes.HasPrefix(k, []byte(prefix))
+	})
+}
+
+// scan yields the items from the key from (inclusive) while inRange (if not
+// nil) holds, reading them in chunks (see scanChunk)
+func (f *StoreBolt[T]) scan(ctx context.Context, from []byte, inRange func(k []byte) bool) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+
+		next := from
+		skip := false // next was already yielded
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+
+			items := make([]*T, 0, scanChunk)
+			done := false
+			err := f.view(func(tx *bolt.Tx) error {
+				c := tx.Bucket(f.bucket).Cursor()
+				k, v := c.Seek(next)
+				if skip && bytes.Equal(k, next) {
+					k, v = c.Next()
+				}
+				for ; len(items) < scanChunk; k, v = c.Next() {
+					if k == nil || inRange != nil && !inRange(k) {
+						done = true
+						return nil
+					}
+					item, err := f.decode(v)
+					if err != nil {
+						return fmt.Errorf("item '%s': %w", k, err)
+					}
+					items = append(items, item)
+					next = append([]byte{}, k...)
+				}
+				return nil
+			})
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			skip = true
+
+			for _, item := range items {
+				if !yield(item, nil) {
+					return
+				}
+			}
+			if done {
+				return
+			}
+		}
+	}
+}
+
+func (f *StoreBolt[T]) ListPage(ctx context.Context, req store.PageRequest) (*store.Page[T], error) {
+
+	after, err := store.DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := req.GetLimit()
+	result := []*T{}
+	err = f.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(f.bucket).Cursor()
+		k, v := c.Seek([]byte(after))
+		if req.Cursor != "" && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(result) <= limit; k, v = c.Next() {
+			item, err := f.decode(v)
+			if err != nil {
+				return fmt.Errorf("item '%s': %w", k, err)
+			}
+			result = append(result, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store.NewPage(result, limit), nil
+}
+
+func (f *StoreBolt[T]) Put(ctx context.Context, item *T) error {
+
+	version := (*item).GetVersion()
+	value, err := f.encode(item, version+1)
+	if err != nil {
+		return err
+	}
+
+	err = f.update(func(tx *bolt.Tx) error {
+		return f.put(tx, (*item).GetId(), version, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	f.stored(item, version+1)
+
+	return nil
+}
+
+// put stores value if id is missing or still at version
+func (f *StoreBolt[T]) put(tx *bolt.Tx, id string, version int64, value []byte) error {
+	b := tx.Bucket(f.bucket)
+	if current := b.Get([]byte(id)); current != nil && valueVersion(current) != version {
+		return store.ErrVersionGone
+	}
+	return b.Put([]byte(id), value)
+}
+
+func (f *StoreBolt[T]) Create(ctx context.Context, item *T) error {
+
+	value, err := f.encode(item, 1)
+	if err != nil {
+		return err
+	}
+
+	err = f.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(f.bucket)
+		if b.Get([]byte((*item).GetId())) != nil {
+			return store.ErrAlreadyExists
+		}
+		return b.Put([]byte((*item).GetId()), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	f.stored(item, 1)
+
+	return nil
+}
+
+func (f *StoreBolt[T]) Update(ctx context.Context, item *T) error {
+
+	version := (*item).GetVersion()
+	value, err := f.encode(item, version+1)
+	if err != nil {
+		return err
+	}
+
+	err = f.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(f.bucket)
+		current := b.Get([]byte((*item).GetId()))
+		if current == nil {
+			return store.ErrNotFound
+		}
+		if valueVersion(current) != version {
+			return store.ErrVersionGone
+		}
+		return b.Put([]byte((*item).GetId()), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	f.stored(item, version+1)
+
+	return nil
+}
+
+// PutMany stores all the items in a single bolt transaction
+func (f *StoreBolt[T]) PutMany(ctx context.Context, items []*T) error {
+
+	errs := store.DuplicatedIds(items)
+
+	values := make([][]byte, len(items))
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+		values[i], errs[i] = f.encode(item, (*item).GetVersion()+1)
+	}
+
+	err := f.update(func(tx *bolt.Tx) error {
+		for i, item := range items {
+			if errs[i] != nil {
+				continue
+			}
+			errs[i] = f.put(tx, (*item).GetId(), (*item).GetVersion(), values[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, item := range items {
+		if errs[i] == nil {
+			f.stored(item, (*item).GetVersion()+1)
+		}
+	}
+
+	return store.NewBatchError(errs)
+}
+
+func (f *StoreBolt[T]) Get(ctx context.Context, id string) (*T, error) {
+
+	var item *T
+	err := f.view(func(tx *bolt.Tx) (err error) {
+		item, err = f.get(tx, id)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (f *StoreBolt[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+
+	result := make([]*T, len(ids))
+	err := f.view(func(tx *bolt.Tx) error {
+		for i, id := range ids {
+			item, err := f.get(tx, id)
+			if err != nil {
+				return err
+			}
+			result[i] = item
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (f *StoreBolt[T]) Delete(ctx context.Context, id string) error {
+	return f.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(f.bucket).Delete([]byte(id))
+	})
+}
+
+func (f *StoreBolt[T]) DeleteMany(ctx context.Context, ids []string) error {
+	return f.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(f.bucket)
+		for _, id := range ids {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (f *StoreBolt[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+	return f.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(f.bucket)
+		current := b.Get([]byte(id))
+		if current == nil {
+			return store.ErrNotFound
+		}
+		if valueVersion(current) != version {
+			return store.ErrVersionGone
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// WithTx runs fn inside a single bolt read-write transaction, so the writes
+// of fn are applied together or not at all. The transaction holds the write
+// lock of the database until fn returns: inside fn, writing with other stores
+// of the same database (other than in a nested WithTx of them) blocks forever.
+func (f *StoreBolt[T]) WithTx(ctx context.Context, fn func(tx store.Storer[T]) error) error {
+
+	if f.tx != nil {
+		return fn(f) // already in a transaction
+	}
+
+	restores := []func(){}
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		txStore := *f
+		txStore.tx = tx
+		txStore.restores = &restores
+		return fn(&txStore)
+	})
+	if err != nil {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+		return err
+	}
+
+	return nil
+}
+
+// stored sets the new version on an item written, inside WithTx the previous
+// one is restored if the transaction is rolled back
+func (f *StoreBolt[T]) stored(item *T, version int64) {
+	if f.restores != nil {
+		previous := (*item).GetVersion()
+		*f.restores = append(*f.restores, func() { (*item).SetVersion(previous) })
+	}
+	(*item).SetVersion(version)
+}
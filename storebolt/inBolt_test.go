@@ -0,0 +1,130 @@
+package storebolt
+
+import (
+	"context"
+	"errors"
+	"path"
+	"testing"
+
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+)
+
+func TestInBolt(t *testing.T) {
+
+	db, err := Open(path.Join(t.TempDir(), "test.db"))
+	biff.AssertNil(err)
+	defer db.Close()
+
+	p, err := New[testutils.TestItem](db, "mycollection")
+	biff.AssertNil(err)
+
+	testutils.SuitePersistencer(p, t)
+	testutils.SuiteOptimisticLocking(p, t)
+
+	t.Run("Pagination", func(t *testing.T) {
+		p, err := New[testutils.TestItem](db, "mycollection_pagination")
+		biff.AssertNil(err)
+		testutils.SuitePagination(p, t)
+	})
+
+	t.Run("Querier", func(t *testing.T) {
+		p, err := New[testutils.TestItem](db, "mycollection_querier")
+		biff.AssertNil(err)
+		testutils.SuiteQuerier(p, t)
+	})
+
+	t.Run("Iterable", func(t *testing.T) {
+		p, err := New[testutils.TestItem](db, "mycollection_iterable")
+		biff.AssertNil(err)
+		testutils.SuiteIterable(p, t)
+	})
+
+	t.Run("RangeScanner", func(t *testing.T) {
+		p, err := New[testutils.TestItem](db, "mycollection_range_scanner")
+		biff.AssertNil(err)
+		testutils.SuiteRangeScanner(p, t)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		p, err := New[testutils.TestItem](db, "mycollection_batch")
+		biff.AssertNil(err)
+		testutils.SuiteBatch(p, t)
+	})
+
+	t.Run("Transactor", func(t *testing.T) {
+		p, err := New[testutils.TestItem](db, "mycollection_transactor")
+		biff.AssertNil(err)
+		testutils.SuiteSerializedTransactor(p, t)
+	})
+
+	t.Run("VersionDeleter", func(t *testing.T) {
+		p, err := New[testutils.TestItem](db, "mycollection_version_deleter")
+		biff.AssertNil(err)
+		testutils.SuiteVersionDeleter(p, t)
+	})
+
+	t.Run("Aliasing", func(t *testing.T) {
+		p, err := New[testutils.TestItem](db, "mycollection_aliasing")
+		biff.AssertNil(err)
+		testutils.SuiteAliasing(p, t)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		records, err := New[store.EncryptedRecord](db, "mycollection_encrypted")
+		biff.AssertNil(err)
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p := store.NewEncryptedStore[testutils.TestItem](records, keyring)
+		testutils.SuitePersistencer(p, t)
+	})
+
+	t.Run("FieldEncrypted", func(t *testing.T) {
+		raw, err := New[testutils.SecretItem](db, "mycollection_field_encrypted")
+		biff.AssertNil(err)
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p, err := store.NewFieldEncryptedStore[testutils.SecretItem](raw, keyring)
+		biff.AssertNil(err)
+		testutils.SuiteFieldEncryption(p, raw, t)
+	})
+}
+
+func TestInBolt_Reopen(t *testing.T) {
+
+	filename := path.Join(t.TempDir(), "test.db")
+	ctx := context.Background()
+
+	db, err := Open(filename)
+	biff.AssertNil(err)
+	p, err := New[testutils.TestItem](db, "mycollection")
+	biff.AssertNil(err)
+	biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("my-id"), Title: "persisted"}))
+
+	t.Run("Locked", func(t *testing.T) {
+		_, err := Open(filename)
+		biff.AssertTrue(errors.Is(err, store.ErrLocked))
+	})
+
+	biff.AssertNil(db.Close())
+
+	db, err = Open(filename)
+	biff.AssertNil(err)
+	defer db.Close()
+	p, err = New[testutils.TestItem](db, "mycollection")
+	biff.AssertNil(err)
+
+	item, err := p.Get(ctx, "my-id")
+	biff.AssertNil(err)
+	biff.AssertEqual(item.Title, "persisted")
+	biff.AssertEqual(item.GetVersion(), int64(1))
+
+	t.Run("Collections are isolated", func(t *testing.T) {
+		other, err := New[testutils.TestItem](db, "other")
+		biff.AssertNil(err)
+		item, err := other.Get(ctx, "my-id")
+		biff.AssertNil(err)
+		biff.AssertNil(item)
+	})
+}
@@ -0,0 +1,51 @@
+package storeinception
+
+import (
+	"github.com/holacloud/store"
+)
+
+// compileFilter translates a (validated) store.Filter into an InceptionDB
+// filter (connor syntax). It returns false if the filter can not be expressed
+// natively, in that case it must be evaluated in process.
+func compileFilter(f store.Filter) (map[string]interface{}, bool) {
+
+	switch f.Op {
+	case "":
+		return map[string]interface{}{}, true
+	case store.OpAnd, store.OpOr:
+		if len(f.Filters) == 0 {
+			return nil, false
+		}
+		filters := []interface{}{}
+		for _, sub := range f.Filters {
+			filter, ok := compileFilter(sub)
+			if !ok {
+				return nil, false
+			}
+			filters = append(filters, filter)
+		}
+		return map[string]interface{}{"$" + string(f.Op): filters}, true
+	}
+
+	operator, ok := map[store.Operator]string{
+		store.OpEq:  "$eq",
+		store.OpNe:  "$ne",
+		store.OpIn:  "$in",
+		store.OpLt:  "$lt",
+		store.OpLte: "$le",
+		store.OpGt:  "$gt",
+		store.OpGte: "$ge",
+	}[f.Op]
+	if !ok {
+		return nil, false // exists is not supported by connor
+	}
+
+	value := f.Value
+	if f.Op == store.OpIn {
+		value = append([]interface{}{}, f.Values...)
+	}
+
+	return map[string]interface{}{
+		f.Field: map[string]interface{}{operator: value},
+	}, true
+}
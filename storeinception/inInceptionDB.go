@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"iter"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/holacloud/store"
@@ -18,8 +20,12 @@ type ConfigInceptionDB struct {
 	Collection string `json:"collection"`
 	ApiKey     string `json:"api_key"`
 	ApiSecret  string `json:"api_secret"`
+	// Unique constraints are created as sparse map indexes with the same name
+	Unique []store.UniqueConstraint `json:"unique,omitempty"`
 }
 
+// StoreInception talks JSON with the InceptionDB API, the codec is not
+// configurable.
 type StoreInception[T store.Identifier] struct {
 	config     *ConfigInceptionDB
 	httpClient *http.Client
@@ -47,6 +53,10 @@ func New[T store.Identifier](config *ConfigInceptionDB) *StoreInception[T] {
 	}
 	result.dropCollection()
 	result.ensureCollection()
+	result.ensureIndex("id", "id")
+	for _, c := range config.Unique {
+		result.ensureIndex(c.Name, c.Field)
+	}
 
 	return result
 }
@@ -63,28 +73,122 @@ func (p *StoreInception[T]) List(ctx context.Context) ([]*T, error) {
 		Filter: map[string]interface{}{},
 		Limit:  -1,
 	}
-	payload, err := json.Marshal(query)
+	return p.find(ctx, "list", query)
+}
+
+func (p *StoreInception[T]) Find(ctx context.Context, filter store.Filter, sort ...store.SortField) ([]*T, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := store.ValidateSort(sort); err != nil {
+		return nil, err
+	}
+
+	native, ok := compileFilter(filter)
+	if ok {
+		items, err := p.find(ctx, "find", FindQuery{
+			Filter: native,
+			Limit:  -1,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if items == nil {
+			items = []*T{}
+		}
+		// InceptionDB has no sort, do it in process
+		return items, store.SortItems(items, sort)
+	}
+
+	// Fallback: evaluate the filter in process
+	items, err := p.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err = store.FilterItems(items, filter)
 	if err != nil {
 		return nil, err
 	}
+	return items, store.SortItems(items, sort)
+}
 
-	endpoint := p.config.Base + "/collections/" + url.PathEscape(p.config.Collection) + ":find"
-	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+func (p *StoreInception[T]) ListPage(ctx context.Context, req store.PageRequest) (*store.Page[T], error) {
+	position, err := store.DecodeCursor(req.Cursor)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Api-Key", p.config.ApiKey)
-	req.Header.Set("Api-Secret", p.config.ApiSecret)
 
-	resp, err := p.httpClient.Do(req)
+	skip := 0
+	if position != "" {
+		skip, err = strconv.Atoi(position)
+		if err != nil || skip < 0 {
+			return nil, store.ErrInvalidCursor
+		}
+	}
+
+	limit := req.GetLimit()
+	query := FindQuery{
+		Filter: map[string]interface{}{},
+		Limit:  limit + 1,
+		Skip:   skip,
+	}
+	items, err := p.find(ctx, "list page", query)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("list: unexpected HTTP status: " + resp.Status)
+	page := &store.Page[T]{
+		Items: items,
 	}
+	if len(items) > limit {
+		page.Items = items[:limit]
+		page.NextCursor = store.EncodeCursor(strconv.Itoa(skip + limit))
+	}
+	if page.Items == nil {
+		page.Items = []*T{}
+	}
+	return page, nil
+}
+
+func (p *StoreInception[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		query := FindQuery{
+			Filter: map[string]interface{}{},
+			Limit:  -1,
+		}
+		resp, err := p.findRequest(ctx, "iterate", query)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var item *T
+			err := decoder.Decode(&item)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
+
+// find performs a query against the collection and decodes all the returned
+// documents, op is used to give context to errors
+func (p *StoreInception[T]) find(ctx context.Context, op string, query FindQuery) ([]*T, error) {
+	resp, err := p.findRequest(ctx, op, query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
 	var items []*T
 	decoder := json.NewDecoder(resp.Body)
@@ -103,6 +207,34 @@ func (p *StoreInception[T]) List(ctx context.Context) ([]*T, error) {
 	return items, nil
 }
 
+// findRequest sends a find query, the caller must close the response body
+func (p *StoreInception[T]) findRequest(ctx context.Context, op string, query FindQuery) (*http.Response, error) {
+	payload, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := p.config.Base + "/collections/" + url.PathEscape(p.config.Collection) + ":find"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Api-Key", p.config.ApiKey)
+	req.Header.Set("Api-Secret", p.config.ApiSecret)
+
+	resp, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(op + ": unexpected HTTP status: " + resp.Status)
+	}
+
+	return resp, nil
+}
+
 func (p *StoreInception[T]) Put(ctx context.Context, item *T) error {
 
 	// TODO: copy? remarshal?
@@ -110,41 +242,84 @@ func (p *StoreInception[T]) Put(ctx context.Context, item *T) error {
 	itemVersion := (*item).GetVersion()
 	if itemVersion == 0 {
 		// Assume the document is new
-
-		(*item).SetVersion(itemVersion + 1) // 1
-		payload, err := json.Marshal(item)
-		(*item).SetVersion(itemVersion) // restore
-		if err != nil {
-			return err
+		err := p.insert(ctx, item)
+		if err == store.ErrAlreadyExists {
+			return store.ErrVersionGone
 		}
-		endpoint := p.config.Base + "/collections/" + url.PathEscape(p.config.Collection) + ":insert"
-		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
-		if err != nil {
-			return err
-		}
-		req.Header.Set("Api-Key", p.config.ApiKey)
-		req.Header.Set("Api-Secret", p.config.ApiSecret)
+		return err
+	}
 
-		resp, err := p.httpClient.Do(req)
-		if err != nil {
+	return p.patch(ctx, item)
+}
+
+func (p *StoreInception[T]) Create(ctx context.Context, item *T) error {
+	return p.insert(ctx, item)
+}
+
+func (p *StoreInception[T]) Update(ctx context.Context, item *T) error {
+	err := p.patch(ctx, item)
+	if err != store.ErrVersionGone {
+		return err
+	}
+
+	// Nothing patched, tell why
+	current, err := p.Get(ctx, (*item).GetId())
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return store.ErrNotFound
+	}
+	return store.ErrVersionGone
+}
+
+// insert stores a new document with version 1, the unique index on id (see
+// ensureCollection) rejects it with ErrAlreadyExists if the id exists
+func (p *StoreInception[T]) insert(ctx context.Context, item *T) error {
+
+	itemVersion := (*item).GetVersion()
+	(*item).SetVersion(1)
+	payload, err := json.Marshal(item)
+	(*item).SetVersion(itemVersion) // restore
+	if err != nil {
+		return err
+	}
+	endpoint := p.config.Base + "/collections/" + url.PathEscape(p.config.Collection) + ":insert"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Api-Key", p.config.ApiKey)
+	req.Header.Set("Api-Secret", p.config.ApiSecret)
+
+	resp, err := p.do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusCreated {
+		if err := p.conflictError(resp); err != nil {
 			return err
 		}
-		defer func() {
-			_, _ = io.Copy(io.Discard, resp.Body)
-			_ = resp.Body.Close()
-		}()
+		return errors.New("put (insert): unexpected HTTP status: " + resp.Status)
+	}
 
-		if resp.StatusCode != http.StatusCreated {
-			return errors.New("put (insert): unexpected HTTP status: " + resp.Status)
-		}
+	(*item).SetVersion(1)
+	return nil
+}
 
-		(*item).SetVersion(itemVersion + 1)
-		return nil
-	}
+// patch updates the document only if it is still at the version of item,
+// otherwise it returns ErrVersionGone
+func (p *StoreInception[T]) patch(ctx context.Context, item *T) error {
 
+	itemVersion := (*item).GetVersion()
 	filter := map[string]interface{}{
 		"id":      (*item).GetId(),
-		"version": (*item).GetVersion(),
+		"version": itemVersion,
 	}
 
 	// Use patch endpoint to update the document. The filter identifies id and actual version.
@@ -166,7 +341,7 @@ func (p *StoreInception[T]) Put(ctx context.Context, item *T) error {
 	req.Header.Set("Api-Key", p.config.ApiKey)
 	req.Header.Set("Api-Secret", p.config.ApiSecret)
 
-	resp, err := p.httpClient.Do(req)
+	resp, err := p.do(req)
 	if err != nil {
 		return err
 	}
@@ -175,21 +350,83 @@ func (p *StoreInception[T]) Put(ctx context.Context, item *T) error {
 		_ = resp.Body.Close()
 	}()
 
-	err = json.NewDecoder(resp.Body).Decode(&item)
+	if resp.StatusCode != http.StatusOK {
+		if err := p.conflictError(resp); err != nil {
+			return err
+		}
+		return errors.New("put (patch): unexpected HTTP status: " + resp.Status)
+	}
+	var patched *T
+	err = json.NewDecoder(resp.Body).Decode(&patched)
 	if err == io.EOF {
 		return store.ErrVersionGone
 	}
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("put (patch): unexpected HTTP status: " + resp.Status)
-	}
 
 	(*item).SetVersion(itemVersion + 1)
 	return nil
 }
 
+func (p *StoreInception[T]) PutMany(ctx context.Context, items []*T) error {
+
+	errs := store.DuplicatedIds(items)
+
+	// New documents are sent together to the insert endpoint as JSON Lines,
+	// updates need a patch per document because the filter includes the version
+	payload := &bytes.Buffer{}
+	encoder := json.NewEncoder(payload)
+	inserts := []int{}
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+
+		itemVersion := (*item).GetVersion()
+		if itemVersion != 0 {
+			errs[i] = p.Put(ctx, item)
+			continue
+		}
+
+		(*item).SetVersion(itemVersion + 1) // 1
+		err := encoder.Encode(item)
+		(*item).SetVersion(itemVersion) // restore
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		inserts = append(inserts, i)
+	}
+
+	if len(inserts) > 0 {
+		endpoint := p.config.Base + "/collections/" + url.PathEscape(p.config.Collection) + ":insert"
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, payload)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Api-Key", p.config.ApiKey)
+		req.Header.Set("Api-Secret", p.config.ApiSecret)
+
+		resp, err := p.do(req)
+		if err != nil {
+			return err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		for _, i := range inserts {
+			if resp.StatusCode != http.StatusCreated {
+				errs[i] = errors.New("put many (insert): unexpected HTTP status: " + resp.Status)
+				continue
+			}
+			(*items[i]).SetVersion(1)
+		}
+	}
+
+	return store.NewBatchError(errs)
+}
+
 func (p *StoreInception[T]) Get(ctx context.Context, id string) (*T, error) {
 	query := FindQuery{
 		Filter: map[string]interface{}{
@@ -210,7 +447,7 @@ func (p *StoreInception[T]) Get(ctx context.Context, id string) (*T, error) {
 	req.Header.Set("Api-Key", p.config.ApiKey)
 	req.Header.Set("Api-Secret", p.config.ApiSecret)
 
-	resp, err := p.httpClient.Do(req)
+	resp, err := p.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -232,6 +469,33 @@ func (p *StoreInception[T]) Get(ctx context.Context, id string) (*T, error) {
 	return item, nil
 }
 
+func (p *StoreInception[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+	if len(ids) == 0 {
+		return []*T{}, nil
+	}
+
+	found, err := p.find(ctx, "get many", FindQuery{
+		Filter: map[string]interface{}{
+			"id": map[string]interface{}{"$in": ids},
+		},
+		Limit: -1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byId := map[string]*T{}
+	for _, item := range found {
+		byId[(*item).GetId()] = item
+	}
+
+	result := make([]*T, len(ids))
+	for i, id := range ids {
+		result[i] = byId[id]
+	}
+	return result, nil
+}
+
 func (p *StoreInception[T]) Delete(ctx context.Context, id string) error {
 	query := FindQuery{
 		Filter: map[string]interface{}{
@@ -251,7 +515,7 @@ func (p *StoreInception[T]) Delete(ctx context.Context, id string) error {
 	req.Header.Set("Api-Key", p.config.ApiKey)
 	req.Header.Set("Api-Secret", p.config.ApiSecret)
 
-	resp, err := p.httpClient.Do(req)
+	resp, err := p.do(req)
 	if err != nil {
 		return err
 	}
@@ -263,6 +527,111 @@ func (p *StoreInception[T]) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
+func (p *StoreInception[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+	query := FindQuery{
+		Filter: map[string]interface{}{
+			"id":      id,
+			"version": version,
+		},
+		Limit: 1,
+	}
+	payload, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+
+	endpoint := p.config.Base + "/collections/" + url.PathEscape(p.config.Collection) + ":remove"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Api-Key", p.config.ApiKey)
+	req.Header.Set("Api-Secret", p.config.ApiSecret)
+
+	resp, err := p.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("delete version: unexpected HTTP status: " + resp.Status)
+	}
+
+	// The removed documents are streamed back, nothing means no match
+	var removed *T
+	err = json.NewDecoder(resp.Body).Decode(&removed)
+	if err == nil {
+		return nil
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	current, err := p.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return store.ErrNotFound
+	}
+	return store.ErrVersionGone
+}
+
+func (p *StoreInception[T]) DeleteMany(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query := FindQuery{
+		Filter: map[string]interface{}{
+			"id": map[string]interface{}{"$in": ids},
+		},
+		Limit: len(ids),
+	}
+	payload, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+
+	endpoint := p.config.Base + "/collections/" + url.PathEscape(p.config.Collection) + ":remove"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Api-Key", p.config.ApiKey)
+	req.Header.Set("Api-Secret", p.config.ApiSecret)
+
+	resp, err := p.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("delete many: unexpected HTTP status: " + resp.Status)
+	}
+	return nil
+}
+
+// do sends the request marking connection failures and gateway errors with
+// store.ErrUnavailable
+func (p *StoreInception[T]) do(req *http.Request) (*http.Response, error) {
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, store.Unavailable(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, store.Unavailable(errors.New("unexpected HTTP status: " + resp.Status))
+	}
+
+	return resp, nil
+}
+
 func (p *StoreInception[T]) ensureCollection() error {
 	endpoint := p.config.Base + "/collections"
 
@@ -281,7 +650,7 @@ func (p *StoreInception[T]) ensureCollection() error {
 	req.Header.Set("Api-Key", p.config.ApiKey)
 	req.Header.Set("Api-Secret", p.config.ApiSecret)
 
-	resp, err := p.httpClient.Do(req)
+	resp, err := p.do(req)
 	if err != nil {
 		return err
 	}
@@ -294,6 +663,55 @@ func (p *StoreInception[T]) ensureCollection() error {
 	return resp.Body.Close()
 }
 
+// conflictError reads a failed response and returns store.ErrAlreadyExists or
+// a *store.UniqueViolationError if it is an index conflict, nil otherwise
+func (p *StoreInception[T]) conflictError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusConflict && !bytes.Contains(body, []byte("conflict")) {
+		return nil
+	}
+	for _, c := range p.config.Unique {
+		if bytes.Contains(body, []byte("'"+c.Field+"'")) || bytes.Contains(body, []byte("'"+c.Name+"'")) {
+			return &store.UniqueViolationError{Constraint: c.Name}
+		}
+	}
+	return store.ErrAlreadyExists
+}
+
+// ensureIndex creates a unique (map) index, the one on id prevents inserts
+// from duplicating documents
+func (p *StoreInception[T]) ensureIndex(name, field string) error {
+	endpoint := p.config.Base + "/collections/" + url.PathEscape(p.config.Collection) + ":createIndex"
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"name":   name,
+		"type":   "map",
+		"field":  field,
+		"sparse": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Api-Key", p.config.ApiKey)
+	req.Header.Set("Api-Secret", p.config.ApiSecret)
+
+	resp, err := p.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, resp.Body)
+
+	return nil
+}
+
 func (p *StoreInception[T]) dropCollection() error {
 	endpoint := p.config.Base + "/collections/" + url.PathEscape(p.config.Collection) + ":dropCollection"
 
@@ -305,7 +723,7 @@ func (p *StoreInception[T]) dropCollection() error {
 	req.Header.Set("Api-Key", p.config.ApiKey)
 	req.Header.Set("Api-Secret", p.config.ApiSecret)
 
-	resp, err := p.httpClient.Do(req)
+	resp, err := p.do(req)
 	if err != nil {
 		return err
 	}
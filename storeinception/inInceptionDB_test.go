@@ -2,9 +2,12 @@ package storeinception
 
 import (
 	"context"
+	"errors"
 	"testing"
 
+	"github.com/fulldump/biff"
 	"github.com/google/uuid"
+	"github.com/holacloud/store"
 	"github.com/holacloud/store/testutils"
 )
 
@@ -26,4 +29,72 @@ func TestInInception(t *testing.T) {
 
 	testutils.SuitePersistencer(p, t)
 	testutils.SuiteOptimisticLocking(p, t) // working on this!
+
+	t.Run("Pagination", func(t *testing.T) {
+		p := New[testutils.TestItem](&ConfigInceptionDB{
+			Base:       p.config.Base,
+			Collection: collection + "-pagination",
+		})
+		testutils.SuitePagination(p, t)
+	})
+
+	t.Run("Querier", func(t *testing.T) {
+		p := New[testutils.TestItem](&ConfigInceptionDB{
+			Base:       p.config.Base,
+			Collection: collection + "-querier",
+		})
+		testutils.SuiteQuerier(p, t)
+	})
+
+	t.Run("Iterable", func(t *testing.T) {
+		p := New[testutils.TestItem](&ConfigInceptionDB{
+			Base:       p.config.Base,
+			Collection: collection + "-iterable",
+		})
+		testutils.SuiteIterable(p, t)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		p := New[testutils.TestItem](&ConfigInceptionDB{
+			Base:       p.config.Base,
+			Collection: collection + "-batch",
+		})
+		testutils.SuiteBatch(p, t)
+	})
+
+	t.Run("VersionDeleter", func(t *testing.T) {
+		p := New[testutils.TestItem](&ConfigInceptionDB{
+			Base:       p.config.Base,
+			Collection: collection + "-version-deleter",
+		})
+		testutils.SuiteVersionDeleter(p, t)
+	})
+
+	t.Run("Aliasing", func(t *testing.T) {
+		p := New[testutils.TestItem](&ConfigInceptionDB{
+			Base:       p.config.Base,
+			Collection: collection + "-aliasing",
+		})
+		testutils.SuiteAliasing(p, t)
+	})
+
+	t.Run("UniqueConstraints", func(t *testing.T) {
+		p := New[testutils.TestItem](&ConfigInceptionDB{
+			Base:       p.config.Base,
+			Collection: collection + "-unique",
+			Unique:     testutils.TestItemConstraints,
+		})
+		testutils.SuiteUniqueConstraints(p, t)
+	})
+}
+
+func TestInInception_Unavailable(t *testing.T) {
+
+	p := New[testutils.TestItem](&ConfigInceptionDB{
+		Base:       "http://127.0.0.1:1/v1",
+		Collection: "testing-unavailable",
+	})
+
+	_, err := p.Get(context.Background(), "1")
+	biff.AssertTrue(errors.Is(err, store.ErrUnavailable))
 }
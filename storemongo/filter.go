@@ -0,0 +1,90 @@
+package storemongo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/holacloud/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// compileFilter translates a (validated) store.Filter into a bson filter.
+// Field "id" is mapped to "_id" as done by store.Id, any other field must have
+// the same name in json and bson.
+func compileFilter(f store.Filter) (bson.M, error) {
+
+	switch f.Op {
+	case "":
+		return bson.M{}, nil
+	case store.OpAnd, store.OpOr:
+		if len(f.Filters) == 0 {
+			if f.Op == store.OpAnd {
+				return bson.M{}, nil
+			}
+			return bson.M{"_id": bson.M{"$in": bson.A{}}}, nil // match nothing
+		}
+		filters := bson.A{}
+		for _, sub := range f.Filters {
+			filter, err := compileFilter(sub)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, filter)
+		}
+		return bson.M{"$" + string(f.Op): filters}, nil
+	}
+
+	field := fieldName(f.Field)
+
+	// Mongo matches missing fields against null, so existence is always
+	// explicit to keep the semantics of store.Filter
+	switch f.Op {
+	case store.OpEq:
+		return bson.M{field: bson.M{"$exists": true, "$eq": f.Value}}, nil
+	case store.OpNe:
+		return bson.M{"$or": bson.A{
+			bson.M{field: bson.M{"$exists": false}},
+			bson.M{field: bson.M{"$ne": f.Value}},
+		}}, nil
+	case store.OpIn:
+		return bson.M{field: bson.M{"$exists": true, "$in": append(bson.A{}, f.Values...)}}, nil
+	case store.OpExists:
+		return bson.M{field: bson.M{"$exists": f.Value}}, nil
+	case store.OpLt, store.OpLte, store.OpGt, store.OpGte:
+		// Mongo type bracketing only compares values of the same type
+		return bson.M{field: bson.M{"$" + string(f.Op): f.Value}}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown operator '%s'", store.ErrInvalidFilter, f.Op)
+}
+
+// compileSort translates sort fields into a mongo sort document, id is always
+// used as tie-break. Mongo already orders types as store.SortBucket does for
+// null, numbers and strings.
+func compileSort(fields []store.SortField) bson.D {
+	result := bson.D{}
+	hasId := false
+	for _, f := range fields {
+		direction := 1
+		if f.Desc {
+			direction = -1
+		}
+		field := fieldName(f.Field)
+		if field == "_id" {
+			hasId = true
+		}
+		result = append(result, bson.E{Key: field, Value: direction})
+	}
+	if !hasId {
+		result = append(result, bson.E{Key: "_id", Value: 1})
+	}
+	return result
+}
+
+// fieldName maps "id" to "_id" as done by store.Id
+func fieldName(field string) string {
+	if field == "id" || strings.HasPrefix(field, "id.") {
+		return "_" + field
+	}
+	return field
+}
@@ -2,27 +2,39 @@ package storemongo
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"iter"
+	"log"
 	"time"
 
 	"github.com/holacloud/store"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
+// StoreMongo keeps items as BSON documents (with their bson tags) so they can
+// be queried and indexed, the codec is not configurable.
 type StoreMongo[T store.Identifier] struct {
 	collectionName string
 	connection     string
+	constraints    []store.UniqueConstraint
 	client         *mongo.Client
 	database       *mongo.Database
 }
 
-func New[T store.Identifier](collectionName, connection string) (*StoreMongo[T], error) {
+// New connects to mongo. Every unique constraint is a unique index with the
+// same name, partial so missing, null and "" values are not constrained
+// (requires MongoDB 6.0 or later).
+func New[T store.Identifier](collectionName, connection string, constraints ...store.UniqueConstraint) (*StoreMongo[T], error) {
 
 	cs, err := connstring.ParseAndValidate(connection)
 	if err != nil {
-		return nil, err
+		return nil, err // invalid connection string
 	}
 
 	databaseName := cs.Database
@@ -35,7 +47,7 @@ func New[T store.Identifier](collectionName, connection string) (*StoreMongo[T],
 
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(connection))
 	if err != nil {
-		return nil, err
+		return nil, unavailable(err)
 	}
 
 	// ensure unique "id" index for items :D
@@ -47,19 +59,109 @@ func New[T store.Identifier](collectionName, connection string) (*StoreMongo[T],
 		return nil, err
 	}
 
+	for _, c := range constraints {
+		field := fieldName(c.Field)
+		_, err := database.Collection(collectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: field, Value: 1}},
+			Options: options.Index().SetName(c.Name).SetUnique(true).SetPartialFilterExpression(bson.M{
+				"$or": bson.A{
+					bson.M{field: bson.M{"$gt": ""}},
+					bson.M{field: bson.M{"$type": "number"}},
+					bson.M{field: bson.M{"$type": "bool"}},
+				},
+			}),
+		})
+		if err != nil {
+			return nil, unavailable(err)
+		}
+	}
+
 	return &StoreMongo[T]{
 		collectionName: collectionName,
 		connection:     connection,
+		constraints:    constraints,
 		client:         client, // might not be needed
 		database:       database,
 	}, nil
 }
 
+// duplicateError tells apart duplicated keys in the unique constraints, which
+// become *store.UniqueViolationError, from duplicated ids, which become
+// fallback
+func (f *StoreMongo[T]) duplicateError(err error, fallback error) error {
+	fields := duplicatedFields(err)
+	for _, c := range f.constraints {
+		for _, field := range fields {
+			if field == fieldName(c.Field) {
+				return &store.UniqueViolationError{Constraint: c.Name}
+			}
+		}
+	}
+	return fallback
+}
+
+// duplicateKeyCode is the server error of a duplicated key in a unique index
+const duplicateKeyCode = 11000
+
+// duplicatedFields returns the fields of the unique indexes violated in err,
+// read from the keyPattern of the server errors with duplicateKeyCode
+func duplicatedFields(err error) []string {
+
+	raws := []bson.Raw{}
+	var writeException mongo.WriteException
+	var bulkException mongo.BulkWriteException
+	var bulkErr mongo.BulkWriteError
+	var writeErr mongo.WriteError
+	var commandErr mongo.CommandError
+	switch {
+	case errors.As(err, &writeException):
+		for _, e := range writeException.WriteErrors {
+			if e.Code == duplicateKeyCode {
+				raws = append(raws, e.Raw)
+			}
+		}
+	case errors.As(err, &bulkException):
+		for _, e := range bulkException.WriteErrors {
+			if e.Code == duplicateKeyCode {
+				raws = append(raws, e.Raw)
+			}
+		}
+	case errors.As(err, &bulkErr):
+		if bulkErr.Code == duplicateKeyCode {
+			raws = append(raws, bulkErr.Raw)
+		}
+	case errors.As(err, &writeErr):
+		if writeErr.Code == duplicateKeyCode {
+			raws = append(raws, writeErr.Raw)
+		}
+	case errors.As(err, &commandErr):
+		if commandErr.Code == duplicateKeyCode {
+			raws = append(raws, commandErr.Raw)
+		}
+	}
+
+	fields := []string{}
+	for _, raw := range raws {
+		keyPattern, ok := raw.Lookup("keyPattern").DocumentOK()
+		if !ok {
+			continue
+		}
+		keys, err := keyPattern.Elements()
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			fields = append(fields, key.Key())
+		}
+	}
+	return fields
+}
+
 func (f *StoreMongo[T]) List(ctx context.Context) ([]*T, error) {
 
 	cur, err := f.database.Collection(f.collectionName).Find(ctx, bson.M{})
 	if err != nil {
-		return nil, err
+		return nil, unavailable(err)
 	}
 	defer cur.Close(context.Background())
 
@@ -77,13 +179,122 @@ func (f *StoreMongo[T]) List(ctx context.Context) ([]*T, error) {
 	return result, nil
 }
 
-func (f *StoreMongo[T]) Put(ctx context.Context, item *T) error {
-	filter := bson.M{
-		"_id": (*item).GetId(),
+func (f *StoreMongo[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+
+		cur, err := f.database.Collection(f.collectionName).Find(ctx, bson.M{})
+		if err != nil {
+			yield(nil, unavailable(err))
+			return
+		}
+		defer cur.Close(context.Background())
+
+		for cur.Next(ctx) {
+			var item *T
+			err := cur.Decode(&item)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(item, nil) {
+				return
+			}
+		}
+		if err := cur.Err(); err != nil {
+			yield(nil, unavailable(err))
+		}
 	}
+}
+
+func (f *StoreMongo[T]) Find(ctx context.Context, filter store.Filter, sort ...store.SortField) ([]*T, error) {
+
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := store.ValidateSort(sort); err != nil {
+		return nil, err
+	}
+
+	query, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Find()
+	if len(sort) > 0 {
+		opts.SetSort(compileSort(sort))
+	}
+
+	cur, err := f.database.Collection(f.collectionName).Find(ctx, query, opts)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer cur.Close(context.Background())
+
+	result := []*T{}
+
+	for cur.Next(ctx) {
+		var item *T
+		err := cur.Decode(&item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+
+	return result, nil
+}
+
+func (f *StoreMongo[T]) ListPage(ctx context.Context, req store.PageRequest) (*store.Page[T], error) {
+
+	after, err := store.DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{}
+	if req.Cursor != "" {
+		filter["_id"] = bson.M{"$gt": after}
+	}
+
+	limit := req.GetLimit()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(limit + 1))
+
+	cur, err := f.database.Collection(f.collectionName).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer cur.Close(context.Background())
+
+	result := []*T{}
+
+	for cur.Next(ctx) {
+		var item *T
+		err := cur.Decode(&item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+
+	return store.NewPage(result, limit), nil
+}
+
+func (f *StoreMongo[T]) Put(ctx context.Context, item *T) error {
+	// A new item (version 0) never matches an existing document, so the upsert
+	// fails with a duplicate key instead of overwriting it
 	version := (*item).GetVersion()
-	if version > 0 {
-		filter["version"] = version
+	filter := bson.M{
+		"_id":     (*item).GetId(),
+		"version": version,
 	}
 	set := *item
 	set.SetVersion(version + 1)
@@ -94,30 +305,371 @@ func (f *StoreMongo[T]) Put(ctx context.Context, item *T) error {
 	result, err := f.database.Collection(f.collectionName).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
 
 	if mongo.IsDuplicateKeyError(err) {
+		return f.duplicateError(err, store.ErrVersionGone)
+	}
+
+	if err != nil {
+		return unavailable(err)
+	}
+
+	if result.MatchedCount == 0 && result.UpsertedCount == 0 {
 		return store.ErrVersionGone
 	}
 
+	return nil
+}
+
+func (f *StoreMongo[T]) Create(ctx context.Context, item *T) error {
+	version := (*item).GetVersion()
+	(*item).SetVersion(1)
+
+	_, err := f.database.Collection(f.collectionName).InsertOne(ctx, item)
+	if err != nil {
+		(*item).SetVersion(version)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return f.duplicateError(err, store.ErrAlreadyExists)
+	}
+
+	return unavailable(err)
+}
+
+func (f *StoreMongo[T]) Update(ctx context.Context, item *T) error {
+	version := (*item).GetVersion()
+	filter := bson.M{
+		"_id":     (*item).GetId(),
+		"version": version,
+	}
+	(*item).SetVersion(version + 1)
+	set, err := bson.Marshal(item)
+	(*item).SetVersion(version) // restore until it is stored
 	if err != nil {
 		return err
 	}
 
-	if result.MatchedCount == 0 && result.UpsertedCount == 0 {
+	result, err := f.database.Collection(f.collectionName).UpdateOne(ctx, filter, bson.M{"$set": bson.Raw(set)})
+	if mongo.IsDuplicateKeyError(err) {
+		return f.duplicateError(err, err)
+	}
+	if err != nil {
+		return unavailable(err)
+	}
+	if result.MatchedCount == 0 {
+		// Nothing updated, tell why
+		n, err := f.database.Collection(f.collectionName).CountDocuments(ctx, bson.M{"_id": (*item).GetId()})
+		if err != nil {
+			return unavailable(err)
+		}
+		if n == 0 {
+			return store.ErrNotFound
+		}
 		return store.ErrVersionGone
 	}
 
+	(*item).SetVersion(version + 1)
 	return nil
 }
 
+func (f *StoreMongo[T]) PutMany(ctx context.Context, items []*T) error {
+
+	errs := store.DuplicatedIds(items)
+
+	models := []mongo.WriteModel{}
+	indexes := []int{} // position in items of each model
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+
+		// Same filter and update as Put
+		version := (*item).GetVersion()
+		filter := bson.M{
+			"_id":     (*item).GetId(),
+			"version": version,
+		}
+		(*item).SetVersion(version + 1)
+		set, err := bson.Marshal(item)
+		(*item).SetVersion(version) // restore until it is stored
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(filter).
+			SetUpdate(bson.M{"$set": bson.Raw(set)}).
+			SetUpsert(true))
+		indexes = append(indexes, i)
+	}
+
+	if len(models) > 0 {
+		_, err := f.database.Collection(f.collectionName).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if bulkErr, ok := err.(mongo.BulkWriteException); ok {
+			for _, writeErr := range bulkErr.WriteErrors {
+				i := indexes[writeErr.Index]
+				if mongo.IsDuplicateKeyError(writeErr) {
+					errs[i] = f.duplicateError(writeErr, store.ErrVersionGone)
+				} else {
+					errs[i] = writeErr
+				}
+			}
+			if bulkErr.WriteConcernError != nil {
+				return bulkErr
+			}
+		} else if err != nil {
+			return unavailable(err)
+		}
+	}
+
+	for _, i := range indexes {
+		if errs[i] == nil {
+			(*items[i]).SetVersion((*items[i]).GetVersion() + 1)
+		}
+	}
+
+	return store.NewBatchError(errs)
+}
+
 func (f *StoreMongo[T]) Get(ctx context.Context, id string) (*T, error) {
-	var result *T
-	err := f.database.Collection(f.collectionName).FindOne(ctx, bson.M{"_id": id}).Decode(&result)
+	found := f.database.Collection(f.collectionName).FindOne(ctx, bson.M{"_id": id})
+	err := found.Err()
 	if err == mongo.ErrNoDocuments {
 		return nil, nil
 	}
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	var result *T
+	err = found.Decode(&result)
 	return result, err
 }
 
+func (f *StoreMongo[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+
+	if len(ids) == 0 {
+		return []*T{}, nil
+	}
+
+	cur, err := f.database.Collection(f.collectionName).Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer cur.Close(context.Background())
+
+	byId := map[string]*T{}
+	for cur.Next(ctx) {
+		var item *T
+		err := cur.Decode(&item)
+		if err != nil {
+			return nil, err
+		}
+		byId[(*item).GetId()] = item
+	}
+	if err := cur.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+
+	result := make([]*T, len(ids))
+	for i, id := range ids {
+		result[i] = byId[id]
+	}
+
+	return result, nil
+}
+
 func (f *StoreMongo[T]) Delete(ctx context.Context, id string) error {
 	_, err := f.database.Collection(f.collectionName).DeleteOne(ctx, bson.M{"_id": id})
+	return unavailable(err)
+}
+
+func (f *StoreMongo[T]) DeleteMany(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := f.database.Collection(f.collectionName).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return unavailable(err)
+}
+
+// WithTx runs fn inside a mongo transaction (requires a replica set or a
+// sharded cluster). Write conflicts with other transactions are reported as
+// store.ErrVersionGone instead of being retried.
+func (f *StoreMongo[T]) WithTx(ctx context.Context, fn func(tx store.Storer[T]) error) error {
+
+	session, err := f.client.StartSession()
+	if err != nil {
+		return unavailable(err)
+	}
+	defer session.EndSession(context.Background())
+
+	if err := session.StartTransaction(); err != nil {
+		return unavailable(err)
+	}
+
+	tx := &txMongo[T]{store: f, session: session}
+	if err := fn(tx); err != nil {
+		_ = session.AbortTransaction(context.Background())
+		tx.rollback()
+		return conflictError(err)
+	}
+
+	err = session.CommitTransaction(mongo.NewSessionContext(ctx, session))
+	if err != nil {
+		_ = session.AbortTransaction(context.Background())
+		tx.rollback()
+		return conflictError(err)
+	}
+
+	return nil
+}
+
+// conflictError translates transaction write conflicts into store.ErrVersionGone
+func conflictError(err error) error {
+	var labeled mongo.LabeledError
+	if errors.As(err, &labeled) && labeled.HasErrorLabel(driver.TransientTransactionError) {
+		return store.ErrVersionGone
+	}
+	return unavailable(err)
+}
+
+// txMongo binds every operation to the session of the transaction
+type txMongo[T store.Identifier] struct {
+	store    *StoreMongo[T]
+	session  mongo.Session
+	restores []func() // restore the versions of the items put, see rollback
+}
+
+// rollback restores the versions the items put had before the transaction
+func (t *txMongo[T]) rollback() {
+	for i := len(t.restores) - 1; i >= 0; i-- {
+		t.restores[i]()
+	}
+}
+
+func (t *txMongo[T]) List(ctx context.Context) ([]*T, error) {
+	return t.store.List(mongo.NewSessionContext(ctx, t.session))
+}
+
+func (t *txMongo[T]) Put(ctx context.Context, item *T) error {
+	previous := (*item).GetVersion()
+	t.restores = append(t.restores, func() { (*item).SetVersion(previous) })
+	return conflictError(t.store.Put(mongo.NewSessionContext(ctx, t.session), item))
+}
+
+func (t *txMongo[T]) Get(ctx context.Context, id string) (*T, error) {
+	return t.store.Get(mongo.NewSessionContext(ctx, t.session), id)
+}
+
+func (t *txMongo[T]) Delete(ctx context.Context, id string) error {
+	return conflictError(t.store.Delete(mongo.NewSessionContext(ctx, t.session), id))
+}
+
+// Watch uses a change stream (requires a replica set or a sharded cluster).
+// Positions are resume tokens so a consumer can continue after a restart as
+// long as the event is still in the oplog. Old versions are derived from the
+// new one because pre-images are not enabled.
+func (f *StoreMongo[T]) Watch(ctx context.Context, from string) (<-chan store.ChangeEvent[T], error) {
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if from != "" {
+		token, err := base64.RawURLEncoding.DecodeString(from)
+		if err != nil {
+			return nil, store.ErrInvalidCursor
+		}
+		opts.SetResumeAfter(bson.Raw(token))
+	}
+
+	stream, err := f.database.Collection(f.collectionName).Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	out := make(chan store.ChangeEvent[T])
+	go func() {
+		defer close(out)
+		defer stream.Close(context.Background())
+
+		for stream.Next(ctx) {
+			change := struct {
+				OperationType string `bson:"operationType"`
+				DocumentKey   struct {
+					Id string `bson:"_id"`
+				} `bson:"documentKey"`
+				FullDocument bson.Raw `bson:"fullDocument"`
+			}{}
+			if err := stream.Decode(&change); err != nil {
+				log.Printf("decoding change: %s\n", err.Error())
+				continue
+			}
+
+			event := store.ChangeEvent[T]{
+				Id:       change.DocumentKey.Id,
+				Position: base64.RawURLEncoding.EncodeToString(stream.ResumeToken()),
+			}
+			switch change.OperationType {
+			case "insert":
+				event.Op = store.ChangeInsert
+			case "update", "replace":
+				event.Op = store.ChangeUpdate
+			case "delete":
+				event.Op = store.ChangeDelete
+			default:
+				continue // drop, rename, invalidate...
+			}
+
+			if event.Op != store.ChangeDelete && change.FullDocument != nil {
+				var item *T
+				if err := bson.Unmarshal(change.FullDocument, &item); err != nil {
+					log.Printf("decoding changed item '%s': %s\n", event.Id, err.Error())
+					continue
+				}
+				event.Item = item
+				event.NewVersion = (*item).GetVersion()
+				if event.Op == store.ChangeUpdate {
+					event.OldVersion = event.NewVersion - 1
+				}
+			}
+
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := stream.Err(); err != nil && ctx.Err() == nil {
+			log.Printf("watching '%s': %s\n", f.collectionName, err.Error())
+		}
+	}()
+
+	return out, nil
+}
+
+func (f *StoreMongo[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+	result, err := f.database.Collection(f.collectionName).DeleteOne(ctx, bson.M{"_id": id, "version": version})
+	if err != nil {
+		return unavailable(err)
+	}
+	if result.DeletedCount > 0 {
+		return nil
+	}
+
+	// Nothing deleted, tell why
+	n, err := f.database.Collection(f.collectionName).CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return unavailable(err)
+	}
+	if n == 0 {
+		return store.ErrNotFound
+	}
+	return store.ErrVersionGone
+}
+
+// unavailable marks network and server selection errors with
+// store.ErrUnavailable
+func unavailable(err error) error {
+	var selectionErr topology.ServerSelectionError
+	if mongo.IsNetworkError(err) || errors.As(err, &selectionErr) {
+		return store.Unavailable(err)
+	}
 	return err
 }
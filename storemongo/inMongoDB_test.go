@@ -2,13 +2,17 @@ package storemongo
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/fulldump/biff"
 	"github.com/google/uuid"
+	"github.com/holacloud/store"
 	"github.com/holacloud/store/testutils"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -57,4 +61,159 @@ func TestMongodb(t *testing.T) {
 
 	testutils.SuitePersistencer(p, t)
 	testutils.SuiteOptimisticLocking(p, t)
+
+	t.Run("Pagination", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("test_items_pagination", connection)
+		biff.AssertNil(err)
+		testutils.SuitePagination(p, t)
+	})
+
+	t.Run("Querier", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("test_items_querier", connection)
+		biff.AssertNil(err)
+		testutils.SuiteQuerier(p, t)
+	})
+
+	t.Run("Iterable", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("test_items_iterable", connection)
+		biff.AssertNil(err)
+		testutils.SuiteIterable(p, t)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("test_items_batch", connection)
+		biff.AssertNil(err)
+		testutils.SuiteBatch(p, t)
+	})
+
+	t.Run("Transactor", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("test_items_transactor", connection)
+		biff.AssertNil(err)
+		testutils.SuiteTransactor(p, t)
+	})
+
+	t.Run("Watcher", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("test_items_watcher", connection)
+		biff.AssertNil(err)
+		testutils.SuiteWatcher(p, t)
+	})
+
+	t.Run("VersionDeleter", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("test_items_version_deleter", connection)
+		biff.AssertNil(err)
+		testutils.SuiteVersionDeleter(p, t)
+	})
+
+	t.Run("Aliasing", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("test_items_aliasing", connection)
+		biff.AssertNil(err)
+		testutils.SuiteAliasing(p, t)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		records, err := New[store.EncryptedRecord]("test_items_encrypted", connection)
+		biff.AssertNil(err)
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p := store.NewEncryptedStore[testutils.TestItem](records, keyring)
+		testutils.SuitePersistencer(p, t)
+	})
+
+	t.Run("FieldEncrypted", func(t *testing.T) {
+		raw, err := New[testutils.SecretItem]("test_items_field_encrypted", connection)
+		biff.AssertNil(err)
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p, err := store.NewFieldEncryptedStore[testutils.SecretItem](raw, keyring)
+		biff.AssertNil(err)
+		testutils.SuiteFieldEncryption(p, raw, t)
+	})
+
+	t.Run("UniqueConstraints", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("test_items_unique", connection, testutils.TestItemConstraints...)
+		biff.AssertNil(err)
+		testutils.SuiteUniqueConstraints(p, t)
+	})
+
+	t.Run("Watcher resume", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("test_items_watcher_resume", connection)
+		biff.AssertNil(err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := p.Watch(ctx, "")
+		biff.AssertNil(err)
+
+		biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("r-1")}))
+		first := <-events
+		biff.AssertEqual(first.Id, "r-1")
+		cancel()
+
+		// Changes while nobody is watching
+		biff.AssertNil(p.Put(context.Background(), &testutils.TestItem{Id: store.NewId("r-2")}))
+
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		events, err = p.Watch(ctx, first.Position)
+		biff.AssertNil(err)
+
+		second := <-events
+		biff.AssertEqual(second.Op, store.ChangeInsert)
+		biff.AssertEqual(second.Id, "r-2")
+	})
+}
+
+func TestMongodb_Unavailable(t *testing.T) {
+
+	p, err := New[testutils.TestItem]("test_items", "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=500")
+	biff.AssertNil(err)
+
+	_, err = p.Get(context.Background(), "1")
+	biff.AssertTrue(errors.Is(err, store.ErrUnavailable))
+}
+
+func TestMongodb_DuplicateError(t *testing.T) {
+
+	p := &StoreMongo[testutils.TestItem]{constraints: testutils.TestItemConstraints}
+
+	raw := func(keyPattern bson.D) bson.Raw {
+		data, err := bson.Marshal(bson.D{
+			{Key: "code", Value: 11000},
+			{Key: "errmsg", Value: "E11000 duplicate key error"},
+			{Key: "keyPattern", Value: keyPattern},
+		})
+		biff.AssertNil(err)
+		return data
+	}
+	description := raw(bson.D{{Key: "description", Value: 1}})
+	subitem := raw(bson.D{{Key: "subitems.0.field1", Value: 1}})
+	id := raw(bson.D{{Key: "_id", Value: 1}})
+
+	violated := func(err error, constraint string) {
+		var violation *store.UniqueViolationError
+		biff.AssertTrue(errors.As(err, &violation))
+		biff.AssertEqual(violation.Constraint, constraint)
+	}
+
+	violated(p.duplicateError(mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{{Code: 11000, Raw: description}},
+	}, store.ErrVersionGone), "unique_description")
+
+	violated(p.duplicateError(mongo.BulkWriteError{
+		WriteError: mongo.WriteError{Code: 11000, Raw: subitem},
+	}, store.ErrVersionGone), "unique_subitem")
+
+	violated(p.duplicateError(fmt.Errorf("commit: %w", mongo.CommandError{
+		Code: 11000, Raw: description,
+	}), store.ErrVersionGone), "unique_description")
+
+	err := p.duplicateError(mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{{Code: 11000, Raw: id}},
+	}, store.ErrAlreadyExists)
+	biff.AssertEqual(err, store.ErrAlreadyExists)
+
+	// Only the code tells it is a duplicated key
+	err = p.duplicateError(mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{{Code: 2, Raw: description}},
+	}, store.ErrVersionGone)
+	biff.AssertEqual(err, store.ErrVersionGone)
 }
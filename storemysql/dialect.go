@@ -0,0 +1,152 @@
+package storemysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/storesql"
+)
+
+// Dialect is the SQL of MySQL (8.0 or later) for storesql: record is a JSON
+// column and every unique constraint is an indexed generated column.
+//
+// There is no single statement for versioned upserts: ON DUPLICATE KEY UPDATE
+// also fires on the unique constraints, so rows are updated at their version
+// and inserted if missing, one by one.
+type Dialect struct{}
+
+var _ storesql.Dialect = Dialect{}
+
+func (Dialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (Dialect) Quote(name string) string {
+	return quoteIdentifier(name)
+}
+
+func (Dialect) JSON(p string) string {
+	return p
+}
+
+func (Dialect) EnsureTable(ctx context.Context, db *sql.DB, table string, constraints []store.UniqueConstraint) error {
+
+	// utf8mb4_bin compares ids in byte order, as the other stores do
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS `+quoteIdentifier(table)+` (
+		    id       VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin PRIMARY KEY,
+		    record   JSON NOT NULL,
+		    version  BIGINT NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range constraints {
+		index := table + "_" + c.Name
+
+		exists := 0
+		err := db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM information_schema.STATISTICS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?
+		`, table, index).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			continue
+		}
+
+		// JSON null and empty strings are NULL, that is not constrained
+		value := "JSON_EXTRACT(record, " + quoteLiteral(jsonPath(c.Path())) + ")"
+		_, err = db.ExecContext(ctx, `
+			ALTER TABLE `+quoteIdentifier(table)+`
+			ADD COLUMN `+quoteIdentifier(index)+` VARCHAR(768) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin
+			AS (CASE WHEN JSON_TYPE(`+value+`) = 'NULL' THEN NULL ELSE NULLIF(JSON_UNQUOTE(`+value+`), '') END) VIRTUAL,
+			ADD UNIQUE INDEX `+quoteIdentifier(index)+` (`+quoteIdentifier(index)+`)
+		`)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Upsert is not supported, see Dialect
+func (Dialect) Upsert(table string, rows []string) string {
+	return ""
+}
+
+// Insert fails with a duplicate of the primary key if id exists
+func (Dialect) Insert(table string, row string) string {
+	return `INSERT INTO ` + quoteIdentifier(table) + ` (id, record, version) VALUES ` + row
+}
+
+// InIds is a parameter per id
+func (Dialect) InIds(ids []string, arg func(v any) string) string {
+	return storesql.InList(ids, arg)
+}
+
+// DuplicateKey reads the index from the message of the error 1062, e.g.
+// "Duplicate entry 'a@b.c' for key 'people.people_email'"
+func (Dialect) DuplicateKey(table string, err error) (string, bool) {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1062 {
+		return "", false
+	}
+	i := strings.LastIndex(mysqlErr.Message, "for key '")
+	if i < 0 {
+		return "", false
+	}
+	index := strings.TrimSuffix(mysqlErr.Message[i+len("for key '"):], "'")
+	index = strings.TrimPrefix(index, table+".") // since MySQL 8.0.19
+	if index == "PRIMARY" {
+		return "", true
+	}
+	return index, true
+}
+
+// Error marks connection errors and lock wait timeouts with
+// store.ErrUnavailable. A deadlock rolls back the transaction because of a
+// concurrent one, that is store.ErrVersionGone.
+func (Dialect) Error(err error) error {
+	return unavailable(err)
+}
+
+func unavailable(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1213: // ER_LOCK_DEADLOCK
+			return fmt.Errorf("%w: %w", store.ErrVersionGone, err)
+		case 1205: // ER_LOCK_WAIT_TIMEOUT
+			return store.Unavailable(err)
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.As(err, &netErr) {
+		return store.Unavailable(err)
+	}
+	return err
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// quoteLiteral quotes a string literal, backslashes are escape characters in
+// MySQL literals
+func quoteLiteral(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return `'` + strings.ReplaceAll(value, `'`, `''`) + `'`
+}
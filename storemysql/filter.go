@@ -0,0 +1,152 @@
+package storemysql
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/holacloud/store"
+)
+
+// numberTypes are the names JSON_TYPE gives to numbers
+const numberTypes = "('INTEGER', 'UNSIGNED INTEGER', 'DOUBLE', 'DECIMAL')"
+
+// Condition compiles a filter on a field comparing JSON values, so values of
+// different types are never equal and objects are equal whatever the order of
+// their keys. Every condition evaluates to TRUE or FALSE (never NULL), so they
+// can be negated.
+func (Dialect) Condition(f store.Filter, arg func(v any) string) (string, error) {
+
+	field := fieldExpression(f.Field, arg)
+
+	switch f.Op {
+	case store.OpEq, store.OpNe:
+		condition, err := equals(field, f.Value, arg)
+		if err != nil {
+			return "", err
+		}
+		if f.Op == store.OpEq {
+			return condition, nil
+		}
+		return "(NOT " + condition + ")", nil
+
+	case store.OpIn:
+		if len(f.Values) == 0 {
+			return "FALSE", nil
+		}
+		conditions := []string{}
+		for _, v := range f.Values {
+			condition, err := equals(field, v, arg)
+			if err != nil {
+				return "", err
+			}
+			conditions = append(conditions, condition)
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")", nil
+
+	case store.OpExists:
+		if f.Value.(bool) {
+			return "(" + field.exists() + ")", nil
+		}
+		return "(NOT " + field.exists() + ")", nil
+
+	case store.OpLt, store.OpLte, store.OpGt, store.OpGte:
+		operator := map[store.Operator]string{
+			store.OpLt:  "<",
+			store.OpLte: "<=",
+			store.OpGt:  ">",
+			store.OpGte: ">=",
+		}[f.Op]
+		// JSON strings compare with utf8mb4_bin, that is byte order
+		guard := "IN " + numberTypes
+		if _, ok := f.Value.(string); ok {
+			guard = "= 'STRING'"
+		}
+		b, err := json.Marshal(f.Value)
+		if err != nil {
+			return "", err
+		}
+		return "(CASE WHEN JSON_TYPE(" + field.value() + ") " + guard + " THEN " + field.value() + " " + operator + " CAST(" + arg(string(b)) + " AS JSON) ELSE FALSE END)", nil
+	}
+
+	return "", fmt.Errorf("%w: unknown operator '%s'", store.ErrInvalidFilter, f.Op)
+}
+
+// equals returns the condition of field being equal to v
+func equals(field jsonField, v any, arg func(v any) string) (string, error) {
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return "IFNULL(" + field.value() + " = CAST(" + arg(string(b)) + " AS JSON), FALSE)", nil
+}
+
+// Sort returns the ORDER BY expressions of a field, the JSON type first to
+// follow store.SortBucket, then numbers and strings (byte order). MySQL sorts
+// NULL first ascending and last descending.
+func (Dialect) Sort(f store.SortField, arg func(v any) string) []string {
+
+	direction := " ASC"
+	if f.Desc {
+		direction = " DESC"
+	}
+	if f.Field == "id" {
+		return []string{"id" + direction}
+	}
+
+	field := fieldExpression(f.Field, arg)
+	bucket := "(CASE IFNULL(JSON_TYPE(" + field.value() + "), 'NULL')" +
+		" WHEN 'NULL' THEN 0 WHEN 'INTEGER' THEN 1 WHEN 'UNSIGNED INTEGER' THEN 1 WHEN 'DOUBLE' THEN 1 WHEN 'DECIMAL' THEN 1" +
+		" WHEN 'STRING' THEN 2 WHEN 'OBJECT' THEN 3 WHEN 'ARRAY' THEN 4 ELSE 5 END)"
+	number := "(CASE WHEN JSON_TYPE(" + field.value() + ") IN " + numberTypes + " THEN JSON_UNQUOTE(" + field.value() + ") + 0 END)"
+	text := "(CASE WHEN JSON_TYPE(" + field.value() + ") = 'STRING' THEN JSON_UNQUOTE(" + field.value() + ") END) COLLATE utf8mb4_bin"
+
+	return []string{bucket + direction, number + direction, text + direction}
+}
+
+// jsonField builds the expressions of a field. Every call adds its own query
+// parameters, MySQL placeholders are positional so they can not be reused.
+type jsonField struct {
+	value  func() string // the JSON value, NULL if missing
+	exists func() string // the condition of the field being present
+}
+
+// fieldExpression returns the expressions for a field path. id and version
+// live in their own columns, which are the reference.
+func fieldExpression(name string, arg func(v any) string) jsonField {
+	switch name {
+	case "id":
+		return jsonField{
+			value:  func() string { return "CAST(JSON_QUOTE(id) AS JSON)" },
+			exists: func() string { return "TRUE" },
+		}
+	case "version":
+		return jsonField{
+			value:  func() string { return "CAST(version AS JSON)" },
+			exists: func() string { return "TRUE" },
+		}
+	}
+	path := jsonPath(strings.Split(name, "."))
+	return jsonField{
+		value:  func() string { return "JSON_EXTRACT(record, " + arg(path) + ")" },
+		exists: func() string { return "JSON_CONTAINS_PATH(record, 'one', " + arg(path) + ")" },
+	}
+}
+
+// jsonPath converts a field path into a MySQL JSON path, numeric parts are
+// array indexes and the rest object keys
+func jsonPath(parts []string) string {
+	b := strings.Builder{}
+	b.WriteString("$")
+	for _, part := range parts {
+		if i, err := strconv.Atoi(part); err == nil && i >= 0 {
+			b.WriteString("[" + strconv.Itoa(i) + "]")
+			continue
+		}
+		b.WriteString(`."` + strings.ReplaceAll(part, `"`, `\"`) + `"`)
+	}
+	return b.String()
+}
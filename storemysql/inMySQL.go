@@ -0,0 +1,41 @@
+package storemysql
+
+import (
+	"database/sql"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/storesql"
+)
+
+// StoreMySQL keeps the items in a table with the columns id, record (JSON) and
+// version, see Dialect. Watch is not supported.
+type StoreMySQL[T store.Identifier] struct {
+	*storesql.StoreSQL[T]
+}
+
+// New connects to MySQL with a github.com/go-sql-driver/mysql DSN (e.g.
+// "user:password@tcp(localhost:3306)/dbname") and ensures the table. Every
+// unique constraint is an indexed generated column named <table>_<constraint
+// name>.
+func New[T store.Identifier](table, dsn string, constraints ...store.UniqueConstraint) (*StoreMySQL[T], error) {
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err // invalid dsn
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, unavailable(err) // can not reach mysql, retry?
+	}
+
+	s, err := storesql.New[T](db, Dialect{}, table, constraints...)
+	if err != nil {
+		db.Close()
+		return nil, err // could not create table
+	}
+
+	return &StoreMySQL[T]{StoreSQL: s}, nil
+}
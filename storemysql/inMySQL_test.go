@@ -0,0 +1,118 @@
+package storemysql
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+)
+
+func TestInMySQL(t *testing.T) {
+
+	host := ""
+	for _, h := range []string{"localhost", "mysql"} {
+
+		db, err := sql.Open("mysql", "root:mysecretpassword@tcp("+h+":3306)/")
+		if err != nil {
+			continue
+		}
+
+		err = db.Ping() // check if mysql is there
+		if err != nil {
+			db.Close()
+			continue
+		}
+
+		host = h
+		db.Close()
+		break
+	}
+
+	if host == "" {
+		t.Skipf("MySQL not available")
+	}
+
+	dbname := "test" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	db, err := sql.Open("mysql", "root:mysecretpassword@tcp("+host+":3306)/")
+	biff.AssertNil(err)
+	_, err = db.Exec("CREATE DATABASE " + dbname)
+	biff.AssertNil(err)
+	db.Close()
+
+	dsn := "root:mysecretpassword@tcp(" + host + ":3306)/" + dbname
+
+	p, err := New[testutils.TestItem]("mytable", dsn)
+	biff.AssertNil(err)
+	defer p.Close()
+
+	testutils.SuitePersistencer(p, t)
+	testutils.SuiteOptimisticLocking(p, t)
+
+	t.Run("Pagination", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_pagination", dsn)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuitePagination(p, t)
+	})
+
+	t.Run("Querier", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_querier", dsn)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteQuerier(p, t)
+	})
+
+	t.Run("Iterable", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_iterable", dsn)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteIterable(p, t)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_batch", dsn)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteBatch(p, t)
+	})
+
+	t.Run("Transactor", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_transactor", dsn)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteTransactor(p, t)
+	})
+
+	t.Run("VersionDeleter", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_version_deleter", dsn)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteVersionDeleter(p, t)
+	})
+
+	t.Run("Aliasing", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_aliasing", dsn)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteAliasing(p, t)
+	})
+
+	t.Run("UniqueConstraints", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_unique", dsn, testutils.TestItemConstraints...)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteUniqueConstraints(p, t)
+	})
+}
+
+func TestInMySQL_Unavailable(t *testing.T) {
+
+	_, err := New[testutils.TestItem]("mytable", "root:mysecretpassword@tcp(127.0.0.1:1)/test?timeout=1s")
+	biff.AssertTrue(errors.Is(err, store.ErrUnavailable))
+}
@@ -0,0 +1,141 @@
+package storepostgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/storesql"
+	"github.com/lib/pq"
+)
+
+// Dialect is the SQL of postgres for storesql: record is jsonb, unique
+// constraints are expression indexes and a trigger notifies the changes (see
+// Watch).
+type Dialect struct{}
+
+var _ storesql.Dialect = Dialect{}
+
+func (Dialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (Dialect) Quote(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+func (Dialect) JSON(p string) string {
+	return p + "::jsonb"
+}
+
+func (Dialect) EnsureTable(ctx context.Context, db *sql.DB, table string, constraints []store.UniqueConstraint) error {
+
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS `+pq.QuoteIdentifier(table)+` (
+		    id       VARCHAR(36) PRIMARY KEY,
+		    record   JSONB,
+		    version  bigint
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// ensure trigger to notify changes (see Watch)
+	_, err = db.ExecContext(ctx, `
+		CREATE OR REPLACE FUNCTION `+pq.QuoteIdentifier(table+"_notify")+`() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_notify(`+pq.QuoteLiteral(table+"_changes")+`, json_build_object(
+				'op',          lower(TG_OP),
+				'id',          COALESCE(NEW.id, OLD.id),
+				'old_version', OLD.version,
+				'new_version', NEW.version
+			)::text);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		CREATE OR REPLACE TRIGGER `+pq.QuoteIdentifier(table+"_notify")+`
+		AFTER INSERT OR UPDATE OR DELETE ON `+pq.QuoteIdentifier(table)+`
+		FOR EACH ROW EXECUTE FUNCTION `+pq.QuoteIdentifier(table+"_notify")+`();
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range constraints {
+		_, err = db.ExecContext(ctx, `
+			CREATE UNIQUE INDEX IF NOT EXISTS `+pq.QuoteIdentifier(table+"_"+c.Name)+`
+			ON `+pq.QuoteIdentifier(table)+` ((NULLIF(record #>> `+pq.QuoteLiteral(textArray(c.Path()))+`, '')));
+		`)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (Dialect) Upsert(table string, rows []string) string {
+	return `
+		INSERT INTO ` + pq.QuoteIdentifier(table) + ` (id, record, version) VALUES ` + strings.Join(rows, ", ") + `
+		ON CONFLICT (id)
+		DO UPDATE SET record = EXCLUDED.record, version = EXCLUDED.version WHERE ` + pq.QuoteIdentifier(table) + `.version = EXCLUDED.version - 1
+		RETURNING id
+	`
+}
+
+func (Dialect) Insert(table string, row string) string {
+	return `
+		INSERT INTO ` + pq.QuoteIdentifier(table) + ` (id, record, version) VALUES ` + row + `
+		ON CONFLICT (id) DO NOTHING
+	`
+}
+
+// InIds sends the ids as a single array parameter
+func (Dialect) InIds(ids []string, arg func(v any) string) string {
+	return "id = ANY(" + arg(pq.Array(ids)) + ")"
+}
+
+// DuplicateKey reads the index from the error code 23505, the primary key is
+// the constraint <table>_pkey
+func (Dialect) DuplicateKey(table string, err error) (string, bool) {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return "", false
+	}
+	if pqErr.Constraint == table+"_pkey" {
+		return "", true
+	}
+	return pqErr.Constraint, true
+}
+
+// Error marks connection errors with store.ErrUnavailable
+func (Dialect) Error(err error) error {
+	return unavailable(err)
+}
+
+// unavailable marks connection errors with store.ErrUnavailable
+func unavailable(err error) error {
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr) {
+		return store.Unavailable(err)
+	}
+	return err
+}
+
+// textArray formats a postgres text[] literal
+func textArray(values []string) string {
+	quoted := []string{}
+	for _, v := range values {
+		v = strings.ReplaceAll(v, `\`, `\\`)
+		v = strings.ReplaceAll(v, `"`, `\"`)
+		quoted = append(quoted, `"`+v+`"`)
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
@@ -0,0 +1,110 @@
+package storepostgres
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/holacloud/store"
+	"github.com/lib/pq"
+)
+
+// Condition compiles a filter on a field, comparing jsonb values so values of
+// different types are never equal.
+func (Dialect) Condition(f store.Filter, arg func(v any) string) (string, error) {
+
+	field := fieldExpression(f.Field, arg)
+
+	jsonArg := func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return arg(string(b)) + "::jsonb", nil
+	}
+
+	switch f.Op {
+	case store.OpEq, store.OpNe:
+		value, err := jsonArg(f.Value)
+		if err != nil {
+			return "", err
+		}
+		if f.Op == store.OpEq {
+			return "(" + field + " = " + value + ")", nil
+		}
+		return "(" + field + " IS DISTINCT FROM " + value + ")", nil
+
+	case store.OpIn:
+		if len(f.Values) == 0 {
+			return "FALSE", nil
+		}
+		values := []string{}
+		for _, v := range f.Values {
+			value, err := jsonArg(v)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return "(" + field + " IN (" + strings.Join(values, ", ") + "))", nil
+
+	case store.OpExists:
+		if f.Value.(bool) {
+			return "(" + field + " IS NOT NULL)", nil
+		}
+		return "(" + field + " IS NULL)", nil
+
+	case store.OpLt, store.OpLte, store.OpGt, store.OpGte:
+		operator := map[store.Operator]string{
+			store.OpLt:  "<",
+			store.OpLte: "<=",
+			store.OpGt:  ">",
+			store.OpGte: ">=",
+		}[f.Op]
+		// CASE guarantees the cast is only evaluated for the right type
+		if s, ok := f.Value.(string); ok {
+			return "(CASE WHEN jsonb_typeof(" + field + ") = 'string' THEN (" + field + " #>> '{}') COLLATE \"C\" " + operator + " " + arg(s) + " COLLATE \"C\" ELSE FALSE END)", nil
+		}
+		b, err := json.Marshal(f.Value)
+		if err != nil {
+			return "", err
+		}
+		return "(CASE WHEN jsonb_typeof(" + field + ") = 'number' THEN (" + field + " #>> '{}')::numeric " + operator + " " + arg(string(b)) + "::numeric ELSE FALSE END)", nil
+	}
+
+	return "", fmt.Errorf("%w: unknown operator '%s'", store.ErrInvalidFilter, f.Op)
+}
+
+// Sort returns the ORDER BY expressions of a field, the jsonb type first to
+// follow store.SortBucket, then numbers and strings (byte order).
+func (Dialect) Sort(f store.SortField, arg func(v any) string) []string {
+
+	direction := " ASC NULLS FIRST"
+	if f.Desc {
+		direction = " DESC NULLS LAST"
+	}
+	if f.Field == "id" {
+		return []string{"id COLLATE \"C\"" + direction}
+	}
+
+	field := fieldExpression(f.Field, arg)
+	bucket := "(CASE COALESCE(jsonb_typeof(" + field + "), 'null')" +
+		" WHEN 'null' THEN 0 WHEN 'number' THEN 1 WHEN 'string' THEN 2" +
+		" WHEN 'object' THEN 3 WHEN 'array' THEN 4 WHEN 'boolean' THEN 5 END)"
+	number := "(CASE WHEN jsonb_typeof(" + field + ") = 'number' THEN (" + field + " #>> '{}')::numeric END)"
+	text := "(CASE WHEN jsonb_typeof(" + field + ") = 'string' THEN (" + field + " #>> '{}') END) COLLATE \"C\""
+
+	return []string{bucket + direction, number + direction, text + direction}
+}
+
+// fieldExpression returns the jsonb expression for a field path. id and
+// version live in their own columns, which are the reference.
+func fieldExpression(field string, arg func(v any) string) string {
+	switch field {
+	case "id":
+		return "to_jsonb(id)"
+	case "version":
+		return "to_jsonb(version)"
+	}
+	return "(record #> " + arg(pq.Array(strings.Split(field, "."))) + "::text[])"
+}
@@ -4,23 +4,30 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"log"
 	"strings"
+	"time"
 
 	"github.com/holacloud/store"
-	_ "github.com/lib/pq"
+	"github.com/holacloud/store/storesql"
+	"github.com/lib/pq"
 )
 
+// StorePostgres keeps the items in a table with the columns id, record
+// (jsonb) and version, see Dialect. Changes can be watched.
 type StorePostgres[T store.Identifier] struct {
+	*storesql.StoreSQL[T]
 	table      string
 	connection string
-	db         *sql.DB
 }
 
-func New[T store.Identifier](table, connection string) (*StorePostgres[T], error) {
+// New connects to postgres and ensures the table. Every unique constraint is
+// a unique expression index named <table>_<constraint name>.
+func New[T store.Identifier](table, connection string, constraints ...store.UniqueConstraint) (*StorePostgres[T], error) {
 
 	db, err := sql.Open("postgres", connection)
 	if err != nil {
-		return nil, err // can not reach postgres, retry?
+		return nil, unavailable(err) // can not reach postgres, retry?
 	}
 
 	err = db.Ping() // check if db exists
@@ -34,41 +41,34 @@ func New[T store.Identifier](table, connection string) (*StorePostgres[T], error
 
 		dbPostgres, err := sql.Open("postgres", connectionPostgres)
 		if err != nil {
-			return nil, err // could not connect as postgres
+			return nil, unavailable(err) // could not connect as postgres
 		}
 
 		_, err = dbPostgres.Exec("create database " + dbname)
 		if err != nil {
-			return nil, err // could not create database
+			return nil, unavailable(err) // could not create database
 		}
 
 		// Connect again with previous connection string
 		db, err = sql.Open("postgres", connection)
 		if err != nil {
-			return nil, err // can not reach postgres, retry?
+			return nil, unavailable(err) // can not reach postgres, retry?
 		}
 
 		err = db.Ping() // check if db exists
 		if err != nil {
-			return nil, err // could not connecto to new database
+			return nil, unavailable(err) // could not connecto to new database
 		}
 	}
 
-	// ensure table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS "` + table + `" (
-		    id       VARCHAR(36) PRIMARY KEY,
-		    record   JSONB,
-		    version  bigint
-		);
-	`)
+	s, err := storesql.New[T](db, Dialect{}, table, constraints...)
 	if err != nil {
-		return nil, err // could not create database
+		return nil, err // could not create table
 	}
 
 	return &StorePostgres[T]{
+		StoreSQL:   s,
 		table:      table,
-		db:         db,
 		connection: connection,
 	}, nil
 }
@@ -100,100 +100,75 @@ func parseConnection(connection string) map[string]string {
 	return result
 }
 
-func (f *StorePostgres[T]) List(ctx context.Context) ([]*T, error) {
+// Watch uses LISTEN/NOTIFY on the channel fed by the trigger created in New.
+// Notifications are not durable so resume is not supported, and changes done
+// while the listener is reconnecting are lost. The item is read when the
+// notification arrives, so it may be newer than NewVersion.
+func (f *StorePostgres[T]) Watch(ctx context.Context, from string) (<-chan store.ChangeEvent[T], error) {
 
-	rows, err := f.db.QueryContext(ctx, `SELECT id, record, version FROM "`+f.table+`";`)
-	if err != nil {
-		return nil, err
-	}
-
-	result := []*T{}
-	for rows.Next() {
-		id := []byte{}
-		record := []byte{}
-		version := int64(0)
-		err := rows.Scan(&id, &record, &version)
-		if err != nil {
-			return nil, err
-		}
-
-		var item *T
-		err = json.Unmarshal(record, &item)
-		if err != nil {
-			return nil, err
-		}
-		(*item).SetVersion(version)
-		result = append(result, item)
-	}
-
-	return result, nil
-}
-
-func (f *StorePostgres[T]) Put(ctx context.Context, item *T) error {
-
-	itemJson, err := json.Marshal(item)
-	if err != nil {
-		return err
+	if from != "" {
+		return nil, store.ErrResumeNotSupported
 	}
 
-	itemVersion := (*item).GetVersion()
-	result, err := f.db.ExecContext(ctx, `
-		INSERT INTO "`+f.table+`" (id, record, version) VALUES ($1, $2::jsonb, $4)
-		ON CONFLICT (ID)
-		DO UPDATE SET record = $2, version = $4 WHERE `+f.table+`.version = $3
-	`, (*item).GetId(), string(itemJson), itemVersion, itemVersion+1)
-	if err != nil {
-		return err
-	}
-
-	n, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
-	if n == 0 {
-		return store.ErrVersionGone
-	}
-
-	(*item).SetVersion(itemVersion + 1)
-
-	return nil
-}
-
-func (f *StorePostgres[T]) Get(ctx context.Context, id string) (*T, error) {
-
-	row := f.db.QueryRowContext(ctx, `
-		SELECT  record, version FROM "`+f.table+`" WHERE id = $1;
-	`, id)
-
-	record := []byte{}
-	version := int64(0)
-	err := row.Scan(&record, &version)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
-	if err != nil {
+	listener := pq.NewListener(f.connection, time.Second, time.Minute, nil)
+	if err := listener.Listen(f.table + "_changes"); err != nil {
+		listener.Close()
 		return nil, err
 	}
 
-	var item *T
-	err = json.Unmarshal(record, &item)
-	if err != nil {
-		return nil, err
-	}
-	(*item).SetVersion(version)
-
-	return item, nil
-}
-
-func (f *StorePostgres[T]) Delete(ctx context.Context, id string) error {
-
-	_, err := f.db.ExecContext(ctx, `
-		DELETE FROM "`+f.table+`" 
-		WHERE id = $1;
-	`, id)
-	if err != nil {
-		return err
-	}
+	out := make(chan store.ChangeEvent[T])
+	go func() {
+		defer close(out)
+		defer listener.Close()
+
+		for {
+			var notification *pq.Notification
+			select {
+			case <-ctx.Done():
+				return
+			case notification = <-listener.Notify:
+			}
+			if notification == nil {
+				continue // connection re-established
+			}
+
+			payload := struct {
+				Op         store.ChangeOp `json:"op"`
+				Id         string         `json:"id"`
+				OldVersion *int64         `json:"old_version"`
+				NewVersion *int64         `json:"new_version"`
+			}{}
+			if err := json.Unmarshal([]byte(notification.Extra), &payload); err != nil {
+				log.Printf("decoding notification '%s': %s\n", notification.Extra, err.Error())
+				continue
+			}
+
+			event := store.ChangeEvent[T]{
+				Op: payload.Op,
+				Id: payload.Id,
+			}
+			if payload.OldVersion != nil {
+				event.OldVersion = *payload.OldVersion
+			}
+			if payload.NewVersion != nil {
+				event.NewVersion = *payload.NewVersion
+			}
+			if event.Op != store.ChangeDelete {
+				item, err := f.Get(ctx, event.Id)
+				if err != nil {
+					log.Printf("reading changed item '%s': %s\n", event.Id, err.Error())
+					continue
+				}
+				event.Item = item // nil if deleted meanwhile
+			}
+
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
-	return nil
+	return out, nil
 }
@@ -2,11 +2,13 @@ package storepostgres
 
 import (
 	"database/sql"
+	"errors"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
 	"github.com/holacloud/store/testutils"
 )
 
@@ -35,9 +37,90 @@ func TestInPostgres(t *testing.T) {
 
 	dbname := "test" + strconv.FormatInt(time.Now().UnixNano(), 10)
 
-	p, err := New[testutils.TestItem]("mytable", "host="+host+" port=5432 user=postgres password=mysecretpassword dbname="+dbname+" sslmode=disable")
+	connection := "host=" + host + " port=5432 user=postgres password=mysecretpassword dbname=" + dbname + " sslmode=disable"
+
+	p, err := New[testutils.TestItem]("mytable", connection)
 	biff.AssertNil(err)
 
 	testutils.SuitePersistencer(p, t)
 	testutils.SuiteOptimisticLocking(p, t)
+
+	t.Run("Pagination", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_pagination", connection)
+		biff.AssertNil(err)
+		testutils.SuitePagination(p, t)
+	})
+
+	t.Run("Querier", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_querier", connection)
+		biff.AssertNil(err)
+		testutils.SuiteQuerier(p, t)
+	})
+
+	t.Run("Iterable", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_iterable", connection)
+		biff.AssertNil(err)
+		testutils.SuiteIterable(p, t)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_batch", connection)
+		biff.AssertNil(err)
+		testutils.SuiteBatch(p, t)
+	})
+
+	t.Run("Transactor", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_transactor", connection)
+		biff.AssertNil(err)
+		testutils.SuiteTransactor(p, t)
+	})
+
+	t.Run("Watcher", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_watcher", connection)
+		biff.AssertNil(err)
+		testutils.SuiteWatcher(p, t)
+	})
+
+	t.Run("VersionDeleter", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_version_deleter", connection)
+		biff.AssertNil(err)
+		testutils.SuiteVersionDeleter(p, t)
+	})
+
+	t.Run("Aliasing", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_aliasing", connection)
+		biff.AssertNil(err)
+		testutils.SuiteAliasing(p, t)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		records, err := New[store.EncryptedRecord]("mytable_encrypted", connection)
+		biff.AssertNil(err)
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p := store.NewEncryptedStore[testutils.TestItem](records, keyring)
+		testutils.SuitePersistencer(p, t)
+	})
+
+	t.Run("FieldEncrypted", func(t *testing.T) {
+		raw, err := New[testutils.SecretItem]("mytable_field_encrypted", connection)
+		biff.AssertNil(err)
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p, err := store.NewFieldEncryptedStore[testutils.SecretItem](raw, keyring)
+		biff.AssertNil(err)
+		testutils.SuiteFieldEncryption(p, raw, t)
+	})
+
+	t.Run("UniqueConstraints", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_unique", connection, testutils.TestItemConstraints...)
+		biff.AssertNil(err)
+		testutils.SuiteUniqueConstraints(p, t)
+	})
+}
+
+func TestInPostgres_Unavailable(t *testing.T) {
+
+	_, err := New[testutils.TestItem]("mytable", "host=127.0.0.1 port=1 user=postgres password=mysecretpassword dbname=postgres sslmode=disable connect_timeout=1")
+	biff.AssertTrue(errors.Is(err, store.ErrUnavailable))
 }
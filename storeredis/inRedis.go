@@ -0,0 +1,640 @@
+package storeredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/holacloud/store"
+	"github.com/redis/go-redis/v9"
+)
+
+// StoreRedis keeps every item in a hash at prefix+id with two fields: version
+// and data (the encoded item). Writes check versions atomically in Lua
+// scripts. With Redis Cluster the keys of a transaction must be in the same
+// slot, e.g. with a hash tag in the prefix like "{items}:". Iterate scans
+// every master of the cluster.
+type StoreRedis[T store.Identifier] struct {
+	client redis.UniversalClient
+	prefix string
+	codec  store.Codec
+}
+
+// scanCount is the number of keys asked to every SCAN of Iterate
+const scanCount = 100
+
+// putScript stores the item if it is missing or still at the expected
+// version, it returns 1 if stored and 0 otherwise.
+// KEYS: item. ARGV: expected version, new version, data.
+var putScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'version')
+if current and current ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'version', ARGV[2], 'data', ARGV[3])
+return 1
+`)
+
+// createScript stores the item at version 1 if it is missing, it returns 1
+// if stored and 0 otherwise.
+// KEYS: item. ARGV: data.
+var createScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'version', '1', 'data', ARGV[1])
+return 1
+`)
+
+// updateScript stores the item if it is still at the expected version, it
+// returns 1 if stored, 0 if the version is gone and -1 if missing.
+// KEYS: item. ARGV: expected version, new version, data.
+var updateScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'version')
+if not current then
+	return -1
+end
+if current ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'version', ARGV[2], 'data', ARGV[3])
+return 1
+`)
+
+// deleteVersionScript deletes the item if it is still at the expected
+// version, it returns 1 if deleted, 0 if the version is gone and -1 if
+// missing.
+// KEYS: item. ARGV: expected version.
+var deleteVersionScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'version')
+if not current then
+	return -1
+end
+if current ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// commitScript applies the writes of a transaction if all the items are
+// still at the versions read (empty if missing), it returns 1 if applied and 0
+// otherwise.
+// KEYS: items. ARGV, four per item: version read, operation (put, delete or
+// check), new version, data.
+var commitScript = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+	local current = redis.call('HGET', key, 'version') or ''
+	if current ~= ARGV[4*i-3] then
+		return 0
+	end
+end
+for i, key in ipairs(KEYS) do
+	local operation = ARGV[4*i-2]
+	if operation == 'put' then
+		redis.call('HSET', key, 'version', ARGV[4*i-1], 'data', ARGV[4*i])
+	elseif operation == 'delete' then
+		redis.call('DEL', key)
+	end
+end
+return 1
+`)
+
+// New returns a store keeping the items under prefix, it checks the server
+// can be reached
+func New[T store.Identifier](client redis.UniversalClient, prefix string) (*StoreRedis[T], error) {
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, store.Unavailable(err)
+	}
+
+	return &StoreRedis[T]{
+		client: client,
+		prefix: prefix,
+		codec:  store.JSONCodec{},
+	}, nil
+}
+
+// SetCodec changes how items are encoded. It must be called before the store
+// is used.
+func (f *StoreRedis[T]) SetCodec(codec store.Codec) {
+	f.codec = codec
+}
+
+// unavailable marks the errors of the connection with store.ErrUnavailable,
+// errors replied by the server and context errors are kept as they are
+func unavailable(err error) error {
+	if err == nil || err == redis.Nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		return err
+	}
+	return store.Unavailable(err)
+}
+
+func (f *StoreRedis[T]) key(id string) string {
+	return f.prefix + id
+}
+
+// pattern matches the keys of the store in SCAN
+func (f *StoreRedis[T]) pattern() string {
+	b := strings.Builder{}
+	for _, c := range f.prefix {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteString("*")
+	return b.String()
+}
+
+// decode returns the item of the version and data fields, nil if the item
+// is missing
+func (f *StoreRedis[T]) decode(fields []any) (*T, error) {
+	if len(fields) != 2 || fields[0] == nil || fields[1] == nil {
+		return nil, nil
+	}
+	versionField, _ := fields[0].(string)
+	data, _ := fields[1].(string)
+
+	version, err := strconv.ParseInt(versionField, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad version: %w", err)
+	}
+
+	var item *T
+	if err := f.codec.Unmarshal([]byte(data), &item); err != nil {
+		return nil, err
+	}
+	(*item).SetVersion(version)
+
+	return item, nil
+}
+
+// encode returns the data of item at version
+func (f *StoreRedis[T]) encode(item *T, version int64) (string, error) {
+	current := (*item).GetVersion()
+	(*item).SetVersion(version)
+	data, err := f.codec.Marshal(item)
+	(*item).SetVersion(current) // restore until it is stored
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// getKeys reads the items of keys with a single round trip, nil for the
+// missing ones
+func (f *StoreRedis[T]) getKeys(ctx context.Context, keys []string) ([]*T, error) {
+
+	if len(keys) == 0 {
+		return []*T{}, nil
+	}
+
+	pipe := f.client.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HMGet(ctx, key, "version", "data")
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, unavailable(err)
+	}
+
+	result := make([]*T, len(keys))
+	for i, cmd := range cmds {
+		item, err := f.decode(cmd.Val())
+		if err != nil {
+			return nil, fmt.Errorf("item '%s': %w", keys[i], err)
+		}
+		result[i] = item
+	}
+
+	return result, nil
+}
+
+// List reads the items with Iterate
+func (f *StoreRedis[T]) List(ctx context.Context) ([]*T, error) {
+
+	result := []*T{}
+	for item, err := range f.Iterate(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+func (f *StoreRedis[T]) Find(ctx context.Context, filter store.Filter, sort ...store.SortField) ([]*T, error) {
+
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := store.ValidateSort(sort); err != nil {
+		return nil, err
+	}
+
+	items, err := f.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err = store.FilterItems(items, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, store.SortItems(items, sort)
+}
+
+// Iterate streams the items with SCAN over the prefix, in no particular
+// order. Like SCAN, items written meanwhile may or may not be yielded. The ids
+// yielded are kept to skip the keys SCAN returns more than once. With Redis
+// Cluster every master is scanned, one after the other.
+func (f *StoreRedis[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+
+		nodes, err := f.nodes(ctx)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		seen := map[string]bool{}
+		for _, node := range nodes {
+			if !f.scan(ctx, node, seen, yield) {
+				return
+			}
+		}
+	}
+}
+
+// nodes returns the clients to scan: every master of a cluster, otherwise
+// the client itself
+func (f *StoreRedis[T]) nodes(ctx context.Context) ([]redis.UniversalClient, error) {
+
+	cluster, ok := f.client.(*redis.ClusterClient)
+	if !ok {
+		return []redis.UniversalClient{f.client}, nil
+	}
+
+	mutex := sync.Mutex{}
+	nodes := []redis.UniversalClient{}
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		nodes = append(nodes, master)
+		return nil
+	})
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	return nodes, nil
+}
+
+// scan yields the items of node not seen yet, it returns false if the
+// iteration is over
+func (f *StoreRedis[T]) scan(ctx context.Context, node redis.UniversalClient, seen map[string]bool, yield func(*T, error) bool) bool {
+
+	cursor := uint64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			yield(nil, err)
+			return false
+		}
+
+		keys, next, err := node.Scan(ctx, cursor, f.pattern(), scanCount).Result()
+		if err != nil {
+			yield(nil, unavailable(err))
+			return false
+		}
+
+		pending := []string{}
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				pending = append(pending, key)
+			}
+		}
+		items, err := f.getKeys(ctx, pending)
+		if err != nil {
+			yield(nil, err)
+			return false
+		}
+		for _, item := range items {
+			if item == nil {
+				continue // deleted meanwhile
+			}
+			if !yield(item, nil) {
+				return false
+			}
+		}
+
+		if next == 0 {
+			return true
+		}
+		cursor = next
+	}
+}
+
+func (f *StoreRedis[T]) Put(ctx context.Context, item *T) error {
+
+	version := (*item).GetVersion()
+	data, err := f.encode(item, version+1)
+	if err != nil {
+		return err
+	}
+
+	stored, err := putScript.Run(ctx, f.client, []string{f.key((*item).GetId())}, version, version+1, data).Int()
+	if err != nil {
+		return unavailable(err)
+	}
+	if stored == 0 {
+		return store.ErrVersionGone
+	}
+
+	(*item).SetVersion(version + 1)
+
+	return nil
+}
+
+func (f *StoreRedis[T]) Create(ctx context.Context, item *T) error {
+
+	data, err := f.encode(item, 1)
+	if err != nil {
+		return err
+	}
+
+	stored, err := createScript.Run(ctx, f.client, []string{f.key((*item).GetId())}, data).Int()
+	if err != nil {
+		return unavailable(err)
+	}
+	if stored == 0 {
+		return store.ErrAlreadyExists
+	}
+
+	(*item).SetVersion(1)
+
+	return nil
+}
+
+func (f *StoreRedis[T]) Update(ctx context.Context, item *T) error {
+
+	version := (*item).GetVersion()
+	data, err := f.encode(item, version+1)
+	if err != nil {
+		return err
+	}
+
+	stored, err := updateScript.Run(ctx, f.client, []string{f.key((*item).GetId())}, version, version+1, data).Int()
+	if err != nil {
+		return unavailable(err)
+	}
+	switch stored {
+	case -1:
+		return store.ErrNotFound
+	case 0:
+		return store.ErrVersionGone
+	}
+
+	(*item).SetVersion(version + 1)
+
+	return nil
+}
+
+// PutMany runs the script of Put for every item with a single round trip
+func (f *StoreRedis[T]) PutMany(ctx context.Context, items []*T) error {
+
+	errs := store.DuplicatedIds(items)
+
+	calls := []scriptCall{}
+	positions := []int{}
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+		version := (*item).GetVersion()
+		data, err := f.encode(item, version+1)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		calls = append(calls, scriptCall{
+			keys: []string{f.key((*item).GetId())},
+			args: []any{version, version + 1, data},
+		})
+		positions = append(positions, i)
+	}
+
+	cmds, err := f.runPipelined(ctx, putScript, calls)
+	if err != nil {
+		return err
+	}
+
+	for j, cmd := range cmds {
+		i := positions[j]
+		stored, err := cmd.Int()
+		if err != nil {
+			errs[i] = unavailable(err)
+			continue
+		}
+		if stored == 0 {
+			errs[i] = store.ErrVersionGone
+			continue
+		}
+		(*items[i]).SetVersion((*items[i]).GetVersion() + 1)
+	}
+
+	return store.NewBatchError(errs)
+}
+
+type scriptCall struct {
+	keys []string
+	args []any
+}
+
+// runPipelined runs script once per call with a single round trip, loading
+// it if the server does not have it (e.g. after a restart)
+func (f *StoreRedis[T]) runPipelined(ctx context.Context, script *redis.Script, calls []scriptCall) ([]*redis.Cmd, error) {
+
+	cmds := make([]*redis.Cmd, len(calls))
+	pending := make([]int, len(calls))
+	for i := range calls {
+		pending[i] = i
+	}
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		pipe := f.client.Pipeline()
+		for _, i := range pending {
+			cmds[i] = script.EvalSha(ctx, pipe, calls[i].keys, calls[i].args...)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			var redisErr redis.Error
+			if !errors.As(err, &redisErr) {
+				return nil, unavailable(err)
+			}
+			// the errors replied (e.g. NOSCRIPT) are in the cmd of each call
+		}
+
+		missing := []int{}
+		for _, i := range pending {
+			if redis.HasErrorPrefix(cmds[i].Err(), "NOSCRIPT") {
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 || attempt > 0 {
+			break
+		}
+		if err := script.Load(ctx, f.client).Err(); err != nil {
+			return nil, unavailable(err)
+		}
+		pending = missing
+	}
+
+	return cmds, nil
+}
+
+func (f *StoreRedis[T]) Get(ctx context.Context, id string) (*T, error) {
+
+	fields, err := f.client.HMGet(ctx, f.key(id), "version", "data").Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	item, err := f.decode(fields)
+	if err != nil {
+		return nil, fmt.Errorf("item '%s': %w", id, err)
+	}
+
+	return item, nil
+}
+
+func (f *StoreRedis[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = f.key(id)
+	}
+
+	return f.getKeys(ctx, keys)
+}
+
+func (f *StoreRedis[T]) Delete(ctx context.Context, id string) error {
+	return unavailable(f.client.Del(ctx, f.key(id)).Err())
+}
+
+// DeleteMany deletes the keys one by one with a single round trip, so they
+// do not need to be in the same slot of a cluster
+func (f *StoreRedis[T]) DeleteMany(ctx context.Context, ids []string) error {
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	pipe := f.client.Pipeline()
+	for _, id := range ids {
+		pipe.Del(ctx, f.key(id))
+	}
+	_, err := pipe.Exec(ctx)
+
+	return unavailable(err)
+}
+
+func (f *StoreRedis[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+
+	deleted, err := deleteVersionScript.Run(ctx, f.client, []string{f.key(id)}, version).Int()
+	if err != nil {
+		return unavailable(err)
+	}
+	switch deleted {
+	case -1:
+		return store.ErrNotFound
+	case 0:
+		return store.ErrVersionGone
+	}
+
+	return nil
+}
+
+// WithTx stages the writes of fn (see store.Stage) and applies them with a
+// script that checks first that none of the items has changed since they
+// were read.
+func (f *StoreRedis[T]) WithTx(ctx context.Context, fn func(tx store.Storer[T]) error) error {
+
+	staged, err := store.Stage[T](f, f.codec, fn)
+	if err != nil {
+		return err
+	}
+
+	ids := staged.Ids()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	currents, err := f.GetMany(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	puts, deletes := staged.Writes()
+	operations := map[string]string{}
+	putItems := map[string]*T{}
+	for _, item := range puts {
+		operations[(*item).GetId()] = "put"
+		putItems[(*item).GetId()] = item
+	}
+	for _, id := range deletes {
+		operations[id] = "delete"
+	}
+
+	keys := make([]string, len(ids))
+	args := []any{}
+	for i, id := range ids {
+		current := currents[i]
+		if staged.Changed(id, current) {
+			return store.ErrVersionGone
+		}
+
+		read := ""
+		if current != nil {
+			read = strconv.FormatInt((*current).GetVersion(), 10)
+		}
+
+		operation, ok := operations[id]
+		if !ok {
+			operation = "check"
+		}
+
+		version, data := int64(0), ""
+		if item := putItems[id]; item != nil {
+			version = (*item).GetVersion()
+			data, err = f.encode(item, version)
+			if err != nil {
+				return err
+			}
+		}
+
+		keys[i] = f.key(id)
+		args = append(args, read, operation, version, data)
+	}
+
+	applied, err := commitScript.Run(ctx, f.client, keys, args...).Int()
+	if err != nil {
+		return unavailable(err)
+	}
+	if applied == 0 {
+		return store.ErrVersionGone
+	}
+
+	staged.Committed()
+	return nil
+}
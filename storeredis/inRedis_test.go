@@ -0,0 +1,221 @@
+package storeredis
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+	"github.com/redis/go-redis/v9"
+)
+
+// newServer launches a redis-server if it is installed, otherwise an
+// in-process fake, and returns its address
+func newServer(t *testing.T) string {
+
+	binary, err := exec.LookPath("redis-server")
+	if err != nil {
+		return miniredis.RunT(t).Addr()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	biff.AssertNil(err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	server := exec.Command(binary, "--port", strconv.Itoa(port), "--bind", "127.0.0.1", "--save", "", "--appendonly", "no")
+	biff.AssertNil(server.Start())
+	t.Cleanup(func() {
+		server.Process.Kill()
+		server.Wait()
+	})
+
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+	for i := 0; client.Ping(context.Background()).Err() != nil; i++ {
+		if i == 50 {
+			t.Fatalf("redis-server not ready at %s", addr)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return addr
+}
+
+func newClient(t *testing.T, addr string) *redis.Client {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+func TestInRedis(t *testing.T) {
+
+	client := newClient(t, newServer(t))
+
+	p, err := New[testutils.TestItem](client, "items:")
+	biff.AssertNil(err)
+
+	testutils.SuitePersistencer(p, t)
+	testutils.SuiteOptimisticLocking(p, t)
+
+	t.Run("Querier", func(t *testing.T) {
+		p, err := New[testutils.TestItem](client, "querier:")
+		biff.AssertNil(err)
+		testutils.SuiteQuerier(p, t)
+	})
+
+	t.Run("Iterable", func(t *testing.T) {
+		p, err := New[testutils.TestItem](client, "iterable:")
+		biff.AssertNil(err)
+		testutils.SuiteIterable(p, t)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		p, err := New[testutils.TestItem](client, "batch:")
+		biff.AssertNil(err)
+		testutils.SuiteBatch(p, t)
+	})
+
+	t.Run("Transactor", func(t *testing.T) {
+		p, err := New[testutils.TestItem](client, "transactor:")
+		biff.AssertNil(err)
+		testutils.SuiteTransactor(p, t)
+	})
+
+	t.Run("VersionDeleter", func(t *testing.T) {
+		p, err := New[testutils.TestItem](client, "version_deleter:")
+		biff.AssertNil(err)
+		testutils.SuiteVersionDeleter(p, t)
+	})
+
+	t.Run("Aliasing", func(t *testing.T) {
+		p, err := New[testutils.TestItem](client, "aliasing:")
+		biff.AssertNil(err)
+		testutils.SuiteAliasing(p, t)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		records, err := New[store.EncryptedRecord](client, "encrypted:")
+		biff.AssertNil(err)
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p := store.NewEncryptedStore[testutils.TestItem](records, keyring)
+		testutils.SuitePersistencer(p, t)
+	})
+
+	t.Run("PatternPrefix", func(t *testing.T) {
+		// The prefix is not a pattern for SCAN
+		p, err := New[testutils.TestItem](client, "pattern*[a]:")
+		biff.AssertNil(err)
+		other, err := New[testutils.TestItem](client, "patternX[a]:")
+		biff.AssertNil(err)
+		biff.AssertNil(other.Put(context.Background(), &testutils.TestItem{Id: store.NewId("other")}))
+		testutils.SuiteIterable(p, t)
+	})
+}
+
+func TestInRedis_Cache(t *testing.T) {
+
+	client := newClient(t, newServer(t))
+
+	newCached := func(prefix string) *store.StoreCached[testutils.TestItem] {
+		cache, err := New[testutils.TestItem](client, prefix)
+		biff.AssertNil(err)
+		p, err := store.NewStoreCached[testutils.TestItem](store.NewStoreMemory[testutils.TestItem](), cache)
+		biff.AssertNil(err)
+		return p
+	}
+
+	p := newCached("cached:")
+	testutils.SuitePersistencer(p, t)
+	testutils.SuiteOptimisticLocking(p, t)
+
+	t.Run("Batch", func(t *testing.T) {
+		testutils.SuiteBatch(newCached("cached_batch:"), t)
+	})
+
+	t.Run("Transactor", func(t *testing.T) {
+		testutils.SuiteTransactor(newCached("cached_transactor:"), t)
+	})
+
+	t.Run("VersionDeleter", func(t *testing.T) {
+		testutils.SuiteVersionDeleter(newCached("cached_version_deleter:"), t)
+	})
+}
+
+func TestInRedis_Cluster(t *testing.T) {
+
+	// Two servers sharing the slots, keys are routed by the client
+	a, b := newServer(t), newServer(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		ClusterSlots: func(ctx context.Context) ([]redis.ClusterSlot, error) {
+			return []redis.ClusterSlot{
+				{Start: 0, End: 8191, Nodes: []redis.ClusterNode{{Addr: a}}},
+				{Start: 8192, End: 16383, Nodes: []redis.ClusterNode{{Addr: b}}},
+			}, nil
+		},
+	})
+	t.Cleanup(func() {
+		client.Close()
+	})
+	ctx := context.Background()
+
+	p, err := New[testutils.TestItem](client, "items:")
+	biff.AssertNil(err)
+
+	for i := 0; i < 20; i++ {
+		biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("item-" + strconv.Itoa(i))}))
+	}
+	for _, addr := range []string{a, b} {
+		keys, err := newClient(t, addr).Keys(ctx, "items:*").Result()
+		biff.AssertNil(err)
+		biff.AssertTrue(len(keys) > 0)
+	}
+
+	items, err := p.List(ctx)
+	biff.AssertNil(err)
+	biff.AssertEqual(len(items), 20)
+}
+
+func TestInRedis_ScriptFlushed(t *testing.T) {
+
+	client := newClient(t, newServer(t))
+	ctx := context.Background()
+
+	p, err := New[testutils.TestItem](client, "items:")
+	biff.AssertNil(err)
+	biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("a")}))
+
+	// PutMany loads the scripts the server lost
+	biff.AssertNil(client.ScriptFlush(ctx).Err())
+	items := []*testutils.TestItem{
+		{Id: store.NewId("b")},
+		{Id: store.NewId("c")},
+	}
+	biff.AssertNil(p.PutMany(ctx, items))
+	biff.AssertEqual(items[0].GetVersion(), int64(1))
+	biff.AssertEqual(items[1].GetVersion(), int64(1))
+
+	list, err := p.List(ctx)
+	biff.AssertNil(err)
+	biff.AssertEqual(len(list), 3)
+}
+
+func TestInRedis_Unavailable(t *testing.T) {
+
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: time.Second, MaxRetries: -1})
+	defer client.Close()
+
+	_, err := New[testutils.TestItem](client, "items:")
+	biff.AssertTrue(errors.Is(err, store.ErrUnavailable))
+}
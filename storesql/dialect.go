@@ -0,0 +1,59 @@
+package storesql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/holacloud/store"
+)
+
+// Dialect is the SQL of a database engine. StoreSQL builds every statement
+// with it, using each query parameter once and in order, so dialects with
+// positional placeholders (?) work.
+type Dialect interface {
+	// Placeholder returns the query parameter number n, counting from 1
+	Placeholder(n int) string
+
+	// Quote quotes an identifier (a table or an index name)
+	Quote(name string) string
+
+	// JSON converts the query parameter p, a JSON text, to the type of the
+	// record column
+	JSON(p string) string
+
+	// EnsureTable creates the table if missing, with the columns id, record
+	// (the encoded item) and version, and a unique index named <table>_<name>
+	// for every constraint. Empty and null values are not constrained.
+	EnsureTable(ctx context.Context, db *sql.DB, table string, constraints []store.UniqueConstraint) error
+
+	// Upsert returns the statement inserting rows, tuples of (id, record,
+	// new version), or updating the rows with the same id that are still at
+	// the new version - 1, returning the ids written. Only conflicts on id
+	// can update a row, other unique violations must fail. Empty if the
+	// database can not do it, rows are updated or inserted one by one then.
+	Upsert(table string, rows []string) string
+
+	// Insert returns the statement inserting row, doing nothing or failing
+	// with a duplicate of the primary key if id exists
+	Insert(table string, row string) string
+
+	// InIds returns the condition of the id column being one of ids, arg
+	// adds a query parameter (see InList)
+	InIds(ids []string, arg func(v any) string) string
+
+	// DuplicateKey reports if err is a violation of a unique index of table
+	// and which one, "" for the primary key
+	DuplicateKey(table string, err error) (index string, ok bool)
+
+	// Error translates the other errors of the database, e.g. connection
+	// errors into store.ErrUnavailable
+	Error(err error) error
+
+	// Condition compiles a filter on a field (any operator but and/or), arg
+	// adds a query parameter. The fields id and version are the columns.
+	Condition(f store.Filter, arg func(v any) string) (string, error)
+
+	// Sort returns the ORDER BY expressions of a sort field following
+	// store.SortBucket, then numbers and strings in byte order
+	Sort(field store.SortField, arg func(v any) string) []string
+}
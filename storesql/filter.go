@@ -0,0 +1,55 @@
+package storesql
+
+import (
+	"strings"
+
+	"github.com/holacloud/store"
+)
+
+// compileFilter translates a (validated) store.Filter into a SQL condition over
+// the record column, the conditions on fields come from the dialect and arg
+// adds the query parameters.
+func compileFilter(dialect Dialect, f store.Filter, arg func(v any) string) (string, error) {
+
+	switch f.Op {
+	case "":
+		return "TRUE", nil
+	case store.OpAnd, store.OpOr:
+		if len(f.Filters) == 0 {
+			if f.Op == store.OpAnd {
+				return "TRUE", nil
+			}
+			return "FALSE", nil
+		}
+		conditions := []string{}
+		for _, sub := range f.Filters {
+			condition, err := compileFilter(dialect, sub, arg)
+			if err != nil {
+				return "", err
+			}
+			conditions = append(conditions, condition)
+		}
+		return "(" + strings.Join(conditions, " "+strings.ToUpper(string(f.Op))+" ") + ")", nil
+	}
+
+	return dialect.Condition(f, arg)
+}
+
+// compileSort translates sort fields into an ORDER BY expression list, with
+// id as tie-break.
+func compileSort(dialect Dialect, fields []store.SortField, arg func(v any) string) string {
+
+	expressions := []string{}
+	hasId := false
+	for _, f := range fields {
+		expressions = append(expressions, dialect.Sort(f, arg)...)
+		if f.Field == "id" {
+			hasId = true
+		}
+	}
+	if !hasId {
+		expressions = append(expressions, dialect.Sort(store.SortField{Field: "id"}, arg)...)
+	}
+
+	return strings.Join(expressions, ", ")
+}
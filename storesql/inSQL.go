@@ -0,0 +1,707 @@
+package storesql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"iter"
+	"strings"
+
+	"github.com/holacloud/store"
+)
+
+// StoreSQL keeps the items in a table of a database/sql database with the
+// columns id, record (the encoded item as JSON) and version. Everything that
+// depends on the database engine (placeholders, DDL, versioned upserts, JSON
+// functions and error codes) comes from a Dialect, see storepostgres,
+// storemysql and storesqlite.
+type StoreSQL[T store.Identifier] struct {
+	table       string
+	dialect     Dialect
+	constraints []store.UniqueConstraint
+	codec       store.Codec // encodes the record column
+	db          *sql.DB
+	conn        dialectConn // db or the current transaction
+	restores    *[]func()   // inside WithTx, restore the versions of the items written
+}
+
+// dbConn is satisfied by both *sql.DB and *sql.Tx
+type dbConn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// dialectConn translates the errors of a connection with the dialect
+type dialectConn struct {
+	dbConn
+	dialect Dialect
+}
+
+func (c dialectConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	result, err := c.dbConn.ExecContext(ctx, query, args...)
+	return result, c.dialect.Error(err)
+}
+
+func (c dialectConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	rows, err := c.dbConn.QueryContext(ctx, query, args...)
+	return rows, c.dialect.Error(err)
+}
+
+// New ensures the table in db (see Dialect.EnsureTable). Every unique
+// constraint is a unique index named <table>_<constraint name>.
+func New[T store.Identifier](db *sql.DB, dialect Dialect, table string, constraints ...store.UniqueConstraint) (*StoreSQL[T], error) {
+
+	err := dialect.EnsureTable(context.Background(), db, table, constraints)
+	if err != nil {
+		return nil, dialect.Error(err) // could not create table
+	}
+
+	return &StoreSQL[T]{
+		table:       table,
+		dialect:     dialect,
+		db:          db,
+		conn:        dialectConn{db, dialect},
+		constraints: constraints,
+		codec:       store.JSONCodec{},
+	}, nil
+}
+
+// SetCodec changes how items are encoded into the record column, so it must
+// produce JSON (e.g. a faster JSON implementation). It must be called before
+// the store is used.
+func (f *StoreSQL[T]) SetCodec(codec store.Codec) {
+	f.codec = codec
+}
+
+// Close closes the database
+func (f *StoreSQL[T]) Close() error {
+	return f.db.Close()
+}
+
+// args collects query parameters, numbering their placeholders
+type args struct {
+	dialect Dialect
+	values  []any
+}
+
+func (a *args) add(v any) string {
+	a.values = append(a.values, v)
+	return a.dialect.Placeholder(len(a.values))
+}
+
+func (f *StoreSQL[T]) newArgs() *args {
+	return &args{dialect: f.dialect}
+}
+
+// row adds the parameters of a row (id, record, version) and returns its tuple
+func (f *StoreSQL[T]) row(a *args, id string, record []byte, version int64) string {
+	return "(" + a.add(id) + ", " + f.dialect.JSON(a.add(string(record))) + ", " + a.add(version) + ")"
+}
+
+// encode marshals item as it will be stored, with version
+func (f *StoreSQL[T]) encode(item *T, version int64) ([]byte, error) {
+	current := (*item).GetVersion()
+	(*item).SetVersion(version)
+	record, err := f.codec.Marshal(item)
+	(*item).SetVersion(current) // restore until it is stored
+	return record, err
+}
+
+// isPrimaryKey tells if err is a duplicate of the id
+func (f *StoreSQL[T]) isPrimaryKey(err error) bool {
+	index, ok := f.dialect.DuplicateKey(f.table, err)
+	return ok && index == ""
+}
+
+// uniqueError converts violations of the unique constraints (on one of their
+// indexes) into *store.UniqueViolationError
+func (f *StoreSQL[T]) uniqueError(err error) error {
+	index, ok := f.dialect.DuplicateKey(f.table, err)
+	if !ok {
+		return err
+	}
+	for _, c := range f.constraints {
+		if index == f.table+"_"+c.Name {
+			return &store.UniqueViolationError{Constraint: c.Name}
+		}
+	}
+	return err
+}
+
+func (f *StoreSQL[T]) List(ctx context.Context) ([]*T, error) {
+
+	rows, err := f.conn.QueryContext(ctx, `SELECT id, record, version FROM `+f.dialect.Quote(f.table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return f.scanRows(rows)
+}
+
+func (f *StoreSQL[T]) Find(ctx context.Context, filter store.Filter, sort ...store.SortField) ([]*T, error) {
+
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := store.ValidateSort(sort); err != nil {
+		return nil, err
+	}
+
+	a := f.newArgs()
+	query, err := compileFilter(f.dialect, filter, a.add)
+	if err != nil {
+		return nil, err
+	}
+	query = `SELECT id, record, version FROM ` + f.dialect.Quote(f.table) + ` WHERE ` + query
+	if len(sort) > 0 {
+		query += ` ORDER BY ` + compileSort(f.dialect, sort, a.add)
+	}
+
+	rows, err := f.conn.QueryContext(ctx, query, a.values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return f.scanRows(rows)
+}
+
+// scanRows decodes all rows with the shape (id, record, version)
+func (f *StoreSQL[T]) scanRows(rows *sql.Rows) ([]*T, error) {
+
+	result := []*T{}
+	for rows.Next() {
+		item, err := f.scanRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, f.dialect.Error(err)
+	}
+
+	return result, nil
+}
+
+// scanRow decodes the current row with the shape (id, record, version)
+func (f *StoreSQL[T]) scanRow(rows *sql.Rows) (*T, error) {
+
+	id := ""
+	record := []byte{}
+	version := int64(0)
+	err := rows.Scan(&id, &record, &version)
+	if err != nil {
+		return nil, err
+	}
+
+	var item *T
+	err = f.codec.Unmarshal(record, &item)
+	if err != nil {
+		return nil, err
+	}
+	(*item).SetVersion(version)
+
+	return item, nil
+}
+
+func (f *StoreSQL[T]) Iterate(ctx context.Context) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+
+		rows, err := f.conn.QueryContext(ctx, `SELECT id, record, version FROM `+f.dialect.Quote(f.table))
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			item, err := f.scanRow(rows)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(item, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, f.dialect.Error(err))
+		}
+	}
+}
+
+func (f *StoreSQL[T]) ListPage(ctx context.Context, req store.PageRequest) (*store.Page[T], error) {
+
+	after, err := store.DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := req.GetLimit()
+	a := f.newArgs()
+	rows, err := f.conn.QueryContext(ctx, `
+		SELECT id, record, version FROM `+f.dialect.Quote(f.table)+`
+		WHERE id > `+a.add(after)+`
+		ORDER BY id
+		LIMIT `+a.add(limit+1), a.values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result, err := f.scanRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.NewPage(result, limit), nil
+}
+
+// put stores record if id is missing or still at version, with the upsert of
+// the dialect, or else updating and inserting if missing (then a duplicated
+// id means that another version was stored)
+func (f *StoreSQL[T]) put(ctx context.Context, id string, record []byte, version int64) error {
+
+	a := f.newArgs()
+	row := f.row(a, id, record, version+1)
+	if query := f.dialect.Upsert(f.table, []string{row}); query != "" {
+		rows, err := f.conn.QueryContext(ctx, query, a.values...)
+		if err != nil {
+			return f.uniqueError(err)
+		}
+		defer rows.Close()
+		if rows.Next() {
+			return nil
+		}
+		if err := rows.Err(); err != nil {
+			return f.uniqueError(f.dialect.Error(err))
+		}
+		return store.ErrVersionGone
+	}
+
+	n, err := f.update(ctx, id, record, version)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	result, err := f.conn.ExecContext(ctx, f.dialect.Insert(f.table, row), a.values...)
+	if f.isPrimaryKey(err) {
+		return store.ErrVersionGone
+	}
+	if err != nil {
+		return f.uniqueError(err)
+	}
+	n, err = result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrVersionGone
+	}
+
+	return nil
+}
+
+// update stores record if id is at version, returning the rows updated
+func (f *StoreSQL[T]) update(ctx context.Context, id string, record []byte, version int64) (int64, error) {
+
+	a := f.newArgs()
+	result, err := f.conn.ExecContext(ctx, `
+		UPDATE `+f.dialect.Quote(f.table)+`
+		SET record = `+f.dialect.JSON(a.add(string(record)))+`, version = `+a.add(version+1)+`
+		WHERE id = `+a.add(id)+` AND version = `+a.add(version), a.values...)
+	if err != nil {
+		return 0, f.uniqueError(err)
+	}
+
+	return result.RowsAffected()
+}
+
+func (f *StoreSQL[T]) Put(ctx context.Context, item *T) error {
+
+	version := (*item).GetVersion()
+	record, err := f.encode(item, version+1)
+	if err != nil {
+		return err
+	}
+
+	err = f.put(ctx, (*item).GetId(), record, version)
+	if err != nil {
+		return err
+	}
+
+	f.stored(item, version+1)
+
+	return nil
+}
+
+func (f *StoreSQL[T]) Create(ctx context.Context, item *T) error {
+
+	record, err := f.encode(item, 1)
+	if err != nil {
+		return err
+	}
+
+	a := f.newArgs()
+	result, err := f.conn.ExecContext(ctx, f.dialect.Insert(f.table, f.row(a, (*item).GetId(), record, 1)), a.values...)
+	if f.isPrimaryKey(err) {
+		return store.ErrAlreadyExists
+	}
+	if err != nil {
+		return f.uniqueError(err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrAlreadyExists
+	}
+
+	f.stored(item, 1)
+
+	return nil
+}
+
+func (f *StoreSQL[T]) Update(ctx context.Context, item *T) error {
+
+	version := (*item).GetVersion()
+	record, err := f.encode(item, version+1)
+	if err != nil {
+		return err
+	}
+
+	n, err := f.update(ctx, (*item).GetId(), record, version)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// Nothing updated, tell why
+		current, err := f.Get(ctx, (*item).GetId())
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return store.ErrNotFound
+		}
+		return store.ErrVersionGone
+	}
+
+	f.stored(item, version+1)
+
+	return nil
+}
+
+// chunkSize limits the number of rows or ids per statement (postgres and
+// mysql accept at most 65535 parameters, SQLite 32766)
+const chunkSize = 1000
+
+// chunks splits values in slices of at most chunkSize
+func chunks[V any](values []V) [][]V {
+	result := [][]V{}
+	for len(values) > chunkSize {
+		result = append(result, values[:chunkSize])
+		values = values[chunkSize:]
+	}
+	if len(values) > 0 {
+		result = append(result, values)
+	}
+	return result
+}
+
+func (f *StoreSQL[T]) PutMany(ctx context.Context, items []*T) error {
+
+	errs := store.DuplicatedIds(items)
+
+	pending := []int{}
+	for i := range items {
+		if errs[i] == nil {
+			pending = append(pending, i)
+		}
+	}
+
+	for _, chunk := range chunks(pending) {
+
+		records := map[int][]byte{}
+		for _, i := range chunk {
+			record, err := f.encode(items[i], (*items[i]).GetVersion()+1)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			records[i] = record
+		}
+
+		stored, err := f.upsertMany(ctx, items, chunk, records)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range chunk {
+			if errs[i] != nil {
+				continue
+			}
+			if stored == nil {
+				// One by one, the dialect has no upsert or the whole statement
+				// failed because of some unique violation
+				errs[i] = f.savepoint(ctx, func() error {
+					return f.put(ctx, (*items[i]).GetId(), records[i], (*items[i]).GetVersion())
+				})
+			} else if !stored[(*items[i]).GetId()] {
+				errs[i] = store.ErrVersionGone
+			}
+			if errs[i] == nil {
+				f.stored(items[i], (*items[i]).GetVersion()+1)
+			}
+		}
+	}
+
+	return store.NewBatchError(errs)
+}
+
+// upsertMany stores the records of a chunk of items in one statement, with
+// the same version check as put, and returns the ids stored. It returns nil
+// if they must be put one by one.
+func (f *StoreSQL[T]) upsertMany(ctx context.Context, items []*T, chunk []int, records map[int][]byte) (map[string]bool, error) {
+
+	a := f.newArgs()
+	values := []string{}
+	for _, i := range chunk {
+		if record, ok := records[i]; ok {
+			values = append(values, f.row(a, (*items[i]).GetId(), record, (*items[i]).GetVersion()+1))
+		}
+	}
+	if len(values) == 0 {
+		return map[string]bool{}, nil
+	}
+
+	query := f.dialect.Upsert(f.table, values)
+	if query == "" {
+		return nil, nil
+	}
+
+	stored := map[string]bool{}
+	err := f.savepoint(ctx, func() error {
+		rows, err := f.conn.QueryContext(ctx, query, a.values...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			id := ""
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			stored[id] = true
+		}
+		return rows.Err()
+	})
+	if errors.Is(f.uniqueError(err), store.ErrUniqueViolation) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, f.dialect.Error(err)
+	}
+
+	return stored, nil
+}
+
+// savepoint runs fn, inside WithTx under a savepoint that is rolled back if
+// fn fails, so the transaction can go on (postgres aborts the whole
+// transaction after a failed statement otherwise)
+func (f *StoreSQL[T]) savepoint(ctx context.Context, fn func() error) error {
+	if _, inTx := f.conn.dbConn.(*sql.Tx); !inTx {
+		return fn()
+	}
+
+	if _, err := f.conn.ExecContext(ctx, `SAVEPOINT storesql_batch`); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if _, rollbackErr := f.conn.ExecContext(ctx, `ROLLBACK TO SAVEPOINT storesql_batch`); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+	_, err := f.conn.ExecContext(ctx, `RELEASE SAVEPOINT storesql_batch`)
+	return err
+}
+
+func (f *StoreSQL[T]) Get(ctx context.Context, id string) (*T, error) {
+
+	a := f.newArgs()
+	row := f.conn.QueryRowContext(ctx, `
+		SELECT record, version FROM `+f.dialect.Quote(f.table)+` WHERE id = `+a.add(id), a.values...)
+
+	record := []byte{}
+	version := int64(0)
+	err := row.Scan(&record, &version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, f.dialect.Error(err)
+	}
+
+	var item *T
+	err = f.codec.Unmarshal(record, &item)
+	if err != nil {
+		return nil, err
+	}
+	(*item).SetVersion(version)
+
+	return item, nil
+}
+
+// InList is the InIds of dialects without array parameters, a parameter per
+// id
+func InList(ids []string, arg func(v any) string) string {
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		placeholders[i] = arg(id)
+	}
+	return "id IN (" + strings.Join(placeholders, ", ") + ")"
+}
+
+func (f *StoreSQL[T]) GetMany(ctx context.Context, ids []string) ([]*T, error) {
+
+	byId := map[string]*T{}
+	for _, chunk := range chunks(ids) {
+		a := f.newArgs()
+		rows, err := f.conn.QueryContext(ctx, `
+			SELECT id, record, version FROM `+f.dialect.Quote(f.table)+` WHERE `+f.dialect.InIds(chunk, a.add), a.values...)
+		if err != nil {
+			return nil, err
+		}
+
+		found, err := f.scanRows(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range found {
+			byId[(*item).GetId()] = item
+		}
+	}
+
+	result := make([]*T, len(ids))
+	for i, id := range ids {
+		result[i] = byId[id]
+	}
+
+	return result, nil
+}
+
+func (f *StoreSQL[T]) Delete(ctx context.Context, id string) error {
+
+	a := f.newArgs()
+	_, err := f.conn.ExecContext(ctx, `
+		DELETE FROM `+f.dialect.Quote(f.table)+`
+		WHERE id = `+a.add(id), a.values...)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (f *StoreSQL[T]) DeleteMany(ctx context.Context, ids []string) error {
+
+	for _, chunk := range chunks(ids) {
+		a := f.newArgs()
+		_, err := f.conn.ExecContext(ctx, `
+			DELETE FROM `+f.dialect.Quote(f.table)+`
+			WHERE `+f.dialect.InIds(chunk, a.add), a.values...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WithTx runs fn inside a database transaction, any error (including
+// store.ErrVersionGone from Put) rolls back all the writes. Isolation is the
+// default of the database, a write conflicting with a concurrent transaction
+// is store.ErrVersionGone.
+func (f *StoreSQL[T]) WithTx(ctx context.Context, fn func(tx store.Storer[T]) error) error {
+
+	if _, inTx := f.conn.dbConn.(*sql.Tx); inTx {
+		return fn(f) // already in a transaction
+	}
+
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return f.dialect.Error(err)
+	}
+
+	txStore := *f
+	txStore.conn = dialectConn{tx, f.dialect}
+	txStore.restores = &[]func(){}
+	rollback := func() {
+		restores := *txStore.restores
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+
+	if err := fn(&txStore); err != nil {
+		_ = tx.Rollback()
+		rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		rollback()
+		return f.dialect.Error(err)
+	}
+	return nil
+}
+
+// stored sets the new version on an item written, inside WithTx the previous
+// one is restored if the transaction is rolled back
+func (f *StoreSQL[T]) stored(item *T, version int64) {
+	if f.restores != nil {
+		previous := (*item).GetVersion()
+		*f.restores = append(*f.restores, func() { (*item).SetVersion(previous) })
+	}
+	(*item).SetVersion(version)
+}
+
+func (f *StoreSQL[T]) DeleteVersion(ctx context.Context, id string, version int64) error {
+
+	a := f.newArgs()
+	result, err := f.conn.ExecContext(ctx, `
+		DELETE FROM `+f.dialect.Quote(f.table)+`
+		WHERE id = `+a.add(id)+` AND version = `+a.add(version), a.values...)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	// Nothing deleted, tell why
+	current, err := f.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return store.ErrNotFound
+	}
+	return store.ErrVersionGone
+}
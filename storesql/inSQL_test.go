@@ -0,0 +1,92 @@
+package storesql_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/storesql"
+	"github.com/holacloud/store/storesqlite"
+	"github.com/holacloud/store/testutils"
+)
+
+// withoutUpsert is SQLite as a database without upserts (e.g. MySQL), so rows
+// are updated or inserted one by one and a duplicated id is an error
+type withoutUpsert struct {
+	storesqlite.Dialect
+}
+
+func (withoutUpsert) Upsert(table string, rows []string) string {
+	return ""
+}
+
+func (withoutUpsert) Insert(table string, row string) string {
+	return `INSERT INTO "` + table + `" (id, record, version) VALUES ` + row
+}
+
+func TestStoreSQL_WithoutUpsert(t *testing.T) {
+
+	db, err := sql.Open("sqlite", "file:"+path.Join(t.TempDir(), "test.db")+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	biff.AssertNil(err)
+	defer db.Close()
+
+	p, err := storesql.New[testutils.TestItem](db, withoutUpsert{}, "mytable")
+	biff.AssertNil(err)
+
+	testutils.SuitePersistencer(p, t)
+	testutils.SuiteOptimisticLocking(p, t)
+
+	t.Run("Batch", func(t *testing.T) {
+		p, err := storesql.New[testutils.TestItem](db, withoutUpsert{}, "mytable_batch")
+		biff.AssertNil(err)
+		testutils.SuiteBatch(p, t)
+	})
+
+	t.Run("Transactor", func(t *testing.T) {
+		p, err := storesql.New[testutils.TestItem](db, withoutUpsert{}, "mytable_transactor")
+		biff.AssertNil(err)
+		testutils.SuiteTransactor(p, t)
+	})
+
+	t.Run("UniqueConstraints", func(t *testing.T) {
+		p, err := storesql.New[testutils.TestItem](db, withoutUpsert{}, "mytable_unique", testutils.TestItemConstraints...)
+		biff.AssertNil(err)
+		testutils.SuiteUniqueConstraints(p, t)
+	})
+
+	for name, dialect := range map[string]storesql.Dialect{
+		"upsert":         storesqlite.Dialect{},
+		"without upsert": withoutUpsert{},
+	} {
+		t.Run("PutMany duplicated value in a transaction, "+name, func(t *testing.T) {
+			p, err := storesql.New[testutils.TestItem](db, dialect, "mytable_unique_tx_"+strings.ReplaceAll(name, " ", "_"), testutils.TestItemConstraints...)
+			biff.AssertNil(err)
+			ctx := context.Background()
+			biff.AssertNil(p.Put(ctx, &testutils.TestItem{Id: store.NewId("u-1"), Description: "d1"}))
+
+			var batchErr *store.BatchError
+			err = p.WithTx(ctx, func(tx store.Storer[testutils.TestItem]) error {
+				err := store.PutMany(ctx, tx, []*testutils.TestItem{
+					{Id: store.NewId("u-2"), Description: "d2"},
+					{Id: store.NewId("u-3"), Description: "d1"},
+				})
+				biff.AssertTrue(errors.As(err, &batchErr))
+				return tx.Put(ctx, &testutils.TestItem{Id: store.NewId("u-4"), Description: "d4"})
+			})
+			biff.AssertNil(err)
+			biff.AssertNil(batchErr.Errors[0])
+			biff.AssertTrue(errors.Is(batchErr.Errors[1], store.ErrUniqueViolation))
+
+			for _, id := range []string{"u-2", "u-4"} {
+				stored, err := p.Get(ctx, id)
+				biff.AssertNil(err)
+				biff.AssertNotNil(stored)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package storesqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/storesql"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Dialect is the SQL of SQLite for storesql: record is JSON text, filters use
+// its JSON functions and unique constraints are expression indexes.
+type Dialect struct{}
+
+var _ storesql.Dialect = Dialect{}
+
+func (Dialect) Placeholder(n int) string {
+	return "?" + strconv.Itoa(n)
+}
+
+func (Dialect) Quote(name string) string {
+	return quoteIdentifier(name)
+}
+
+func (Dialect) JSON(p string) string {
+	return "json(" + p + ")"
+}
+
+func (Dialect) EnsureTable(ctx context.Context, db *sql.DB, table string, constraints []store.UniqueConstraint) error {
+
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS `+quoteIdentifier(table)+` (
+		    id       TEXT PRIMARY KEY,
+		    record   TEXT NOT NULL,
+		    version  INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range constraints {
+		_, err = db.ExecContext(ctx, `
+			CREATE UNIQUE INDEX IF NOT EXISTS `+quoteIdentifier(table+"_"+c.Name)+`
+			ON `+quoteIdentifier(table)+` (NULLIF(json_extract(record, `+quoteLiteral(jsonPath(c.Path()))+`), ''));
+		`)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (Dialect) Upsert(table string, rows []string) string {
+	return `
+		INSERT INTO ` + quoteIdentifier(table) + ` (id, record, version) VALUES ` + strings.Join(rows, ", ") + `
+		ON CONFLICT (id)
+		DO UPDATE SET record = excluded.record, version = excluded.version WHERE ` + quoteIdentifier(table) + `.version = excluded.version - 1
+		RETURNING id
+	`
+}
+
+func (Dialect) Insert(table string, row string) string {
+	return `
+		INSERT INTO ` + quoteIdentifier(table) + ` (id, record, version) VALUES ` + row + `
+		ON CONFLICT (id) DO NOTHING
+	`
+}
+
+// InIds is a parameter per id
+func (Dialect) InIds(ids []string, arg func(v any) string) string {
+	return storesql.InList(ids, arg)
+}
+
+// DuplicateKey reads the index from the message of SQLITE_CONSTRAINT_UNIQUE,
+// e.g. "UNIQUE constraint failed: index 'people_email'"
+func (Dialect) DuplicateKey(table string, err error) (string, bool) {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return "", false
+	}
+	switch sqliteErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+		return "", true
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		_, index, ok := strings.Cut(sqliteErr.Error(), "index '")
+		if !ok {
+			return "", false
+		}
+		index, _, ok = strings.Cut(index, "'")
+		return index, ok
+	}
+	return "", false
+}
+
+// Error marks the errors of a database locked for too long (see busyTimeout)
+// with store.ErrUnavailable. A transaction that read a snapshot of the
+// database that another connection has written since can not write anymore,
+// that is store.ErrVersionGone.
+func (Dialect) Error(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		if sqliteErr.Code() == sqlite3.SQLITE_BUSY_SNAPSHOT {
+			return fmt.Errorf("%w: %w", store.ErrVersionGone, err)
+		}
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+			return store.Unavailable(err)
+		}
+	}
+	return err
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return `'` + strings.ReplaceAll(value, `'`, `''`) + `'`
+}
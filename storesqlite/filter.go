@@ -0,0 +1,158 @@
+package storesqlite
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/holacloud/store"
+)
+
+// Condition compiles a filter on a field, the JSON functions of SQLite tell
+// its type. Every condition evaluates to 0 or 1 (never NULL), so they can be
+// negated.
+func (Dialect) Condition(f store.Filter, arg func(v any) string) (string, error) {
+
+	field := fieldExpression(f.Field, arg)
+
+	switch f.Op {
+	case store.OpEq, store.OpNe:
+		condition, err := equals(field, f.Value, arg)
+		if err != nil {
+			return "", err
+		}
+		if f.Op == store.OpEq {
+			return condition, nil
+		}
+		return "(NOT " + condition + ")", nil
+
+	case store.OpIn:
+		if len(f.Values) == 0 {
+			return "0", nil
+		}
+		conditions := []string{}
+		for _, v := range f.Values {
+			condition, err := equals(field, v, arg)
+			if err != nil {
+				return "", err
+			}
+			conditions = append(conditions, condition)
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")", nil
+
+	case store.OpExists:
+		if f.Value.(bool) {
+			return "(" + field.kind + " IS NOT NULL)", nil
+		}
+		return "(" + field.kind + " IS NULL)", nil
+
+	case store.OpLt, store.OpLte, store.OpGt, store.OpGte:
+		operator := map[store.Operator]string{
+			store.OpLt:  "<",
+			store.OpLte: "<=",
+			store.OpGt:  ">",
+			store.OpGte: ">=",
+		}[f.Op]
+		// Strings use the BINARY collation, that is byte order
+		guard := "IN ('integer', 'real')"
+		if _, ok := f.Value.(string); ok {
+			guard = "= 'text'"
+		}
+		return "(CASE WHEN " + field.kind + " " + guard + " THEN " + field.value + " " + operator + " " + arg(f.Value) + " ELSE 0 END)", nil
+	}
+
+	return "", fmt.Errorf("%w: unknown operator '%s'", store.ErrInvalidFilter, f.Op)
+}
+
+// equals returns the condition of field being equal to v, values of different
+// JSON types are never equal (e.g. 1 and "1" or 1 and true). Objects are
+// compared by their JSON text, so their keys must be in the same order.
+func equals(field jsonField, v any, arg func(v any) string) (string, error) {
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var value any
+	if err := json.Unmarshal(b, &value); err != nil {
+		return "", err
+	}
+
+	condition := ""
+	switch value := value.(type) {
+	case nil:
+		condition = field.kind + " = 'null'"
+	case bool:
+		condition = field.kind + " = '" + strconv.FormatBool(value) + "'"
+	case float64:
+		condition = field.kind + " IN ('integer', 'real') AND " + field.value + " = " + arg(value)
+	case string:
+		condition = field.kind + " = 'text' AND " + field.value + " = " + arg(value)
+	default:
+		condition = field.kind + " IN ('object', 'array') AND " + field.value + " = json(" + arg(string(b)) + ")"
+	}
+
+	return "IFNULL((" + condition + "), 0)", nil
+}
+
+// Sort returns the ORDER BY expressions of a field, the JSON type first to
+// follow store.SortBucket, then numbers and strings (BINARY collation, that is
+// byte order).
+func (Dialect) Sort(f store.SortField, arg func(v any) string) []string {
+
+	direction := " ASC NULLS FIRST"
+	if f.Desc {
+		direction = " DESC NULLS LAST"
+	}
+	if f.Field == "id" {
+		return []string{"id" + direction}
+	}
+
+	field := fieldExpression(f.Field, arg)
+	bucket := "(CASE IFNULL(" + field.kind + ", 'null')" +
+		" WHEN 'null' THEN 0 WHEN 'integer' THEN 1 WHEN 'real' THEN 1 WHEN 'text' THEN 2" +
+		" WHEN 'object' THEN 3 WHEN 'array' THEN 4 ELSE 5 END)"
+	number := "(CASE WHEN " + field.kind + " IN ('integer', 'real') THEN " + field.value + " END)"
+	text := "(CASE WHEN " + field.kind + " = 'text' THEN " + field.value + " END)"
+
+	return []string{bucket + direction, number + direction, text + direction}
+}
+
+// jsonField has the SQL expressions for the JSON type of a field (as json_type
+// names it, NULL if missing) and for its SQL value
+type jsonField struct {
+	kind  string
+	value string
+}
+
+// fieldExpression returns the expressions for a field path. id and version
+// live in their own columns, which are the reference.
+func fieldExpression(name string, arg func(v any) string) jsonField {
+	switch name {
+	case "id":
+		return jsonField{kind: "'text'", value: "id"}
+	case "version":
+		return jsonField{kind: "'integer'", value: "version"}
+	}
+	path := arg(jsonPath(strings.Split(name, ".")))
+	return jsonField{
+		kind:  "json_type(record, " + path + ")",
+		value: "json_extract(record, " + path + ")",
+	}
+}
+
+// jsonPath converts a field path into a SQLite JSON path, numeric parts are
+// array indexes and the rest object keys
+func jsonPath(parts []string) string {
+	b := strings.Builder{}
+	b.WriteString("$")
+	for _, part := range parts {
+		if i, err := strconv.Atoi(part); err == nil && i >= 0 {
+			b.WriteString("[" + strconv.Itoa(i) + "]")
+			continue
+		}
+		b.WriteString(`."` + part + `"`)
+	}
+	return b.String()
+}
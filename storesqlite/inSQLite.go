@@ -0,0 +1,49 @@
+package storesqlite
+
+import (
+	"database/sql"
+
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/storesql"
+	_ "modernc.org/sqlite"
+)
+
+// StoreSQLite keeps the items in a table of a SQLite database file, with the
+// same layout as storepostgres: id, record (JSON text) and version columns.
+// Filters use the JSON functions of SQLite. Watch is not supported.
+//
+// Transactions (WithTx) read a snapshot of the database, and the first write
+// takes the write lock of the database until the transaction ends. Writing
+// fails with store.ErrVersionGone if anything was written after the snapshot
+// was taken.
+type StoreSQLite[T store.Identifier] struct {
+	*storesql.StoreSQL[T]
+}
+
+// busyTimeout is how long (in ms) a connection waits for other writers before
+// failing with SQLITE_BUSY
+const busyTimeout = "5000"
+
+// New opens (or creates) the database file and ensures the table. The
+// database is opened in WAL mode so readers do not block the writer. Every
+// unique constraint is a unique expression index named <table>_<constraint
+// name>.
+func New[T store.Identifier](table, filename string, constraints ...store.UniqueConstraint) (*StoreSQLite[T], error) {
+
+	dataSource := "file:" + filename +
+		"?_pragma=busy_timeout(" + busyTimeout + ")" +
+		"&_pragma=journal_mode(WAL)"
+
+	db, err := sql.Open("sqlite", dataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := storesql.New[T](db, Dialect{}, table, constraints...)
+	if err != nil {
+		db.Close()
+		return nil, err // could not create table
+	}
+
+	return &StoreSQLite[T]{StoreSQL: s}, nil
+}
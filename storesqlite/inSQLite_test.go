@@ -0,0 +1,175 @@
+package storesqlite
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/fulldump/biff"
+	"github.com/holacloud/store"
+	"github.com/holacloud/store/testutils"
+)
+
+func TestInSQLite(t *testing.T) {
+
+	filename := path.Join(t.TempDir(), "test.db")
+
+	p, err := New[testutils.TestItem]("mytable", filename)
+	biff.AssertNil(err)
+	defer p.Close()
+
+	testutils.SuitePersistencer(p, t)
+	testutils.SuiteOptimisticLocking(p, t)
+
+	t.Run("Pagination", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_pagination", filename)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuitePagination(p, t)
+	})
+
+	t.Run("Querier", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_querier", filename)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteQuerier(p, t)
+	})
+
+	t.Run("Iterable", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_iterable", filename)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteIterable(p, t)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_batch", filename)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteBatch(p, t)
+	})
+
+	t.Run("Transactor", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_transactor", filename)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteTransactor(p, t)
+	})
+
+	t.Run("VersionDeleter", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_version_deleter", filename)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteVersionDeleter(p, t)
+	})
+
+	t.Run("Aliasing", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_aliasing", filename)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteAliasing(p, t)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		records, err := New[store.EncryptedRecord]("mytable_encrypted", filename)
+		biff.AssertNil(err)
+		defer records.Close()
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p := store.NewEncryptedStore[testutils.TestItem](records, keyring)
+		testutils.SuitePersistencer(p, t)
+	})
+
+	t.Run("FieldEncrypted", func(t *testing.T) {
+		raw, err := New[testutils.SecretItem]("mytable_field_encrypted", filename)
+		biff.AssertNil(err)
+		defer raw.Close()
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+		biff.AssertNil(err)
+		p, err := store.NewFieldEncryptedStore[testutils.SecretItem](raw, keyring)
+		biff.AssertNil(err)
+		testutils.SuiteFieldEncryption(p, raw, t)
+	})
+
+	t.Run("UniqueConstraints", func(t *testing.T) {
+		p, err := New[testutils.TestItem]("mytable_unique", filename, testutils.TestItemConstraints...)
+		biff.AssertNil(err)
+		defer p.Close()
+		testutils.SuiteUniqueConstraints(p, t)
+	})
+}
+
+func TestInSQLite_Reopen(t *testing.T) {
+
+	filename := path.Join(t.TempDir(), "test.db")
+	ctx := context.Background()
+
+	p, err := New[testutils.TestItem]("mytable", filename)
+	biff.AssertNil(err)
+	item := &testutils.TestItem{Id: store.NewId("my-id"), Title: "persisted"}
+	biff.AssertNil(p.Put(ctx, item))
+	biff.AssertNil(p.Close())
+
+	p, err = New[testutils.TestItem]("mytable", filename)
+	biff.AssertNil(err)
+	defer p.Close()
+
+	got, err := p.Get(ctx, "my-id")
+	biff.AssertNil(err)
+	biff.AssertEqual(got.Title, "persisted")
+	biff.AssertEqual(got.GetVersion(), int64(1))
+}
+
+func TestInSQLite_ConcurrentWriters(t *testing.T) {
+
+	filename := path.Join(t.TempDir(), "test.db")
+	ctx := context.Background()
+
+	// Two stores on the same file are two processes as far as locking goes
+	a, err := New[testutils.TestItem]("mytable", filename)
+	biff.AssertNil(err)
+	defer a.Close()
+	b, err := New[testutils.TestItem]("mytable", filename)
+	biff.AssertNil(err)
+	defer b.Close()
+
+	biff.AssertNil(a.Put(ctx, &testutils.TestItem{Id: store.NewId("counter")}))
+
+	increment := func(p *StoreSQLite[testutils.TestItem]) error {
+		for {
+			item, err := p.Get(ctx, "counter")
+			if err != nil {
+				return err
+			}
+			item.Counter++
+			err = p.Put(ctx, item)
+			if errors.Is(err, store.ErrVersionGone) {
+				continue
+			}
+			return err
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		for _, p := range []*StoreSQLite[testutils.TestItem]{a, b} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- increment(p)
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		biff.AssertNil(err)
+	}
+
+	item, err := a.Get(ctx, "counter")
+	biff.AssertNil(err)
+	biff.AssertEqual(item.Counter, 40)
+}
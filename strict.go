@@ -0,0 +1,21 @@
+package store
+
+import (
+	"context"
+)
+
+// StrictStorer separates inserts from updates instead of guessing the intent
+// from the version of the item, the behaviour is the same on every store.
+//
+// Create stores a new item with version 1, whatever the version of item is, and
+// fails with ErrAlreadyExists if the id is already stored.
+//
+// Update stores the item only if the id exists and its version matches the
+// stored one, otherwise it fails with ErrNotFound or ErrVersionGone. The
+// stored version is incremented.
+//
+// On success the new version is set on item, on failure item is not modified.
+type StrictStorer[T Identifier] interface {
+	Create(ctx context.Context, item *T) error
+	Update(ctx context.Context, item *T) error
+}
@@ -2,8 +2,12 @@ package testutils
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"iter"
 	"math/rand/v2"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -26,6 +30,32 @@ type SubItem struct {
 	Field2 string `json:"field2"`
 }
 
+// SecretItem has encrypted fields, see SuiteFieldEncryption
+type SecretItem struct {
+	*store.Id `bson:",inline"`
+	Name      string        `json:"name"`
+	Email     string        `json:"email" store:"encrypted,deterministic"`
+	Notes     string        `json:"notes" store:"encrypted"`
+	Cards     []*SecretCard `json:"cards"`
+}
+
+type SecretCard struct {
+	Number string `json:"number" store:"encrypted"`
+}
+
+// TestItemIndexes are the secondary indexes expected by SuiteIndexer
+var TestItemIndexes = []store.Index[TestItem]{
+	{
+		Name: "title",
+		Key:  func(item *TestItem) string { return item.Title },
+	},
+	{
+		Name:   "description",
+		Key:    func(item *TestItem) string { return item.Description },
+		Unique: true,
+	},
+}
+
 func SuitePersistencer(p store.Storer[TestItem], t *testing.T) {
 
 	ctx := context.Background()
@@ -111,6 +141,16 @@ func SuitePersistencer(p store.Storer[TestItem], t *testing.T) {
 			AssertNil(getErr)
 			AssertNil(getResult)
 		})
+
+		t.Run("Check GetExisting fails with not found", func(t *testing.T) {
+			getResult, getErr := store.GetExisting(ctx, p, "1")
+			AssertTrue(errors.Is(getErr, store.ErrNotFound))
+			AssertNil(getResult)
+
+			getResult, getErr = store.GetExisting(ctx, p, "2")
+			AssertNil(getErr)
+			AssertEqual(getResult.Id, item2.Id)
+		})
 	})
 
 	t.Run("Concurrency", func(t *testing.T) {
@@ -211,4 +251,1327 @@ func SuiteOptimisticLocking(p store.Storer[TestItem], t *testing.T) {
 		AssertEqual(finalItem.Counter, workers)
 	})
 
+	strict, ok := p.(store.StrictStorer[TestItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.StrictStorer", p)
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		item := &TestItem{Id: store.NewId("strict-1"), Title: "created"}
+		AssertNil(strict.Create(ctx, item))
+		AssertEqual(item.GetVersion(), int64(1))
+
+		stored, err := p.Get(ctx, "strict-1")
+		AssertNil(err)
+		AssertEqual(stored.Title, "created")
+		AssertEqual(stored.GetVersion(), int64(1))
+	})
+
+	t.Run("Create existing", func(t *testing.T) {
+		item := &TestItem{Id: store.NewId("strict-1"), Title: "duplicated"}
+		err := strict.Create(ctx, item)
+		AssertTrue(errors.Is(err, store.ErrAlreadyExists))
+		AssertEqual(item.GetVersion(), int64(0))
+
+		stored, err := p.Get(ctx, "strict-1")
+		AssertNil(err)
+		AssertEqual(stored.Title, "created")
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		item, err := p.Get(ctx, "strict-1")
+		AssertNil(err)
+		item.Title = "updated"
+		AssertNil(strict.Update(ctx, item))
+		AssertEqual(item.GetVersion(), int64(2))
+
+		stored, err := p.Get(ctx, "strict-1")
+		AssertNil(err)
+		AssertEqual(stored.Title, "updated")
+		AssertEqual(stored.GetVersion(), int64(2))
+	})
+
+	t.Run("Update stale version", func(t *testing.T) {
+		item := &TestItem{Id: store.NewId("strict-1"), Title: "stale"}
+		item.SetVersion(1)
+		err := strict.Update(ctx, item)
+		AssertTrue(errors.Is(err, store.ErrVersionGone))
+		AssertEqual(item.GetVersion(), int64(1))
+
+		stored, err := p.Get(ctx, "strict-1")
+		AssertNil(err)
+		AssertEqual(stored.Title, "updated")
+	})
+
+	t.Run("Update missing", func(t *testing.T) {
+		item := &TestItem{Id: store.NewId("strict-missing")}
+		err := strict.Update(ctx, item)
+		AssertTrue(errors.Is(err, store.ErrNotFound))
+
+		stored, err := p.Get(ctx, "strict-missing")
+		AssertNil(err)
+		AssertNil(stored)
+	})
+
+	t.Run("Put new item does not overwrite", func(t *testing.T) {
+		err := p.Put(ctx, &TestItem{Id: store.NewId("strict-1"), Title: "overwritten"})
+		AssertTrue(errors.Is(err, store.ErrVersionGone))
+
+		stored, err := p.Get(ctx, "strict-1")
+		AssertNil(err)
+		AssertEqual(stored.Title, "updated")
+	})
+
+	t.Run("Create concurrently", func(t *testing.T) {
+		w := &sync.WaitGroup{}
+		created := int32(0)
+		existing := int32(0)
+		workers := 20
+		for i := 0; i < workers; i++ {
+			w.Add(1)
+			go func() {
+				defer w.Done()
+				err := strict.Create(ctx, &TestItem{Id: store.NewId("strict-2")})
+				if err == nil {
+					atomic.AddInt32(&created, 1)
+				} else if errors.Is(err, store.ErrAlreadyExists) {
+					atomic.AddInt32(&existing, 1)
+				}
+			}()
+		}
+		w.Wait()
+
+		AssertEqual(created, int32(1))
+		AssertEqual(existing, int32(workers-1))
+	})
+
+}
+
+func SuitePagination(p store.Storer[TestItem], t *testing.T) {
+
+	ctx := context.Background()
+
+	pager, ok := p.(store.Pager[TestItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.Pager", p)
+	}
+
+	t.Run("Page empty", func(t *testing.T) {
+		page, err := pager.ListPage(ctx, store.PageRequest{Limit: 10})
+		AssertNil(err)
+		AssertEqual(len(page.Items), 0)
+		AssertEqual(page.NextCursor, "")
+	})
+
+	total := 25
+	for i := 0; i < total; i++ {
+		err := p.Put(ctx, &TestItem{
+			Id:    store.NewId(fmt.Sprintf("page-%02d", i)),
+			Title: fmt.Sprintf("Title %d", i),
+		})
+		AssertNil(err)
+	}
+
+	t.Run("Walk all pages", func(t *testing.T) {
+		ids := []string{}
+		sizes := []int{}
+		req := store.PageRequest{Limit: 10}
+		for {
+			page, err := pager.ListPage(ctx, req)
+			AssertNil(err)
+			sizes = append(sizes, len(page.Items))
+			for _, item := range page.Items {
+				ids = append(ids, item.GetId())
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			req.Cursor = page.NextCursor
+		}
+
+		AssertEqual(sizes, []int{10, 10, 5})
+		AssertEqual(len(ids), total)
+		for i, id := range ids {
+			AssertEqual(id, fmt.Sprintf("page-%02d", i))
+		}
+	})
+
+	t.Run("Exact page size", func(t *testing.T) {
+		page, err := pager.ListPage(ctx, store.PageRequest{Limit: total})
+		AssertNil(err)
+		AssertEqual(len(page.Items), total)
+		AssertEqual(page.NextCursor, "")
+	})
+
+	t.Run("Default limit", func(t *testing.T) {
+		page, err := pager.ListPage(ctx, store.PageRequest{})
+		AssertNil(err)
+		AssertEqual(len(page.Items), total)
+	})
+
+	t.Run("Invalid cursor", func(t *testing.T) {
+		_, err := pager.ListPage(ctx, store.PageRequest{Cursor: "!!!"})
+		AssertTrue(errors.Is(err, store.ErrInvalidCursor))
+	})
+}
+
+func SuiteQuerier(p store.Storer[TestItem], t *testing.T) {
+
+	ctx := context.Background()
+
+	querier, ok := p.(store.Querier[TestItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.Querier", p)
+	}
+
+	items := []*TestItem{
+		{Id: store.NewId("q-1"), Title: "alpha", Counter: 1, Subitems: []*SubItem{{Field1: "x"}}},
+		{Id: store.NewId("q-2"), Title: "beta", Counter: 2},
+		{Id: store.NewId("q-3"), Title: "gamma", Counter: 3, Description: "desc"},
+		{Id: store.NewId("q-4"), Title: "Beta", Counter: 10},
+	}
+	for _, item := range items {
+		AssertNil(p.Put(ctx, item))
+	}
+
+	cases := []struct {
+		name     string
+		filter   store.Filter
+		expected []string
+	}{
+		{"empty", store.Filter{}, []string{"q-1", "q-2", "q-3", "q-4"}},
+		{"eq string", store.Eq("title", "beta"), []string{"q-2"}},
+		{"eq number", store.Eq("counter", 3), []string{"q-3"}},
+		{"eq id", store.Eq("id", "q-2"), []string{"q-2"}},
+		{"eq nested", store.Eq("subitems.0.field1", "x"), []string{"q-1"}},
+		{"ne", store.Ne("title", "beta"), []string{"q-1", "q-3", "q-4"}},
+		{"ne missing field", store.Ne("missing", "beta"), []string{"q-1", "q-2", "q-3", "q-4"}},
+		{"lt number", store.Lt("counter", 3), []string{"q-1", "q-2"}},
+		{"lte number", store.Lte("counter", 3), []string{"q-1", "q-2", "q-3"}},
+		{"gt number", store.Gt("counter", 2), []string{"q-3", "q-4"}},
+		{"gte number", store.Gte("counter", 10), []string{"q-4"}},
+		{"gte string", store.Gte("title", "beta"), []string{"q-2", "q-3"}},
+		{"lt string byte order", store.Lt("title", "alpha"), []string{"q-4"}},
+		{"gt type mismatch", store.Gt("counter", "2"), []string{}},
+		{"in strings", store.In("title", "alpha", "gamma"), []string{"q-1", "q-3"}},
+		{"in numbers", store.In("counter", 1, 10), []string{"q-1", "q-4"}},
+		{"in empty", store.In("counter"), []string{}},
+		{"exists nested", store.Exists("subitems.0.field1", true), []string{"q-1"}},
+		{"exists missing", store.Exists("missing", true), []string{}},
+		{"not exists missing", store.Exists("missing", false), []string{"q-1", "q-2", "q-3", "q-4"}},
+		{"and", store.And(store.Gt("counter", 1), store.Lt("counter", 10)), []string{"q-2", "q-3"}},
+		{"or", store.Or(store.Eq("title", "alpha"), store.Eq("counter", 10)), []string{"q-1", "q-4"}},
+		{"nested and/or", store.And(
+			store.Or(store.Eq("title", "alpha"), store.Eq("title", "gamma")),
+			store.Ne("description", "desc"),
+		), []string{"q-1"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := querier.Find(ctx, c.filter)
+			AssertNil(err)
+
+			ids := []string{}
+			for _, item := range result {
+				ids = append(ids, item.GetId())
+			}
+			sort.Strings(ids)
+			AssertEqual(ids, c.expected)
+		})
+	}
+
+	sortCases := []struct {
+		name     string
+		filter   store.Filter
+		sort     []store.SortField
+		expected []string
+	}{
+		{"sort number asc", store.Filter{}, []store.SortField{store.Asc("counter")}, []string{"q-1", "q-2", "q-3", "q-4"}},
+		{"sort number desc", store.Filter{}, []store.SortField{store.Desc("counter")}, []string{"q-4", "q-3", "q-2", "q-1"}},
+		{"sort string byte order", store.Filter{}, []store.SortField{store.Asc("title")}, []string{"q-4", "q-1", "q-2", "q-3"}},
+		{"sort tie-break by id", store.Filter{}, []store.SortField{store.Asc("description")}, []string{"q-1", "q-2", "q-4", "q-3"}},
+		{"sort multiple fields", store.Filter{}, []store.SortField{store.Desc("description"), store.Desc("counter")}, []string{"q-3", "q-4", "q-2", "q-1"}},
+		{"sort missing field asc", store.Filter{}, []store.SortField{store.Asc("missing")}, []string{"q-1", "q-2", "q-3", "q-4"}},
+		{"sort missing field desc", store.Filter{}, []store.SortField{store.Desc("missing")}, []string{"q-1", "q-2", "q-3", "q-4"}},
+		{"sort missing first", store.Filter{}, []store.SortField{store.Asc("subitems.0.field1")}, []string{"q-2", "q-3", "q-4", "q-1"}},
+		{"sort missing last when desc", store.Filter{}, []store.SortField{store.Desc("subitems.0.field1")}, []string{"q-1", "q-2", "q-3", "q-4"}},
+		{"sort by id desc", store.Filter{}, []store.SortField{store.Desc("id")}, []string{"q-4", "q-3", "q-2", "q-1"}},
+		{"sort filtered", store.Gt("counter", 1), []store.SortField{store.Desc("title")}, []string{"q-3", "q-2", "q-4"}},
+	}
+
+	for _, c := range sortCases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := querier.Find(ctx, c.filter, c.sort...)
+			AssertNil(err)
+
+			ids := []string{}
+			for _, item := range result {
+				ids = append(ids, item.GetId())
+			}
+			AssertEqual(ids, c.expected)
+		})
+	}
+
+	t.Run("sorted listing", func(t *testing.T) {
+		// Find with an empty filter lists all the items in the same order
+		// as SortItems, whatever the store
+		fields := []store.SortField{store.Asc("description"), store.Desc("title")}
+		expected, err := p.List(ctx)
+		AssertNil(err)
+		AssertNil(store.SortItems(expected, fields))
+
+		result, err := querier.Find(ctx, store.Filter{}, fields...)
+		AssertNil(err)
+		AssertEqual(len(result), len(expected))
+		for i := range result {
+			AssertEqual(result[i].GetId(), expected[i].GetId())
+		}
+	})
+
+	t.Run("invalid sort", func(t *testing.T) {
+		_, err := querier.Find(ctx, store.Filter{}, store.Asc(""))
+		AssertTrue(errors.Is(err, store.ErrInvalidFilter))
+	})
+
+	t.Run("invalid operator", func(t *testing.T) {
+		_, err := querier.Find(ctx, store.Filter{Op: "nope", Field: "title"})
+		AssertTrue(errors.Is(err, store.ErrInvalidFilter))
+	})
+
+	t.Run("invalid comparison", func(t *testing.T) {
+		_, err := querier.Find(ctx, store.Lt("title", true))
+		AssertTrue(errors.Is(err, store.ErrInvalidFilter))
+	})
+}
+
+func SuiteIterable(p store.Storer[TestItem], t *testing.T) {
+
+	ctx := context.Background()
+
+	iterable, ok := p.(store.Iterable[TestItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.Iterable", p)
+	}
+
+	t.Run("Iterate empty", func(t *testing.T) {
+		n := 0
+		for _, err := range iterable.Iterate(ctx) {
+			AssertNil(err)
+			n++
+		}
+		AssertEqual(n, 0)
+	})
+
+	total := 30
+	for i := 0; i < total; i++ {
+		err := p.Put(ctx, &TestItem{
+			Id:    store.NewId(fmt.Sprintf("iter-%02d", i)),
+			Title: fmt.Sprintf("Title %d", i),
+		})
+		AssertNil(err)
+	}
+
+	t.Run("Iterate all", func(t *testing.T) {
+		ids := map[string]bool{}
+		for item, err := range iterable.Iterate(ctx) {
+			AssertNil(err)
+			ids[item.GetId()] = true
+		}
+		AssertEqual(len(ids), total)
+	})
+
+	t.Run("Break early", func(t *testing.T) {
+		// Repeat to make sure underlying resources are released
+		for i := 0; i < 20; i++ {
+			n := 0
+			for _, err := range iterable.Iterate(ctx) {
+				AssertNil(err)
+				n++
+				if n == 5 {
+					break
+				}
+			}
+			AssertEqual(n, 5)
+		}
+
+		n := 0
+		for _, err := range iterable.Iterate(ctx) {
+			AssertNil(err)
+			n++
+		}
+		AssertEqual(n, total)
+	})
+
+	t.Run("Canceled context", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		var lastErr error
+		for _, err := range iterable.Iterate(canceled) {
+			lastErr = err
+		}
+		AssertNotNil(lastErr)
+	})
+}
+
+func SuiteRangeScanner(p store.Storer[TestItem], t *testing.T) {
+
+	ctx := context.Background()
+
+	scanner, ok := p.(store.RangeScanner[TestItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.RangeScanner", p)
+	}
+
+	ids := func(seq iter.Seq2[*TestItem, error]) []string {
+		result := []string{}
+		for item, err := range seq {
+			AssertNil(err)
+			result = append(result, item.GetId())
+		}
+		return result
+	}
+
+	t.Run("Scan empty", func(t *testing.T) {
+		AssertEqual(ids(scanner.ScanRange(ctx, "", "")), []string{})
+		AssertEqual(ids(scanner.ScanPrefix(ctx, "a")), []string{})
+	})
+
+	// Not in order, more than a chunk of the usual backends
+	all := []string{"b", "a/2", "ab", "a", "a/1", "c"}
+	for i := 0; i < 150; i++ {
+		all = append(all, fmt.Sprintf("m/%03d", 149-i))
+	}
+	for _, id := range all {
+		AssertNil(p.Put(ctx, &TestItem{Id: store.NewId(id)}))
+	}
+	sorted := append([]string{}, all...)
+	sort.Strings(sorted)
+
+	t.Run("Range all", func(t *testing.T) {
+		AssertEqual(ids(scanner.ScanRange(ctx, "", "")), sorted)
+	})
+
+	t.Run("Range bounds", func(t *testing.T) {
+		AssertEqual(ids(scanner.ScanRange(ctx, "a/", "b")), []string{"a/1", "a/2", "ab"})
+		AssertEqual(ids(scanner.ScanRange(ctx, "a/1", "a/2")), []string{"a/1"})
+		AssertEqual(ids(scanner.ScanRange(ctx, "b", "")), append([]string{"b", "c"}, sorted[6:]...))
+		AssertEqual(ids(scanner.ScanRange(ctx, "b", "b")), []string{})
+		AssertEqual(ids(scanner.ScanRange(ctx, "c", "b")), []string{})
+	})
+
+	t.Run("Prefix", func(t *testing.T) {
+		AssertEqual(ids(scanner.ScanPrefix(ctx, "a/")), []string{"a/1", "a/2"})
+		AssertEqual(ids(scanner.ScanPrefix(ctx, "a")), []string{"a", "a/1", "a/2", "ab"})
+		AssertEqual(ids(scanner.ScanPrefix(ctx, "m/")), sorted[6:])
+		AssertEqual(ids(scanner.ScanPrefix(ctx, "z")), []string{})
+		AssertEqual(ids(scanner.ScanPrefix(ctx, "")), sorted)
+	})
+
+	t.Run("Break early", func(t *testing.T) {
+		// Repeat to make sure underlying resources are released
+		for i := 0; i < 20; i++ {
+			n := 0
+			for _, err := range scanner.ScanPrefix(ctx, "m/") {
+				AssertNil(err)
+				n++
+				if n == 5 {
+					break
+				}
+			}
+			AssertEqual(n, 5)
+		}
+
+		// Writes are not blocked by a scan in progress
+		for item, err := range scanner.ScanRange(ctx, "", "") {
+			AssertNil(err)
+			item.Title = "scanned"
+			AssertNil(p.Put(ctx, item))
+		}
+		item, err := p.Get(ctx, "m/042")
+		AssertNil(err)
+		AssertEqual(item.Title, "scanned")
+	})
+
+	t.Run("Canceled context", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		var lastErr error
+		for _, err := range scanner.ScanRange(canceled, "", "") {
+			lastErr = err
+		}
+		AssertNotNil(lastErr)
+	})
+}
+
+func SuiteBatch(p store.Storer[TestItem], t *testing.T) {
+
+	ctx := context.Background()
+
+	batch, ok := p.(store.BatchStorer[TestItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.BatchStorer", p)
+	}
+
+	t.Run("Get many missing", func(t *testing.T) {
+		items, err := batch.GetMany(ctx, []string{"b-0", "b-1"})
+		AssertNil(err)
+		AssertEqual(len(items), 2)
+		AssertNil(items[0])
+		AssertNil(items[1])
+	})
+
+	t.Run("Put many", func(t *testing.T) {
+		items := []*TestItem{}
+		for i := 0; i < 10; i++ {
+			items = append(items, &TestItem{
+				Id:    store.NewId(fmt.Sprintf("b-%d", i)),
+				Title: fmt.Sprintf("Title %d", i),
+			})
+		}
+		err := batch.PutMany(ctx, items)
+		AssertNil(err)
+	})
+
+	t.Run("Get many keeps order", func(t *testing.T) {
+		items, err := batch.GetMany(ctx, []string{"b-3", "missing", "b-1"})
+		AssertNil(err)
+		AssertEqual(len(items), 3)
+		AssertEqual(items[0].GetId(), "b-3")
+		AssertEqual(items[0].Title, "Title 3")
+		AssertNil(items[1])
+		AssertEqual(items[2].GetId(), "b-1")
+	})
+
+	t.Run("Put many reports conflicts per item", func(t *testing.T) {
+		items, err := batch.GetMany(ctx, []string{"b-0", "b-1"})
+		AssertNil(err)
+		stale, fresh := items[0], items[1]
+
+		// Somebody else updates b-0
+		other, err := p.Get(ctx, "b-0")
+		AssertNil(err)
+		other.Title = "Updated by other"
+		AssertNil(p.Put(ctx, other))
+
+		stale.Title = "Stale update"
+		fresh.Title = "Fresh update"
+		err = batch.PutMany(ctx, []*TestItem{
+			stale,
+			fresh,
+			{Id: store.NewId("b-10"), Title: "Title 10"},
+		})
+		AssertTrue(errors.Is(err, store.ErrVersionGone))
+
+		var batchErr *store.BatchError
+		AssertTrue(errors.As(err, &batchErr))
+		AssertEqual(len(batchErr.Errors), 3)
+		AssertEqual(batchErr.Errors[0], store.ErrVersionGone)
+		AssertNil(batchErr.Errors[1])
+		AssertNil(batchErr.Errors[2])
+
+		items, err = batch.GetMany(ctx, []string{"b-0", "b-1", "b-10"})
+		AssertNil(err)
+		AssertEqual(items[0].Title, "Updated by other")
+		AssertEqual(items[1].Title, "Fresh update")
+		AssertEqual(items[2].Title, "Title 10")
+	})
+
+	t.Run("Put many with repeated ids", func(t *testing.T) {
+		err := batch.PutMany(ctx, []*TestItem{
+			{Id: store.NewId("b-dup"), Title: "first"},
+			{Id: store.NewId("b-dup"), Title: "second"},
+		})
+
+		var batchErr *store.BatchError
+		AssertTrue(errors.As(err, &batchErr))
+		AssertNil(batchErr.Errors[0])
+		AssertEqual(batchErr.Errors[1], store.ErrVersionGone)
+
+		item, err := p.Get(ctx, "b-dup")
+		AssertNil(err)
+		AssertEqual(item.Title, "first")
+	})
+
+	t.Run("Delete many", func(t *testing.T) {
+		err := batch.DeleteMany(ctx, []string{"b-0", "b-1", "missing"})
+		AssertNil(err)
+
+		items, err := batch.GetMany(ctx, []string{"b-0", "b-1", "b-2"})
+		AssertNil(err)
+		AssertNil(items[0])
+		AssertNil(items[1])
+		AssertNotNil(items[2])
+
+		list, err := p.List(ctx)
+		AssertNil(err)
+		AssertEqual(len(list), 10)
+	})
+}
+
+func SuiteTransactor(p store.Storer[TestItem], t *testing.T) {
+	suiteTransactor(p, false, t)
+}
+
+// SuiteSerializedTransactor is SuiteTransactor for stores whose transactions
+// hold the write lock until they end, so a write outside of a transaction
+// waits for it instead of making it fail
+func SuiteSerializedTransactor(p store.Storer[TestItem], t *testing.T) {
+	suiteTransactor(p, true, t)
+}
+
+func suiteTransactor(p store.Storer[TestItem], serialized bool, t *testing.T) {
+
+	ctx := context.Background()
+
+	transactor, ok := p.(store.Transactor[TestItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.Transactor", p)
+	}
+
+	getCounter := func(id string) int {
+		item, err := p.Get(ctx, id)
+		AssertNil(err)
+		AssertNotNil(item)
+		return item.Counter
+	}
+
+	t.Run("Commit", func(t *testing.T) {
+		err := transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+			if err := tx.Put(ctx, &TestItem{Id: store.NewId("tx-a"), Counter: 10}); err != nil {
+				return err
+			}
+			return tx.Put(ctx, &TestItem{Id: store.NewId("tx-b"), Counter: 0})
+		})
+		AssertNil(err)
+		AssertEqual(getCounter("tx-a"), 10)
+		AssertEqual(getCounter("tx-b"), 0)
+	})
+
+	t.Run("Move counter", func(t *testing.T) {
+		err := transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+			a, err := tx.Get(ctx, "tx-a")
+			if err != nil {
+				return err
+			}
+			b, err := tx.Get(ctx, "tx-b")
+			if err != nil {
+				return err
+			}
+			a.Counter -= 3
+			b.Counter += 3
+			if err := tx.Put(ctx, a); err != nil {
+				return err
+			}
+			return tx.Put(ctx, b)
+		})
+		AssertNil(err)
+		AssertEqual(getCounter("tx-a"), 7)
+		AssertEqual(getCounter("tx-b"), 3)
+	})
+
+	t.Run("Rollback on error", func(t *testing.T) {
+		boom := errors.New("boom")
+		err := transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+			a, err := tx.Get(ctx, "tx-a")
+			if err != nil {
+				return err
+			}
+			a.Counter = 100
+			if err := tx.Put(ctx, a); err != nil {
+				return err
+			}
+			if err := tx.Delete(ctx, "tx-b"); err != nil {
+				return err
+			}
+			return boom
+		})
+		AssertEqual(err, boom)
+		AssertEqual(getCounter("tx-a"), 7)
+		AssertEqual(getCounter("tx-b"), 3)
+	})
+
+	t.Run("Reads see own writes", func(t *testing.T) {
+		err := transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+			AssertNil(tx.Put(ctx, &TestItem{Id: store.NewId("tx-c"), Counter: 1}))
+			AssertNil(tx.Delete(ctx, "tx-a"))
+
+			c, err := tx.Get(ctx, "tx-c")
+			AssertNil(err)
+			AssertNotNil(c)
+
+			a, err := tx.Get(ctx, "tx-a")
+			AssertNil(err)
+			AssertNil(a)
+
+			items, err := tx.List(ctx)
+			AssertNil(err)
+			ids := []string{}
+			for _, item := range items {
+				ids = append(ids, item.GetId())
+			}
+			sort.Strings(ids)
+			AssertEqual(ids, []string{"tx-b", "tx-c"})
+
+			return errors.New("rollback")
+		})
+		AssertNotNil(err)
+
+		c, err := p.Get(ctx, "tx-c")
+		AssertNil(err)
+		AssertNil(c)
+		AssertEqual(getCounter("tx-a"), 7)
+	})
+
+	t.Run("Version conflict aborts everything", func(t *testing.T) {
+		if serialized {
+			t.Skip("writes outside the transaction wait for it")
+		}
+
+		err := transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+			a, err := tx.Get(ctx, "tx-a")
+			if err != nil {
+				return err
+			}
+			b, err := tx.Get(ctx, "tx-b")
+			if err != nil {
+				return err
+			}
+
+			// Somebody else updates a outside the transaction
+			other, err := p.Get(ctx, "tx-a")
+			AssertNil(err)
+			other.Title = "Updated by other"
+			AssertNil(p.Put(ctx, other))
+
+			b.Counter = 50
+			if err := tx.Put(ctx, b); err != nil {
+				return err
+			}
+			a.Counter = 50
+			return tx.Put(ctx, a)
+		})
+		AssertTrue(errors.Is(err, store.ErrVersionGone))
+		AssertEqual(getCounter("tx-a"), 7)
+		AssertEqual(getCounter("tx-b"), 3)
+	})
+
+	if serialized {
+		t.Run("Write outside waits for the transaction", func(t *testing.T) {
+			other := make(chan error, 1)
+			err := transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+				a, err := tx.Get(ctx, "tx-a")
+				if err != nil {
+					return err
+				}
+
+				// Somebody else updates a outside the transaction
+				outside, err := p.Get(ctx, "tx-a")
+				AssertNil(err)
+				go func() {
+					outside.Title = "Updated by other"
+					other <- p.Put(ctx, outside)
+				}()
+
+				select {
+				case err := <-other:
+					t.Fatalf("write outside the transaction did not wait: %v", err)
+				case <-time.After(100 * time.Millisecond):
+				}
+
+				a.Counter = 8
+				return tx.Put(ctx, a)
+			})
+			AssertNil(err)
+			AssertTrue(errors.Is(<-other, store.ErrVersionGone))
+			AssertEqual(getCounter("tx-a"), 8)
+
+			a, err := p.Get(ctx, "tx-a")
+			AssertNil(err)
+			a.Counter = 7
+			AssertNil(p.Put(ctx, a))
+		})
+	}
+
+	t.Run("Failed commit keeps versions", func(t *testing.T) {
+		b, err := p.Get(ctx, "tx-b")
+		AssertNil(err)
+		version := b.GetVersion()
+
+		err = transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+			if _, err := tx.Get(ctx, "tx-a"); err != nil {
+				return err
+			}
+			b.Counter = 60
+			if err := tx.Put(ctx, b); err != nil {
+				return err
+			}
+			return errors.New("rollback")
+		})
+		AssertNotNil(err)
+		AssertEqual(b.GetVersion(), version)
+
+		// Retry with the same item
+		err = transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+			return tx.Put(ctx, b)
+		})
+		AssertNil(err)
+		AssertEqual(b.GetVersion(), version+1)
+		AssertEqual(getCounter("tx-b"), 60)
+	})
+
+	t.Run("Changes after Put are not written", func(t *testing.T) {
+		item := &TestItem{Id: store.NewId("tx-d"), Counter: 1}
+		err := transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+			if err := tx.Put(ctx, item); err != nil {
+				return err
+			}
+			item.Counter = 2
+			return nil
+		})
+		AssertNil(err)
+		AssertEqual(item.GetVersion(), int64(1))
+		AssertEqual(getCounter("tx-d"), 1)
+	})
+}
+
+func SuiteWatcher(p store.Storer[TestItem], t *testing.T) {
+
+	watcher, ok := p.(store.Watcher[TestItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.Watcher", p)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := watcher.Watch(ctx, "")
+	AssertNil(err)
+
+	next := func(t *testing.T) store.ChangeEvent[TestItem] {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("watch channel closed")
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for change event")
+		}
+		return store.ChangeEvent[TestItem]{}
+	}
+
+	t.Run("Insert", func(t *testing.T) {
+		AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("w-1"), Title: "created"}))
+
+		event := next(t)
+		AssertEqual(event.Op, store.ChangeInsert)
+		AssertEqual(event.Id, "w-1")
+		AssertEqual(event.Item.Title, "created")
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		item, err := p.Get(ctx, "w-1")
+		AssertNil(err)
+		item.Title = "updated"
+		AssertNil(p.Put(ctx, item))
+
+		stored, err := p.Get(ctx, "w-1")
+		AssertNil(err)
+
+		event := next(t)
+		AssertEqual(event.Op, store.ChangeUpdate)
+		AssertEqual(event.Id, "w-1")
+		AssertEqual(event.Item.Title, "updated")
+		AssertEqual(event.NewVersion, stored.GetVersion())
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		AssertNil(p.Delete(ctx, "w-1"))
+
+		event := next(t)
+		AssertEqual(event.Op, store.ChangeDelete)
+		AssertEqual(event.Id, "w-1")
+		AssertNil(event.Item)
+	})
+
+	t.Run("Closed on cancel", func(t *testing.T) {
+		cancel()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+			case <-timeout:
+				t.Fatal("watch channel not closed")
+			}
+		}
+	})
+}
+
+func SuiteVersionDeleter(p store.Storer[TestItem], t *testing.T) {
+
+	ctx := context.Background()
+
+	deleter, ok := p.(store.VersionDeleter[TestItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.VersionDeleter", p)
+	}
+
+	AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("d-1"), Title: "to delete"}))
+	stored, err := p.Get(ctx, "d-1")
+	AssertNil(err)
+	AssertNotNil(stored)
+
+	t.Run("Missing id", func(t *testing.T) {
+		err := deleter.DeleteVersion(ctx, "missing", 1)
+		AssertTrue(errors.Is(err, store.ErrNotFound))
+	})
+
+	t.Run("Wrong version", func(t *testing.T) {
+		err := deleter.DeleteVersion(ctx, "d-1", stored.GetVersion()+1)
+		AssertTrue(errors.Is(err, store.ErrVersionGone))
+
+		item, err := p.Get(ctx, "d-1")
+		AssertNil(err)
+		AssertNotNil(item)
+	})
+
+	t.Run("Right version", func(t *testing.T) {
+		err := deleter.DeleteVersion(ctx, "d-1", stored.GetVersion())
+		AssertNil(err)
+
+		item, err := p.Get(ctx, "d-1")
+		AssertNil(err)
+		AssertNil(item)
+	})
+
+	t.Run("Already deleted", func(t *testing.T) {
+		err := deleter.DeleteVersion(ctx, "d-1", stored.GetVersion())
+		AssertTrue(errors.Is(err, store.ErrNotFound))
+	})
+}
+
+// SuiteAliasing checks that callers never share memory with the store: items
+// given to it or returned by it can be changed freely
+func SuiteAliasing(p store.Storer[TestItem], t *testing.T) {
+
+	ctx := context.Background()
+
+	original := func() *TestItem {
+		return &TestItem{
+			Id:       store.NewId("alias-1"),
+			Title:    "original",
+			Subitems: []*SubItem{{Field1: "original"}},
+		}
+	}
+
+	unchanged := func() {
+		stored, err := p.Get(ctx, "alias-1")
+		AssertNil(err)
+		AssertNotNil(stored)
+		AssertEqual(stored.Title, "original")
+		AssertEqual(stored.Subitems[0].Field1, "original")
+	}
+
+	change := func(item *TestItem) {
+		item.Title = "changed"
+		item.Subitems[0].Field1 = "changed"
+		item.Subitems = append(item.Subitems, &SubItem{Field1: "added"})
+	}
+
+	item := original()
+	AssertNil(p.Put(ctx, item))
+
+	t.Run("Change after Put", func(t *testing.T) {
+		change(item)
+		unchanged()
+	})
+
+	t.Run("Change after Get", func(t *testing.T) {
+		stored, err := p.Get(ctx, "alias-1")
+		AssertNil(err)
+		change(stored)
+		unchanged()
+	})
+
+	t.Run("Change after List", func(t *testing.T) {
+		items, err := p.List(ctx)
+		AssertNil(err)
+		for _, item := range items {
+			change(item)
+		}
+		unchanged()
+	})
+
+	t.Run("Change after GetMany", func(t *testing.T) {
+		items, err := store.GetMany(ctx, p, []string{"alias-1"})
+		AssertNil(err)
+		change(items[0])
+		unchanged()
+	})
+
+	t.Run("Change after update", func(t *testing.T) {
+		stored, err := p.Get(ctx, "alias-1")
+		AssertNil(err)
+		AssertNil(p.Put(ctx, stored))
+		change(stored)
+		unchanged()
+	})
+
+	if querier, ok := p.(store.Querier[TestItem]); ok {
+		t.Run("Change after Find", func(t *testing.T) {
+			items, err := querier.Find(ctx, store.Eq("id", "alias-1"))
+			AssertNil(err)
+			for _, item := range items {
+				change(item)
+			}
+			unchanged()
+		})
+	}
+
+	if transactor, ok := p.(store.Transactor[TestItem]); ok {
+		t.Run("Change after commit", func(t *testing.T) {
+			var updated *TestItem
+			err := transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+				stored, err := tx.Get(ctx, "alias-1")
+				if err != nil {
+					return err
+				}
+				updated = stored
+				return tx.Put(ctx, stored)
+			})
+			AssertNil(err)
+			change(updated)
+			unchanged()
+		})
+	}
+}
+
+// SuiteFieldEncryption expects p to be a store.FieldEncryptedStore writing
+// to raw
+func SuiteFieldEncryption(p, raw store.Storer[SecretItem], t *testing.T) {
+
+	ctx := context.Background()
+
+	querier, ok := p.(store.Querier[SecretItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.Querier", p)
+	}
+
+	ids := func(items []*SecretItem, err error) []string {
+		AssertNil(err)
+		result := []string{}
+		for _, item := range items {
+			result = append(result, item.GetId())
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	alice := &SecretItem{
+		Id:    store.NewId("s-1"),
+		Name:  "alice",
+		Email: "shared@example.com",
+		Notes: "same notes",
+		Cards: []*SecretCard{{Number: "1111"}},
+	}
+	AssertNil(p.Put(ctx, alice))
+	AssertNil(p.Put(ctx, &SecretItem{Id: store.NewId("s-2"), Name: "bob", Email: "shared@example.com", Notes: "same notes"}))
+	AssertNil(p.Put(ctx, &SecretItem{Id: store.NewId("s-3"), Name: "carol", Email: "carol@example.com"}))
+
+	t.Run("Put does not change the item", func(t *testing.T) {
+		AssertEqual(alice.Email, "shared@example.com")
+		AssertEqual(alice.Cards[0].Number, "1111")
+		AssertEqual(alice.GetVersion(), int64(1))
+	})
+
+	t.Run("Get decrypts", func(t *testing.T) {
+		item, err := p.Get(ctx, "s-1")
+		AssertNil(err)
+		AssertEqual(item.Name, "alice")
+		AssertEqual(item.Email, "shared@example.com")
+		AssertEqual(item.Notes, "same notes")
+		AssertEqual(item.Cards[0].Number, "1111")
+	})
+
+	t.Run("Stored encrypted", func(t *testing.T) {
+		stored, err := raw.Get(ctx, "s-1")
+		AssertNil(err)
+		AssertEqual(stored.Name, "alice")
+		AssertTrue(stored.Email != "shared@example.com")
+		AssertTrue(stored.Notes != "same notes")
+		AssertTrue(stored.Cards[0].Number != "1111")
+
+		other, err := raw.Get(ctx, "s-2")
+		AssertNil(err)
+		AssertEqual(other.Email, stored.Email) // deterministic
+		AssertTrue(other.Notes != stored.Notes)
+	})
+
+	t.Run("List decrypts", func(t *testing.T) {
+		items, err := p.List(ctx)
+		AssertNil(err)
+		AssertEqual(len(items), 3)
+		for _, item := range items {
+			AssertTrue(strings.HasSuffix(item.Email, "@example.com"))
+		}
+	})
+
+	t.Run("Find by deterministic field", func(t *testing.T) {
+		AssertEqual(ids(querier.Find(ctx, store.Eq("email", "shared@example.com"))), []string{"s-1", "s-2"})
+		AssertEqual(ids(querier.Find(ctx, store.Ne("email", "shared@example.com"))), []string{"s-3"})
+		AssertEqual(ids(querier.Find(ctx, store.In("email", "carol@example.com", "nobody@example.com"))), []string{"s-3"})
+		AssertEqual(ids(querier.Find(ctx, store.And(store.Eq("email", "shared@example.com"), store.Eq("name", "bob")))), []string{"s-2"})
+	})
+
+	t.Run("Find by plain field", func(t *testing.T) {
+		items, err := querier.Find(ctx, store.Eq("name", "carol"))
+		AssertNil(err)
+		AssertEqual(len(items), 1)
+		AssertEqual(items[0].Email, "carol@example.com")
+	})
+
+	t.Run("Encrypted fields can not be compared", func(t *testing.T) {
+		_, err := querier.Find(ctx, store.Eq("notes", "same notes"))
+		AssertTrue(errors.Is(err, store.ErrInvalidFilter))
+
+		_, err = querier.Find(ctx, store.Gt("email", "a"))
+		AssertTrue(errors.Is(err, store.ErrInvalidFilter))
+
+		_, err = querier.Find(ctx, store.Filter{}, store.Asc("email"))
+		AssertTrue(errors.Is(err, store.ErrInvalidFilter))
+	})
+
+	t.Run("Values can not be moved between items", func(t *testing.T) {
+		a, err := raw.Get(ctx, "s-1")
+		AssertNil(err)
+		b, err := raw.Get(ctx, "s-2")
+		AssertNil(err)
+		b.Notes = a.Notes
+		AssertNil(raw.Put(ctx, b))
+
+		_, err = p.Get(ctx, "s-2")
+		AssertNotNil(err)
+	})
+}
+
+// TestItemConstraints are the unique constraints expected by
+// SuiteUniqueConstraints
+var TestItemConstraints = []store.UniqueConstraint{
+	{Name: "unique_description", Field: "description"},
+	{Name: "unique_subitem", Field: "subitems.0.field1"},
+}
+
+// SuiteUniqueConstraints expects p to be built with TestItemConstraints
+func SuiteUniqueConstraints(p store.Storer[TestItem], t *testing.T) {
+
+	ctx := context.Background()
+
+	violated := func(err error, constraint string) {
+		AssertTrue(errors.Is(err, store.ErrUniqueViolation))
+		var violation *store.UniqueViolationError
+		AssertTrue(errors.As(err, &violation))
+		AssertEqual(violation.Constraint, constraint)
+	}
+
+	AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("u-1"), Description: "d1"}))
+
+	t.Run("Duplicated value", func(t *testing.T) {
+		item := &TestItem{Id: store.NewId("u-2"), Description: "d1"}
+		violated(p.Put(ctx, item), "unique_description")
+		AssertEqual(item.GetVersion(), int64(0))
+
+		stored, err := p.Get(ctx, "u-2")
+		AssertNil(err)
+		AssertNil(stored)
+	})
+
+	t.Run("Empty values are not constrained", func(t *testing.T) {
+		AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("u-3")}))
+		AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("u-4")}))
+	})
+
+	t.Run("Update keeping the value", func(t *testing.T) {
+		item, err := p.Get(ctx, "u-1")
+		AssertNil(err)
+		item.Title = "changed"
+		AssertNil(p.Put(ctx, item))
+	})
+
+	t.Run("Update to a taken value", func(t *testing.T) {
+		item, err := p.Get(ctx, "u-3")
+		AssertNil(err)
+		item.Description = "d1"
+		violated(p.Put(ctx, item), "unique_description")
+
+		stored, err := p.Get(ctx, "u-3")
+		AssertNil(err)
+		AssertEqual(stored.Description, "")
+	})
+
+	t.Run("Value freed by update", func(t *testing.T) {
+		item, err := p.Get(ctx, "u-1")
+		AssertNil(err)
+		item.Description = "d2"
+		AssertNil(p.Put(ctx, item))
+
+		AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("u-5"), Description: "d1"}))
+	})
+
+	t.Run("Value freed by delete", func(t *testing.T) {
+		AssertNil(p.Delete(ctx, "u-5"))
+		AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("u-6"), Description: "d1"}))
+	})
+
+	t.Run("Nested field", func(t *testing.T) {
+		AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("u-7"), Subitems: []*SubItem{{Field1: "f1"}}}))
+		// only the first subitem is constrained
+		AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("u-8"), Subitems: []*SubItem{{Field1: "f2"}, {Field1: "f1"}}}))
+
+		err := p.Put(ctx, &TestItem{Id: store.NewId("u-9"), Subitems: []*SubItem{{Field1: "f1"}}})
+		violated(err, "unique_subitem")
+	})
+
+	if strict, ok := p.(store.StrictStorer[TestItem]); ok {
+		t.Run("Create duplicated value", func(t *testing.T) {
+			err := strict.Create(ctx, &TestItem{Id: store.NewId("u-10"), Description: "d2"})
+			violated(err, "unique_description")
+		})
+	}
+
+	t.Run("PutMany duplicated value", func(t *testing.T) {
+		err := store.PutMany(ctx, p, []*TestItem{
+			{Id: store.NewId("u-11"), Description: "d11"},
+			{Id: store.NewId("u-12"), Description: "d2"},
+		})
+		var batchErr *store.BatchError
+		AssertTrue(errors.As(err, &batchErr))
+		AssertNil(batchErr.Errors[0])
+		violated(batchErr.Errors[1], "unique_description")
+
+		stored, err := p.Get(ctx, "u-11")
+		AssertNil(err)
+		AssertNotNil(stored)
+	})
+}
+
+// SuiteIndexer expects p to be built with TestItemIndexes
+func SuiteIndexer(p store.Storer[TestItem], t *testing.T) {
+
+	ctx := context.Background()
+
+	getter, ok := p.(store.IndexGetter[TestItem])
+	if !ok {
+		t.Fatalf("%T does not implement store.IndexGetter", p)
+	}
+
+	ids := func(items []*TestItem, err error) []string {
+		AssertNil(err)
+		result := []string{}
+		for _, item := range items {
+			result = append(result, item.GetId())
+		}
+		return result
+	}
+
+	AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("ix-1"), Title: "a", Description: "d1"}))
+	AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("ix-2"), Title: "a", Description: "d2"}))
+	AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("ix-3"), Title: "b"}))
+
+	t.Run("Get by non unique", func(t *testing.T) {
+		AssertEqual(ids(getter.GetBy(ctx, "title", "a")), []string{"ix-1", "ix-2"})
+		AssertEqual(ids(getter.GetBy(ctx, "title", "b")), []string{"ix-3"})
+		AssertEqual(ids(getter.GetBy(ctx, "title", "missing")), []string{})
+	})
+
+	t.Run("Get by unique", func(t *testing.T) {
+		items, err := getter.GetBy(ctx, "description", "d1")
+		AssertNil(err)
+		AssertEqual(len(items), 1)
+		AssertEqual(items[0].Title, "a")
+	})
+
+	t.Run("Unknown index", func(t *testing.T) {
+		_, err := getter.GetBy(ctx, "missing", "a")
+		AssertTrue(errors.Is(err, store.ErrUnknownIndex))
+	})
+
+	t.Run("Unique violation", func(t *testing.T) {
+		err := p.Put(ctx, &TestItem{Id: store.NewId("ix-4"), Description: "d1"})
+		AssertTrue(errors.Is(err, store.ErrUniqueViolation))
+
+		item, err := p.Get(ctx, "ix-4")
+		AssertNil(err)
+		AssertNil(item)
+	})
+
+	t.Run("Empty keys are not unique", func(t *testing.T) {
+		AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("ix-5"), Title: "c"}))
+		AssertEqual(ids(getter.GetBy(ctx, "description", "")), []string{})
+	})
+
+	t.Run("Update moves the keys", func(t *testing.T) {
+		item, err := p.Get(ctx, "ix-1")
+		AssertNil(err)
+		item.Title = "b"
+		item.Description = "d3"
+		AssertNil(p.Put(ctx, item))
+
+		AssertEqual(ids(getter.GetBy(ctx, "title", "a")), []string{"ix-2"})
+		AssertEqual(ids(getter.GetBy(ctx, "title", "b")), []string{"ix-1", "ix-3"})
+		AssertEqual(ids(getter.GetBy(ctx, "description", "d1")), []string{})
+
+		// d1 is free now
+		item, err = p.Get(ctx, "ix-2")
+		AssertNil(err)
+		item.Description = "d1"
+		AssertNil(p.Put(ctx, item))
+		AssertEqual(ids(getter.GetBy(ctx, "description", "d1")), []string{"ix-2"})
+	})
+
+	t.Run("Update to a taken key", func(t *testing.T) {
+		item, err := p.Get(ctx, "ix-1")
+		AssertNil(err)
+		item.Description = "d1"
+		err = p.Put(ctx, item)
+		AssertTrue(errors.Is(err, store.ErrUniqueViolation))
+		AssertEqual(ids(getter.GetBy(ctx, "description", "d3")), []string{"ix-1"})
+	})
+
+	t.Run("Delete removes the keys", func(t *testing.T) {
+		AssertNil(p.Delete(ctx, "ix-2"))
+		AssertEqual(ids(getter.GetBy(ctx, "title", "a")), []string{})
+		AssertEqual(ids(getter.GetBy(ctx, "description", "d1")), []string{})
+	})
+
+	if transactor, ok := p.(store.Transactor[TestItem]); ok {
+		t.Run("Swap unique keys in a transaction", func(t *testing.T) {
+			AssertNil(p.Put(ctx, &TestItem{Id: store.NewId("ix-6"), Description: "d6"}))
+
+			err := transactor.WithTx(ctx, func(tx store.Storer[TestItem]) error {
+				a, err := tx.Get(ctx, "ix-1")
+				if err != nil {
+					return err
+				}
+				b, err := tx.Get(ctx, "ix-6")
+				if err != nil {
+					return err
+				}
+				a.Description, b.Description = b.Description, a.Description
+				if err := tx.Put(ctx, a); err != nil {
+					return err
+				}
+				return tx.Put(ctx, b)
+			})
+			AssertNil(err)
+
+			AssertEqual(ids(getter.GetBy(ctx, "description", "d6")), []string{"ix-1"})
+			AssertEqual(ids(getter.GetBy(ctx, "description", "d3")), []string{"ix-6"})
+		})
+	}
 }
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrTxNotSupported = errors.New("transactions not supported")
+
+// Transactor runs fn in a transaction: either all the writes done through tx
+// are applied or none. If fn returns an error the transaction is discarded and
+// the error is returned. Optimistic version checks are the same as Put and a
+// conflict fails the whole transaction with ErrVersionGone.
+type Transactor[T Identifier] interface {
+	WithTx(ctx context.Context, fn func(tx Storer[T]) error) error
+}
+
+// stagedEntry keeps the pending write of an id and the state of the item in
+// the store when it was first touched, used to detect conflicts on commit.
+type stagedEntry[T Identifier] struct {
+	item        *T // nil means deleted
+	baseFound   bool
+	baseVersion int64
+}
+
+// stagedTx is a Storer that buffers writes in memory, reads see the pending
+// writes first and fall back to base. It is used by local stores to implement
+// transactions: stage with fn, then validate and apply under a lock.
+type stagedTx[T Identifier] struct {
+	base      Storer[T]
+	versioned bool // apply the optimistic locking of StoreMemory.Put
+	codec     Codec
+	entries   map[string]*stagedEntry[T]
+	order     []string
+	versions  map[*T]int64 // the versions of the items put, set on commit
+}
+
+func newStagedTx[T Identifier](base Storer[T], versioned bool, codec Codec) *stagedTx[T] {
+	return &stagedTx[T]{
+		base:      base,
+		versioned: versioned,
+		codec:     codec,
+		entries:   map[string]*stagedEntry[T]{},
+		versions:  map[*T]int64{},
+	}
+}
+
+func (s *stagedTx[T]) entry(ctx context.Context, id string) (*stagedEntry[T], error) {
+	if e, ok := s.entries[id]; ok {
+		return e, nil
+	}
+
+	current, err := s.base.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &stagedEntry[T]{
+		item: current,
+	}
+	if current != nil {
+		e.baseFound = true
+		e.baseVersion = (*current).GetVersion()
+	}
+	s.entries[id] = e
+	s.order = append(s.order, id)
+	return e, nil
+}
+
+func (s *stagedTx[T]) List(ctx context.Context) ([]*T, error) {
+	items, err := s.base.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*T{}
+	for _, item := range items {
+		if _, staged := s.entries[(*item).GetId()]; !staged {
+			result = append(result, item)
+		}
+	}
+	for _, id := range s.order {
+		if item := s.entries[id].item; item != nil {
+			newItem, err := copyItem(s.codec, item)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, newItem)
+		}
+	}
+
+	return result, nil
+}
+
+// Put stages a copy of item, so later changes to item are not written. The
+// new version is set on item by commit, an item put again before that is at
+// the version it was staged with.
+func (s *stagedTx[T]) Put(ctx context.Context, item *T) error {
+	e, err := s.entry(ctx, (*item).GetId())
+	if err != nil {
+		return err
+	}
+
+	version, staged := s.versions[item]
+	if !staged {
+		version = (*item).GetVersion()
+	}
+	if s.versioned {
+		if e.item != nil && (*e.item).GetVersion() != version {
+			return ErrVersionGone
+		}
+		version++
+	}
+
+	copied, err := copyItem(s.codec, item)
+	if err != nil {
+		return err
+	}
+	(*copied).SetVersion(version)
+
+	e.item = copied
+	s.versions[item] = version
+	return nil
+}
+
+func (s *stagedTx[T]) Get(ctx context.Context, id string) (*T, error) {
+	e, ok := s.entries[id]
+	if !ok {
+		return s.base.Get(ctx, id)
+	}
+	if e.item == nil {
+		return nil, nil
+	}
+
+	return copyItem(s.codec, e.item)
+}
+
+func (s *stagedTx[T]) Delete(ctx context.Context, id string) error {
+	e, err := s.entry(ctx, id)
+	if err != nil {
+		return err
+	}
+	e.item = nil
+	return nil
+}
+
+// changed reports if the committed item is no longer the one the transaction
+// was based on
+func (e *stagedEntry[T]) changed(current *T) bool {
+	if current == nil {
+		return e.baseFound
+	}
+	return !e.baseFound || (*current).GetVersion() != e.baseVersion
+}
+
+// commit sets the new versions on the items put, once the writes are applied
+func (s *stagedTx[T]) commit() {
+	for item, version := range s.versions {
+		(*item).SetVersion(version)
+	}
+}
+
+// writes returns the pending puts and deletes in the order they were touched
+func (s *stagedTx[T]) writes() (puts []*T, deletes []string) {
+	for _, id := range s.order {
+		e := s.entries[id]
+		if e.item != nil {
+			puts = append(puts, e.item)
+		} else if e.baseFound {
+			deletes = append(deletes, id)
+		}
+	}
+	return
+}
+
+// StagedTx is a transaction buffered by Stage. Stores in other packages use it
+// to implement transactions: validate every id of Ids against the committed
+// item with Changed (failing with ErrVersionGone), apply Writes at once and
+// then call Committed.
+type StagedTx[T Identifier] struct {
+	tx *stagedTx[T]
+}
+
+// Stage runs fn buffering its writes in memory, with the optimistic locking of
+// Put. Reads see the pending writes first and fall back to base, nothing is
+// written to base.
+func Stage[T Identifier](base Storer[T], codec Codec, fn func(tx Storer[T]) error) (*StagedTx[T], error) {
+	tx := newStagedTx[T](base, true, codec)
+	if err := fn(tx); err != nil {
+		return nil, err
+	}
+	return &StagedTx[T]{tx: tx}, nil
+}
+
+// Ids returns the ids written by the transaction, in the order they were
+// first touched
+func (s *StagedTx[T]) Ids() []string {
+	return s.tx.order
+}
+
+// Changed reports if current, the committed item of id (nil if missing), is no
+// longer the one the transaction was based on
+func (s *StagedTx[T]) Changed(id string, current *T) bool {
+	e, ok := s.tx.entries[id]
+	return ok && e.changed(current)
+}
+
+// Writes returns the pending puts (copies with their new versions) and
+// deletes in the order they were touched
+func (s *StagedTx[T]) Writes() (puts []*T, deletes []string) {
+	return s.tx.writes()
+}
+
+// Committed sets the new versions on the items passed to Put, it must be
+// called once the writes are applied. Until then they keep their versions, so
+// a transaction failing on commit can be retried with the same items.
+func (s *StagedTx[T]) Committed() {
+	s.tx.commit()
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrWatchNotSupported = errors.New("watch not supported")
+var ErrResumeNotSupported = errors.New("resume not supported")
+
+type ChangeOp string
+
+const (
+	ChangeInsert ChangeOp = "insert"
+	ChangeUpdate ChangeOp = "update"
+	ChangeDelete ChangeOp = "delete"
+)
+
+type ChangeEvent[T Identifier] struct {
+	Op         ChangeOp `json:"op"`
+	Id         string   `json:"id"`
+	OldVersion int64    `json:"old_version"` // 0 on insert or if the backend does not know it
+	NewVersion int64    `json:"new_version"` // 0 on delete
+	Item       *T       `json:"item"`        // nil on delete
+	// Position is an opaque token to resume watching right after this event,
+	// empty if the backend can not resume.
+	Position string `json:"position,omitempty"`
+}
+
+// Watcher streams the changes of a store. The channel is closed when ctx is
+// done or the underlying stream fails. from is the Position of a previously
+// received event to resume after it, or empty to receive changes from now on;
+// stores that can not resume return ErrResumeNotSupported.
+type Watcher[T Identifier] interface {
+	Watch(ctx context.Context, from string) (<-chan ChangeEvent[T], error)
+}
+
+// broadcaster fans out events to in-process subscribers. Publishing never
+// blocks: every subscriber has its own unbounded queue.
+type broadcaster[T Identifier] struct {
+	mutex       sync.Mutex
+	subscribers map[*subscriber[T]]struct{}
+	codec       Codec // copies the published items, nil is Clone
+}
+
+type subscriber[T Identifier] struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	queue  []ChangeEvent[T]
+	closed bool
+}
+
+func (b *broadcaster[T]) subscribe(ctx context.Context) <-chan ChangeEvent[T] {
+	s := &subscriber[T]{}
+	s.cond = sync.NewCond(&s.mutex)
+
+	b.mutex.Lock()
+	if b.subscribers == nil {
+		b.subscribers = map[*subscriber[T]]struct{}{}
+	}
+	b.subscribers[s] = struct{}{}
+	b.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.mutex.Lock()
+		delete(b.subscribers, s)
+		b.mutex.Unlock()
+
+		s.mutex.Lock()
+		s.closed = true
+		s.cond.Broadcast()
+		s.mutex.Unlock()
+	}()
+
+	out := make(chan ChangeEvent[T])
+	go func() {
+		defer close(out)
+		for {
+			s.mutex.Lock()
+			for len(s.queue) == 0 && !s.closed {
+				s.cond.Wait()
+			}
+			if s.closed {
+				s.mutex.Unlock()
+				return
+			}
+			event := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mutex.Unlock()
+
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// publish sends a copy of the item to every subscriber
+func (b *broadcaster[T]) publish(op ChangeOp, id string, oldVersion, newVersion int64, item *T) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for s := range b.subscribers {
+		event := ChangeEvent[T]{
+			Op:         op,
+			Id:         id,
+			OldVersion: oldVersion,
+			NewVersion: newVersion,
+		}
+		if item != nil {
+			// the item was copied when stored, so it can be copied again
+			event.Item, _ = copyItem(b.codec, item)
+		}
+
+		s.mutex.Lock()
+		s.queue = append(s.queue, event)
+		s.cond.Signal()
+		s.mutex.Unlock()
+	}
+}